@@ -0,0 +1,109 @@
+package wal
+
+// Future reports when a record written with Append is durable
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed once the record is durable or
+// failed to become durable
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err waits for the record to become durable and returns nil, or the error
+// that kept it from becoming durable
+func (f *Future) Err() error {
+	<-f.done
+	return f.err
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Append writes data like Write and returns a future that is done once the
+// record was synced, so that many records can be appended before awaiting
+// their durability together. The records appended meanwhile share a sync,
+// with Options.MaxCommitDelay the group commit of synced writes. If the
+// write itself fails, the position is nil and the future is done with the
+// error right away.
+func (w *WAL) Append(data []byte) (*Position, *Future) {
+	f := newFuture()
+	if w.opts.ReadOnly {
+		f.resolve(ErrReadOnly)
+		return nil, f
+	}
+	if err := w.lockWrite(); err != nil {
+		f.resolve(err)
+		return nil, f
+	}
+	pos, err := w.write(data, 0)
+	if err != nil {
+		w.mu.Unlock()
+		f.resolve(err)
+		return nil, f
+	}
+	w.appended = append(w.appended, f)
+	w.mu.Unlock()
+
+	if w.appendTask != nil {
+		w.opts.BackgroundScheduler.trigger(w.appendTask)
+		return pos, f
+	}
+	select {
+	case w.appendC <- struct{}{}:
+	default: // A sync is already due
+	}
+	return pos, f
+}
+
+// syncAppends syncs the records written with Append and resolves their
+// futures until the WAL is closed. Records appended during a sync are synced
+// together by the next one.
+func (w *WAL) syncAppends() {
+	for {
+		select {
+		case <-w.appendC:
+		case <-w.closeC:
+			return
+		}
+		w.syncAppended()
+	}
+}
+
+// syncAppended syncs the records written with Append so far and resolves
+// their futures
+func (w *WAL) syncAppended() {
+	w.mu.Lock()
+	futures := w.appended
+	w.appended = nil
+	w.mu.Unlock()
+	if len(futures) == 0 {
+		return
+	}
+
+	var err error
+	if w.committer != nil {
+		err = w.committer.commit(w.closeC)
+	} else {
+		err = w.Sync()
+	}
+	if err != nil {
+		w.mu.Lock()
+		if w.isClosed() {
+			// Close synced the records, or failed to
+			err = w.closeErr
+		}
+		w.mu.Unlock()
+	}
+	for _, f := range futures {
+		f.resolve(err)
+	}
+}
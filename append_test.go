@@ -0,0 +1,75 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Append(t *testing.T) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("MaxCommitDelay=%v", delay), func(t *testing.T) {
+			fs := newCountingFS()
+			fs.syncDelay = time.Millisecond
+			opts := Options{
+				Directory:      t.TempDir(),
+				SegmentSize:    4096,
+				SyncInterval:   1 * time.Hour,
+				MaxCommitDelay: delay,
+				FS:             fs,
+			}
+			wal, err := Open(opts)
+			assert.NoError(t, err)
+
+			const n = 500
+			var positions []*Position
+			var futures []*Future
+			for i := 0; i < n; i++ {
+				pos, f := wal.Append([]byte(fmt.Sprintf("record %d", i)))
+				assert.NotNil(t, pos)
+				positions = append(positions, pos)
+				futures = append(futures, f)
+			}
+			for _, f := range futures {
+				<-f.Done()
+				assert.NoError(t, f.Err())
+			}
+			assert.Less(t, fs.syncs.Load(), int64(n), "appends share syncs")
+
+			// All records are on disk in order, the last one included
+			last := positions[n-1]
+			seg := wal.segments[last.SegmentId]
+			assert.Greater(t, seg.flushedSize(), int64(last.BlockId)*blockSize+int64(last.Offset))
+			for i := 1; i < n; i++ {
+				assert.True(t, positions[i-1].SegmentId < positions[i].SegmentId ||
+					positions[i-1].SegmentId == positions[i].SegmentId && positions[i-1].Offset < positions[i].Offset)
+			}
+			assert.NoError(t, wal.Close())
+
+			wal, err = Open(opts)
+			assert.NoError(t, err)
+			defer wal.Close()
+			r, err := wal.NewReader(&Position{})
+			assert.NoError(t, err)
+			for i := 0; i < n; i++ {
+				data, at, err := r.next()
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+				assert.Equal(t, *positions[i], at)
+			}
+			_, err = r.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestWAL_AppendAfterClose(t *testing.T) {
+	wal, err := Open(Options{Directory: t.TempDir(), SegmentSize: 1 * GB, SyncInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+	_, f := wal.Append([]byte("record"))
+	assert.NoError(t, wal.Close())
+	assert.NoError(t, f.Err(), "Close syncs the appended records")
+}
@@ -0,0 +1,177 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// archivedFile is the name of the file in Options.Directory holding the
+// position of the first segment not archived yet, see Options.Archiver
+const archivedFile = "archived"
+
+// Archiver keeps sealed segments in long-term storage, like an object store,
+// see Options.Archiver. Its methods may be called concurrently.
+type Archiver interface {
+	// Archive durably stores the file of the segment with the given id, read
+	// from r. A segment may be archived again, e.g. after a crash before its
+	// upload was recorded, and then replaces the stored file.
+	Archive(id int, r io.Reader) error
+	// Fetch writes the file of the segment with the given id, as stored by
+	// Archive, to w.
+	Fetch(id int, w io.Writer) error
+}
+
+// loadArchived reads which segments were archived. Without the file of
+// Options.Directory recording it none were.
+func (w *WAL) loadArchived() error {
+	path := filepath.Join(w.opts.Directory, archivedFile)
+	pos, ok, err := readPositionFile(w.opts.FS, path)
+	if errors.Is(err, errInvalidPositionFile) {
+		return fmt.Errorf("invalid archive file %s", path)
+	}
+	if err != nil {
+		return err
+	}
+	if ok {
+		w.archivedTo = pos.SegmentId
+		return nil
+	}
+	w.archivedTo = w.segment.Id()
+	for id := range w.segments {
+		w.archivedTo = min(w.archivedTo, id)
+	}
+	return nil
+}
+
+// setArchived durably records that the segments before id are archived,
+// w.mu held
+func (w *WAL) setArchived(id int) error {
+	if err := writePositionFile(w.opts.FS, filepath.Join(w.opts.Directory, archivedFile), &Position{SegmentId: id}); err != nil {
+		return err
+	}
+	w.archivedTo = id
+	return nil
+}
+
+// nextToArchive returns the id and path of the sealed segment to archive
+// next, reporting false if all are, w.mu held
+func (w *WAL) nextToArchive() (int, string, bool) {
+	next, ok := 0, false
+	for id := range w.segments {
+		if id >= w.archivedTo && w.segments[id] != w.segment && (!ok || id < next) {
+			next, ok = id, true
+		}
+	}
+	if !ok {
+		return 0, "", false
+	}
+	return next, w.segments[next].path, true
+}
+
+// triggerArchive wakes up the archival of the sealed segments
+func (w *WAL) triggerArchive() {
+	switch {
+	case w.archiveTask != nil:
+		w.opts.BackgroundScheduler.trigger(w.archiveTask)
+	case w.archiveC != nil:
+		select {
+		case w.archiveC <- struct{}{}:
+		default: // The archival is already due
+		}
+	}
+}
+
+// archiveSegments archives the segments sealed by rotations until the WAL
+// is closed
+func (w *WAL) archiveSegments() {
+	for {
+		select {
+		case <-w.archiveC:
+		case <-w.closeC:
+			return
+		}
+		w.archiveSealed()
+	}
+}
+
+// archiveSealed uploads the sealed segments not archived yet in order. The
+// uploads run outside of the lock, a failure is reported to
+// Options.ErrorHandler and retried with the next rotation.
+func (w *WAL) archiveSealed() {
+	for {
+		w.mu.RLock()
+		id, path, ok := w.nextToArchive()
+		w.mu.RUnlock()
+		if !ok {
+			return
+		}
+		err := w.upload(id, path)
+		w.mu.Lock()
+		switch {
+		case w.isClosed():
+			w.mu.Unlock()
+			return // Uploaded again after reopening
+		case w.archivedTo > id:
+			err = nil // Purge archived it in the meantime
+		case err == nil:
+			err = w.setArchived(id + 1)
+		}
+		w.mu.Unlock()
+		if err != nil {
+			w.handleError(fmt.Errorf("archive: segment %d: %w", id, err))
+			return
+		}
+	}
+}
+
+// archiveUpTo uploads the sealed segments up to id that are not archived
+// yet, w.mu held. Purge calls it so that only archived segments are deleted.
+func (w *WAL) archiveUpTo(id int) error {
+	for {
+		next, path, ok := w.nextToArchive()
+		if !ok || next > id {
+			return nil
+		}
+		if err := w.upload(next, path); err != nil {
+			return fmt.Errorf("failed to archive segment %d: %w", next, err)
+		}
+		if err := w.setArchived(next + 1); err != nil {
+			return err
+		}
+	}
+}
+
+// upload passes the file of the sealed segment at path to Options.Archiver
+func (w *WAL) upload(id int, path string) error {
+	f, err := w.opts.FS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.opts.Archiver.Archive(id, f)
+}
+
+// fetch stores the archived segment with the given id at path
+func (w *WAL) fetch(id int, path string) error {
+	if err := w.opts.FS.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := w.opts.FS.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := w.opts.Archiver.Fetch(id, f); err != nil {
+		_ = f.Close()
+		_ = w.opts.FS.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = w.opts.FS.Remove(tmp)
+		return err
+	}
+	return w.opts.FS.Rename(tmp, path)
+}
@@ -0,0 +1,174 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memArchiver is an Archiver keeping the segments in memory
+type memArchiver struct {
+	mu       sync.Mutex
+	segments map[int][]byte
+	uploads  int
+	fetches  int
+	fail     atomic.Bool
+}
+
+func newMemArchiver() *memArchiver {
+	return &memArchiver{segments: make(map[int][]byte)}
+}
+
+func (a *memArchiver) Archive(id int, r io.Reader) error {
+	if a.fail.Load() {
+		return errors.New("archive unavailable")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.segments[id] = data
+	a.uploads++
+	return nil
+}
+
+func (a *memArchiver) Fetch(id int, w io.Writer) error {
+	a.mu.Lock()
+	data, ok := a.segments[id]
+	a.fetches++
+	a.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+func (a *memArchiver) archived(id int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.segments[id]
+	return ok
+}
+
+func TestWAL_Archiver(t *testing.T) {
+	archiver := newMemArchiver()
+	opts := Options{
+		Directory:        t.TempDir(),
+		ArchiveDirectory: t.TempDir(),
+		Archiver:         archiver,
+		SegmentSize:      4 * KB,
+		SyncInterval:     1 * time.Hour,
+		BlockSize:        1 * KB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var positions []*Position
+	var records []string
+	for i := 0; i < 100; i++ {
+		record := fmt.Sprintf("record %d %s", i, make([]byte, i*10))
+		pos, err := wal.Write([]byte(record))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Sync())
+	active := wal.segment.Id()
+	assert.Greater(t, active, 2)
+
+	// The sealed segments are uploaded in the background
+	assert.Eventually(t, func() bool { return archiver.archived(active - 1) }, time.Second, time.Millisecond)
+	assert.False(t, archiver.archived(active))
+	for id := 0; id < active; id++ {
+		local, err := os.ReadFile(wal.segments[id].path)
+		assert.NoError(t, err)
+		assert.Equal(t, local, archiver.segments[id], "segment %d", id)
+	}
+
+	// Purged segments are deleted and fetched again when read
+	last := positions[len(positions)-1]
+	assert.NoError(t, wal.Truncate(last))
+	_, err = os.Stat(filepath.Join(opts.Directory, defaultPathFor(0)))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(opts.ArchiveDirectory, defaultPathFor(0)))
+	assert.True(t, os.IsNotExist(err))
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], string(data))
+	}
+	assert.Equal(t, active, archiver.fetches)
+	_, err = os.Stat(filepath.Join(opts.ArchiveDirectory, defaultPathFor(0)))
+	assert.NoError(t, err, "fetched segments are cached")
+	assert.NoError(t, wal.Close())
+
+	// What was archived survives reopening, the cache too
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, active, wal.archivedTo)
+	data, err := wal.Read(positions[0])
+	assert.NoError(t, err)
+	assert.Equal(t, records[0], string(data))
+	assert.Equal(t, active, archiver.fetches)
+
+	// Purging a cached segment drops it from the cache
+	assert.NoError(t, wal.Purge(0))
+	_, err = os.Stat(filepath.Join(opts.ArchiveDirectory, defaultPathFor(0)))
+	assert.True(t, os.IsNotExist(err))
+	archiver.mu.Lock()
+	assert.Equal(t, active, archiver.uploads, "every segment is uploaded once")
+	archiver.mu.Unlock()
+}
+
+func TestWAL_ArchiverPurge(t *testing.T) {
+	archiver := newMemArchiver()
+	archiver.fail.Store(true)
+	var errs atomic.Int32
+	opts := Options{
+		Directory:        t.TempDir(),
+		ArchiveDirectory: t.TempDir(),
+		Archiver:         archiver,
+		SegmentSize:      4 * KB,
+		SyncInterval:     1 * time.Hour,
+		BlockSize:        1 * KB,
+		ErrorHandler:     func(err error) { errs.Add(1) },
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d %s", i, make([]byte, i*10))))
+		assert.NoError(t, err)
+	}
+	assert.Greater(t, wal.segment.Id(), 2)
+	assert.Eventually(t, func() bool { return errs.Load() > 0 }, time.Second, time.Millisecond)
+
+	// Segments are only deleted once they are archived
+	path := wal.segments[1].path
+	assert.Error(t, wal.Purge(1))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	// Purge archives the segments before the one purged as well
+	archiver.fail.Store(false)
+	assert.NoError(t, wal.Purge(1))
+	assert.True(t, archiver.archived(0))
+	assert.True(t, archiver.archived(1))
+	assert.Equal(t, 2, wal.archivedTo)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
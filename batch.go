@@ -0,0 +1,226 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Error constants
+var (
+	ErrInvalidBatch = errors.New("invalid batch framing")
+)
+
+// WriteBatch writes records in order under a single acquisition of the lock,
+// rotating the segment as needed, then flushes and syncs the active segment
+// once. It returns the positions of the records. If a write or the sync
+// fails, it returns the positions of the records written so far along with
+// the error. The batch is durable once WriteBatch returns, whatever the
+// Options.SyncPolicy.
+func (w *WAL) WriteBatch(records [][]byte) ([]*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := w.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer w.mu.Unlock()
+	positions := make([]*Position, 0, len(records))
+	for i, record := range records {
+		pos, err := w.write(record, 0)
+		if err != nil {
+			return positions, fmt.Errorf("record %d of the batch: %w", i, err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := w.syncActive(); err != nil {
+		return positions, err
+	}
+	w.notifyFlushed()
+	return positions, nil
+}
+
+// WriteAtomicBatch writes records in order like WriteBatch, but as an atomic
+// batch: after a crash either all of them are recovered or none. All but
+// the last record are written and synced first, flagged as part of the
+// batch, and the sync of the last record then commits it. Opening the WAL
+// for writing discards the records of a batch that was not committed, a
+// read-only WAL still returns them. The batch is written to one segment,
+// which may grow beyond Options.SegmentSize for it. If a write or a sync
+// fails, the records of the batch written so far are discarded again and
+// no position is returned.
+func (w *WAL) WriteAtomicBatch(records [][]byte) ([]*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if w.opts.SingleRecordSegments {
+		return nil, errors.New("atomic batches are not supported with SingleRecordSegments")
+	}
+	if err := w.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer w.mu.Unlock()
+	chainHash := w.chainHash
+	positions := make([]*Position, 0, len(records))
+	for i, record := range records {
+		flags := kBatchFlag
+		if i == len(records)-1 {
+			// The rest of the batch is durable, its last record commits it
+			if err := w.syncActive(); err != nil {
+				return nil, w.rollbackBatch(positions, chainHash, err)
+			}
+			flags = 0
+		}
+		pos, err := w.write(record, flags)
+		if err != nil {
+			return nil, w.rollbackBatch(positions, chainHash, fmt.Errorf("record %d of the batch: %w", i, err))
+		}
+		positions = append(positions, pos)
+		w.batching = true // The first record rotated the segment if needed
+	}
+	w.batching = false
+	if err := w.syncActive(); err != nil {
+		return nil, w.rollbackBatch(positions, chainHash, err)
+	}
+	w.notifyFlushed()
+	return positions, nil
+}
+
+// rollbackBatch discards the records of an atomic batch written so far at
+// positions after it failed with err, restoring the chain hash from before
+// the batch. It returns err, joined with the error of the rollback.
+func (w *WAL) rollbackBatch(positions []*Position, chainHash [chainHashSize]byte, err error) error {
+	w.batching = false
+	if len(positions) == 0 {
+		return err
+	}
+	start := *positions[0]
+	if ferr := w.segment.flushBlock(false); ferr != nil {
+		return errors.Join(err, ferr)
+	}
+	if cerr := w.cutActive(w.segment.fileOffset(start)); cerr != nil {
+		return errors.Join(err, cerr)
+	}
+	w.chainHash = chainHash
+	if kerr := w.rebuildKeys(); kerr != nil {
+		return errors.Join(err, kerr)
+	}
+	if w.seqIndex != nil {
+		if serr := w.seqIndex.truncate(w.seqIndex.search(start)); serr != nil {
+			return errors.Join(err, serr)
+		}
+	}
+	return err
+}
+
+// dropUncommittedBatch cuts the records of an atomic batch that was not
+// committed off the end of the active segment, see WriteAtomicBatch
+func (w *WAL) dropUncommittedBatch() error {
+	start, ok := w.segment.uncommittedBatch()
+	if !ok {
+		return nil
+	}
+	return w.cutActive(w.segment.fileOffset(start))
+}
+
+// uncommittedBatch returns the position of the first record of an atomic
+// batch at the end of the segment that lacks its last record, the one
+// committing it. Only the tail of the segment is scanned: it starts at the
+// last block beginning with an intact record outside of any batch.
+func (s *Segment) uncommittedBatch() (Position, bool) {
+	for blockID := int((s.flushedSize() - 1) / int64(s.blockSize)); blockID > 0; blockID-- {
+		blockData, err := s.readBlock(blockID)
+		if err != nil {
+			continue
+		}
+		chk, err := s.readChunk(blockData, false)
+		base := chk.chunkType &^ (kTombstoneFlag | kCheckpointFlag | kKeyedFlag | kCompressedFlag | kZstdFlag)
+		if err != nil || len(chk.data) == 0 || (base != kFullType && base != kFirstType) {
+			continue // Not the start of a record outside of a batch
+		}
+		if start, ok, intact := s.scanBatch(Position{SegmentId: s.id, BlockId: blockID}); intact {
+			return start, ok
+		}
+	}
+	start, ok, _ := s.scanBatch(Position{SegmentId: s.id})
+	return start, ok
+}
+
+// scanBatch scans the records from pos on for an atomic batch lacking its
+// last record, see uncommittedBatch. A torn or corrupt record ends the
+// scan. intact reports whether the record at pos was read.
+func (s *Segment) scanBatch(pos Position) (start Position, ok, intact bool) {
+	for first := true; ; first = false {
+		_, at, next, err := s.scanNext(pos, false)
+		if err != nil && err != ErrTombstoned && err != errCheckpoint {
+			return start, ok, !first
+		}
+		blockData, err := s.readBlock(at.BlockId)
+		if err != nil {
+			return start, ok, !first
+		}
+		chk, err := s.readChunk(blockData[at.Offset:], false)
+		if err != nil {
+			return start, ok, !first
+		}
+		if chk.chunkType&kBatchFlag == 0 {
+			ok = false
+		} else if !ok {
+			start, ok = at, true
+		}
+		pos = next
+	}
+}
+
+// WriteBatchAsOne writes entries as a single record, each entry prefixed by
+// its uvarint encoded length, so that the batch is covered by one set of
+// chunk headers and CRCs instead of one per entry. The batch can only be read
+// back as a whole with ReadBatch.
+func (w *WAL) WriteBatchAsOne(entries [][]byte) (*Position, error) {
+	size := 0
+	for _, entry := range entries {
+		size += uvarintLen(uint64(len(entry))) + len(entry)
+	}
+	buf := w.pool.Alloc(size)
+	for _, entry := range entries {
+		buf = binary.AppendUvarint(buf, uint64(len(entry)))
+		buf = append(buf, entry...)
+	}
+	pos, err := w.Write(buf)
+	w.pool.Free(buf)
+	return pos, err
+}
+
+// ReadBatch reads the batch written by WriteBatchAsOne at pos
+func (w *WAL) ReadBatch(pos *Position) ([][]byte, error) {
+	data, err := w.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBatch(data)
+}
+
+// decodeBatch splits the framed batch record into its entries
+func decodeBatch(data []byte) ([][]byte, error) {
+	var entries [][]byte
+	for len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return nil, ErrInvalidBatch
+		}
+		data = data[n:]
+		entries = append(entries, data[:length:length])
+		data = data[length:]
+	}
+	return entries, nil
+}
+
+// uvarintLen returns the number of bytes the uvarint encoding of x takes
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
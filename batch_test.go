@@ -0,0 +1,181 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_WriteBatchAsOne(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var entries [][]byte
+	for i := 0; i < 100; i++ {
+		entries = append(entries, []byte(fmt.Sprintf("entry %d", i)))
+	}
+	entries = append(entries, []byte{}, make([]byte, blockSize))
+
+	pos, err := wal.WriteBatchAsOne(entries)
+	assert.NoError(t, err)
+	next, err := wal.Write([]byte("after batch"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	got, err := wal.ReadBatch(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, entries, got)
+
+	data, err := wal.Read(next)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("after batch"), data)
+
+	_, err = decodeBatch([]byte{0x05, 'a'})
+	assert.ErrorIs(t, err, ErrInvalidBatch)
+}
+
+func TestWAL_WriteBatch(t *testing.T) {
+	fs := newCountingFS()
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  4 * KB,
+		SyncInterval: 1 * time.Hour,
+		NoSplit:      true,
+		FS:           fs,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var records [][]byte
+	for i := 0; i < 500; i++ {
+		records = append(records, []byte(fmt.Sprintf("record %d", i)))
+	}
+	syncs := fs.syncs.Load()
+	positions, err := wal.WriteBatch(records)
+	assert.NoError(t, err)
+	assert.Len(t, positions, len(records))
+	assert.Greater(t, positions[len(positions)-1].SegmentId, positions[0].SegmentId, "the batch rotates segments")
+	assert.Equal(t, int64(positions[len(positions)-1].SegmentId-positions[0].SegmentId+1), fs.syncs.Load()-syncs,
+		"one sync per rotation and one at the end")
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data)
+	}
+
+	// A failing record stops the batch, the records before it stay written
+	failing := [][]byte{[]byte("a"), []byte("b"), make([]byte, blockSize), []byte("c")}
+	positions, err = wal.WriteBatch(failing)
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	assert.Len(t, positions, 2)
+	data, err := wal.Read(positions[1])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), data)
+}
+
+func TestWAL_WriteAtomicBatch(t *testing.T) {
+	// The first record fills block 0, so the scan for an uncommitted batch
+	// can start at block 1
+	before := [][]byte{
+		make([]byte, blockSize-segmentHeaderSize-ChecksumCRC32.chunkHeaderSize()),
+		[]byte("before 1"),
+		[]byte("before 2"),
+	}
+	batch := [][]byte{
+		[]byte("batch 0"),
+		bytes.Repeat([]byte{1}, 2*blockSize),
+		{},
+		[]byte("batch 3"),
+		bytes.Repeat([]byte{4}, blockSize/2),
+	}
+	readAll := func(wal *WAL) [][]byte {
+		r, err := wal.NewReader(&Position{})
+		assert.NoError(t, err)
+		defer r.Close()
+		var records [][]byte
+		for {
+			data, err := r.Next()
+			if err == io.EOF {
+				return records
+			}
+			if !assert.NoError(t, err) {
+				return records
+			}
+			records = append(records, data)
+		}
+	}
+	write := func(dir string) []*Position {
+		wal, err := Open(Options{Directory: dir, SegmentSize: 1 * MB, SyncInterval: 1 * time.Hour})
+		assert.NoError(t, err)
+		defer wal.Close()
+		written, err := wal.WriteBatch(before)
+		assert.NoError(t, err)
+		assert.Equal(t, Position{SegmentId: written[0].SegmentId, BlockId: 1}, *written[1])
+		positions, err := wal.WriteAtomicBatch(batch)
+		assert.NoError(t, err)
+		assert.Len(t, positions, len(batch))
+		for _, pos := range positions {
+			assert.Equal(t, positions[0].SegmentId, pos.SegmentId, "the batch stays in one segment")
+		}
+		assert.Equal(t, append(append([][]byte{}, before...), batch...), readAll(wal))
+		return positions
+	}
+
+	// A crash anywhere before the last record of the batch is durable
+	// recovers the WAL without any record of the batch
+	dir := t.TempDir()
+	positions := write(dir)
+	offset := func(pos *Position) int64 { return int64(pos.BlockId)*blockSize + int64(pos.Offset) }
+	last := offset(positions[len(positions)-1])
+	for _, cut := range []int64{offset(positions[1]), offset(positions[1]) + blockSize, offset(positions[3]), last, last + 10} {
+		t.Run(fmt.Sprint(cut), func(t *testing.T) {
+			dir := t.TempDir()
+			positions := write(dir)
+			path := filepath.Join(dir, defaultPathFor(positions[0].SegmentId))
+			assert.NoError(t, os.Truncate(path, cut))
+
+			wal, err := Open(Options{Directory: dir, SegmentSize: 1 * MB, SyncInterval: 1 * time.Hour})
+			assert.NoError(t, err)
+			defer wal.Close()
+			assert.Equal(t, before, readAll(wal))
+			pos, err := wal.Write([]byte("after"))
+			assert.NoError(t, err)
+			assert.NoError(t, wal.Sync())
+			assert.Equal(t, offset(positions[0]), offset(pos), "appended where the batch started")
+			assert.Equal(t, append(append([][]byte{}, before...), []byte("after")), readAll(wal))
+		})
+	}
+
+	// A committed batch survives reopening
+	wal, err := Open(Options{Directory: dir, SegmentSize: 1 * MB, SyncInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, append(append([][]byte{}, before...), batch...), readAll(wal))
+	assert.NoError(t, wal.Close())
+
+	// A failing batch leaves nothing behind
+	wal, err = Open(Options{Directory: t.TempDir(), SegmentSize: 1 * GB, SyncInterval: 1 * time.Hour, NoSplit: true})
+	assert.NoError(t, err)
+	defer wal.Close()
+	_, err = wal.WriteBatch(before)
+	assert.NoError(t, err)
+	positions, err = wal.WriteAtomicBatch([][]byte{[]byte("a"), []byte("b"), make([]byte, blockSize)})
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	assert.Nil(t, positions)
+	_, err = wal.Write([]byte("after"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	assert.Equal(t, append(append([][]byte{}, before...), []byte("after")), readAll(wal))
+}
@@ -0,0 +1,100 @@
+package wal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockCache caches the blocks read from the segment files of a WAL, shared
+// by all its segments, and evicts the least recently used blocks beyond its
+// capacity, see Options.BlockCacheSize. It only holds blocks that no longer
+// change: those of sealed segments and the complete blocks of the active
+// one. Blocks rewritten in place are invalidated.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64 // Bytes of blocks held at most
+	size     int64 // Bytes of blocks held
+	lru      *list.List
+	blocks   map[*Segment]map[int]*list.Element // Elements of lru by segment and block id
+}
+
+// blockKey identifies a cached block. Segments are keyed by identity, so a
+// segment reopened after it was cut does not see the blocks of the old one.
+type blockKey struct {
+	seg *Segment
+	id  int
+}
+
+// cacheEntry is a cached block, the value of the elements of lru
+type cacheEntry struct {
+	key  blockKey
+	data []byte
+}
+
+// newBlockCache returns a cache of capacity bytes, or nil if capacity is
+// zero. A nil blockCache caches nothing.
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[*Segment]map[int]*list.Element),
+	}
+}
+
+// get returns the cached block id of seg
+func (c *blockCache) get(seg *Segment, id int) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[seg][id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// put caches data as block id of seg. data must not be modified afterwards.
+func (c *blockCache) put(seg *Segment, id int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[seg][id]; ok {
+		c.remove(e)
+	}
+	if c.blocks[seg] == nil {
+		c.blocks[seg] = make(map[int]*list.Element)
+	}
+	c.blocks[seg][id] = c.lru.PushFront(&cacheEntry{key: blockKey{seg, id}, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// drop removes the blocks of seg, e.g. once it was closed or rewritten
+func (c *blockCache) drop(seg *Segment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.blocks[seg] {
+		c.remove(e)
+	}
+}
+
+// remove removes the cached block of e, c.mu held
+func (c *blockCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	blocks := c.blocks[entry.key.seg]
+	delete(blocks, entry.key.id)
+	if len(blocks) == 0 {
+		delete(c.blocks, entry.key.seg)
+	}
+	c.size -= int64(len(entry.data))
+}
@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_BlockCacheSize(t *testing.T) {
+	opts := Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    4 * KB,
+		SyncInterval:   1 * time.Hour,
+		BlockSize:      1 * KB,
+		BlockCacheSize: 4 * KB,
+		AllowOverwrite: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records []string
+	for i := 0; i < 100; i++ {
+		record := fmt.Sprintf("record %d %s", i, make([]byte, i*10))
+		pos, err := wal.Write([]byte(record))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, wal.segment.Id(), 2)
+
+	// Alternating between blocks of different segments is served by the
+	// shared cache once they were read
+	first, last := positions[0], positions[len(positions)-1]
+	for _, pos := range []*Position{first, last} {
+		_, err := wal.Read(pos)
+		assert.NoError(t, err)
+	}
+	misses := wal.Stats().CacheMisses
+	for i := 0; i < 5; i++ {
+		for _, pos := range []*Position{first, last} {
+			data, err := wal.Read(pos)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, data)
+		}
+	}
+	assert.Equal(t, misses, wal.Stats().CacheMisses)
+
+	// The cache is bounded by its size
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], string(data))
+	}
+	wal.blockCache.mu.Lock()
+	assert.LessOrEqual(t, wal.blockCache.size, opts.BlockCacheSize)
+	assert.Equal(t, int64(wal.blockCache.lru.Len()*opts.BlockSize), wal.blockCache.size)
+	wal.blockCache.mu.Unlock()
+
+	// Overwrites invalidate the cached blocks of the segment
+	_, err = wal.Read(first)
+	assert.NoError(t, err)
+	replaced := []byte(records[0])
+	copy(replaced, "REPLACED")
+	assert.NoError(t, wal.Overwrite(first, replaced))
+	data, err := wal.Read(first)
+	assert.NoError(t, err)
+	assert.Equal(t, replaced, data)
+
+	// Closing the WAL drops the cached blocks
+	assert.NoError(t, wal.Close())
+	assert.Zero(t, wal.blockCache.lru.Len())
+	assert.Zero(t, wal.blockCache.size)
+}
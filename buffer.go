@@ -0,0 +1,53 @@
+package wal
+
+import "sync"
+
+// maxPooledBuffer is the capacity above which buffers are not pooled, so
+// that a few huge records do not pin their memory
+const maxPooledBuffer = 1 * MB
+
+// Buffers are pooled separately from bp, whose counters are not safe for
+// Release calls racing with reads.
+var bufferPool = sync.Pool{
+	New: func() any { return new(Buffer) },
+}
+
+// Buffer holds a record read with ReadBuffer in memory taken from a pool.
+// Release returns the memory to the pool, after which the record must no
+// longer be used. A Buffer must not be used by several goroutines at once.
+type Buffer struct {
+	buf  []byte // Reassembled record, chain hash and key included
+	data []byte // The record within buf
+}
+
+// Bytes returns the record. It is valid until Release is called.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Release returns the buffer to the pool
+func (b *Buffer) Release() {
+	if cap(b.buf) > maxPooledBuffer {
+		b.buf = nil
+	}
+	b.data = nil
+	bufferPool.Put(b)
+}
+
+// ReadBuffer reads the record at pos like Read, reassembling it in a pooled
+// buffer rather than a newly allocated one.
+func (s *Segment) ReadBuffer(pos *Position) (*Buffer, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	b := bufferPool.Get().(*Buffer)
+	entry, _, err := s.readInto(b.buf, pos)
+	if err != nil && err != errCheckpoint {
+		b.Release()
+		return nil, err
+	}
+	if cap(entry) > cap(b.buf) {
+		b.buf = entry[:0] // Grown for the record, keep the larger capacity
+	}
+	b.data = entry
+	return b, nil
+}
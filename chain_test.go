@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_VerifyChainDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		Directory:    dir,
+		SegmentSize:  512,
+		SyncInterval: 1 * time.Hour,
+		HashChain:    true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 30; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	// The chain continues across a restart
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	for i := 30; i < 40; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.VerifyChain())
+	data, err := wal.Read(positions[3])
+	assert.NoError(t, err)
+	assert.Equal(t, "record 3", string(data))
+
+	// Readers see the payloads without the chain hash
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, wal.Close())
+
+	// Change the payload of a record, fixing up its CRC as an attacker would
+	tampered := positions[17]
+	seg, err := NewSegment(tampered.SegmentId, opts.withDefaults().segmentPath(dir, tampered.SegmentId))
+	assert.NoError(t, err)
+	stored, _, _, err := seg.readStored(nil, tampered)
+	assert.NoError(t, err)
+	stored[len(stored)-1] = 'X'
+	assert.NoError(t, seg.Overwrite(tampered, stored))
+	assert.NoError(t, seg.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	data, err = wal.Read(tampered)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 1X", string(data))
+	err = wal.VerifyChain()
+	assert.ErrorIs(t, err, ErrChainBroken)
+	assert.ErrorContains(t, err, fmt.Sprintf("%+v", *tampered))
+}
+
+func TestWAL_HashChainRejectsAllowOverwrite(t *testing.T) {
+	_, err := Open(Options{Directory: t.TempDir(), SegmentSize: 1 * GB, HashChain: true, AllowOverwrite: true})
+	assert.Error(t, err)
+}
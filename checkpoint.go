@@ -0,0 +1,68 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// checkpointFile is the name of the file in Options.Directory holding the
+// position of the latest checkpoint
+const checkpointFile = "checkpoint"
+
+var ErrNoCheckpoint = errors.New("no checkpoint was written")
+
+// WriteCheckpoint writes a checkpoint record holding state and syncs it,
+// then durably records its position as the latest checkpoint. Readers skip
+// checkpoint records, so a Reader created at the position returned by
+// LatestCheckpoint replays only the records written after it.
+func (w *WAL) WriteCheckpoint(state []byte) (*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pos, err := w.write(state, kCheckpointFlag)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.syncActive(); err != nil {
+		return nil, err
+	}
+	w.notifyFlushed()
+	if err := writePositionFile(w.opts.FS, filepath.Join(w.opts.Directory, checkpointFile), pos); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+// LatestCheckpoint returns the position and state of the checkpoint written
+// last, or ErrNoCheckpoint if there is none.
+func (w *WAL) LatestCheckpoint() (*Position, []byte, error) {
+	path := filepath.Join(w.opts.Directory, checkpointFile)
+	pos, ok, err := readPositionFile(w.opts.FS, path)
+	if errors.Is(err, errInvalidPositionFile) {
+		return nil, nil, fmt.Errorf("invalid checkpoint file %s", path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrNoCheckpoint
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return nil, nil, fmt.Errorf("segment %d of the latest checkpoint not found", pos.SegmentId)
+	}
+	state, _, err := seg.read(&pos)
+	if err != errCheckpoint {
+		if err == nil {
+			err = errors.New("not a checkpoint record")
+		}
+		return nil, nil, fmt.Errorf("latest checkpoint at %+v: %w", pos, err)
+	}
+	return &pos, state, nil
+}
@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Checkpoint(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	_, _, err = wal.LatestCheckpoint()
+	assert.ErrorIs(t, err, ErrNoCheckpoint)
+
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+			assert.NoError(t, err)
+		}
+	}
+	write(0, 10)
+	_, err = wal.WriteCheckpoint([]byte("state 1"))
+	assert.NoError(t, err)
+	write(10, 20)
+	checkpoint, err := wal.WriteCheckpoint([]byte("state 2"))
+	assert.NoError(t, err)
+	write(20, 30)
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos, state, err := wal.LatestCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, checkpoint, pos)
+	assert.Equal(t, "state 2", string(state))
+
+	replay := func(pos *Position) []string {
+		reader, err := wal.NewReader(pos)
+		assert.NoError(t, err)
+		defer reader.Close()
+		var records []string
+		for {
+			data, err := reader.Next()
+			if err == io.EOF {
+				return records
+			}
+			assert.NoError(t, err)
+			records = append(records, string(data))
+		}
+	}
+	var expected []string
+	for i := 20; i < 30; i++ {
+		expected = append(expected, fmt.Sprintf("record %d", i))
+	}
+	assert.Equal(t, expected, replay(pos))
+	// A full replay skips the checkpoint records as well
+	assert.Len(t, replay(&Position{}), 30)
+
+	// Empty states are fine
+	checkpoint, err = wal.WriteCheckpoint(nil)
+	assert.NoError(t, err)
+	pos, state, err = wal.LatestCheckpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, checkpoint, pos)
+	assert.Empty(t, state)
+	assert.Empty(t, replay(pos))
+}
@@ -0,0 +1,186 @@
+// Command walinspect inspects the segment files of a WAL directory: it lists
+// the segments, dumps their blocks and chunks, verifies the chunk CRCs and
+// prints the records. The files are opened read-only, so it can be pointed
+// at the directory of a running WAL; the active segment is read as far as
+// it was written.
+//
+// Usage:
+//
+//	walinspect list <dir>
+//	walinspect dump [-segment id] <dir>
+//	walinspect verify [-segment id] <dir>
+//	walinspect records [-segment id] [-format string|hex|length] <dir>
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ongniud/wal"
+)
+
+const usage = `usage: walinspect <command> [flags] <dir>
+
+commands:
+  list     list the segment files with their size and block count
+  dump     print the blocks and chunks of the segments
+  verify   check the CRC and the order of every chunk
+  records  print the records with their positions
+
+flags:
+  -segment id                   only inspect the segment with this id
+  -format string|hex|length     how records prints payloads (default string)
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit code: 1 if damaged
+// segments were found, 2 for other errors
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	segment := flags.Int("segment", -1, "only inspect the segment with this id")
+	format := flags.String("format", "string", "how records prints payloads: string, hex or length")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var inspect func(seg *wal.Segment, file wal.SegmentFileInfo) error
+	switch command {
+	case "list":
+		fmt.Fprintf(stdout, "%-8s %-12s %-8s %s\n", "ID", "SIZE", "BLOCKS", "PATH")
+		inspect = func(seg *wal.Segment, file wal.SegmentFileInfo) error {
+			blocks := (seg.Size() + int64(seg.BlockSize()) - 1) / int64(seg.BlockSize())
+			_, err := fmt.Fprintf(stdout, "%-8d %-12d %-8d %s\n", file.Id, seg.Size(), blocks, file.Path)
+			return err
+		}
+	case "dump":
+		inspect = func(seg *wal.Segment, file wal.SegmentFileInfo) error {
+			return seg.Dump(stdout)
+		}
+	case "verify":
+		inspect = func(seg *wal.Segment, file wal.SegmentFileInfo) error {
+			if err := seg.QuickVerify(); err != nil {
+				return damagedError{err}
+			}
+			_, err := fmt.Fprintf(stdout, "segment %d ok\n", file.Id)
+			return err
+		}
+	case "records":
+		if *format != "string" && *format != "hex" && *format != "length" {
+			fmt.Fprintf(stderr, "unknown format %q\n", *format)
+			return 2
+		}
+		inspect = func(seg *wal.Segment, file wal.SegmentFileInfo) error {
+			return printRecords(stdout, seg, *format)
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", command)
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	files, err := wal.ListSegmentFiles(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	code, found := 0, false
+	for _, file := range files {
+		if *segment >= 0 && file.Id != *segment {
+			continue
+		}
+		found = true
+		err := inspectFile(file, inspect)
+		var damaged damagedError
+		switch {
+		case errors.As(err, &damaged):
+			fmt.Fprintf(stdout, "segment %d damaged: %v\n", file.Id, damaged.err)
+			code = 1
+		case err != nil:
+			fmt.Fprintf(stderr, "segment %d: %v\n", file.Id, err)
+			return 2
+		}
+	}
+	if *segment >= 0 && !found {
+		fmt.Fprintf(stderr, "segment %d not found\n", *segment)
+		return 2
+	}
+	return code
+}
+
+// damagedError reports a segment with damaged chunks, which does not stop
+// the inspection of the other segments
+type damagedError struct {
+	err error
+}
+
+func (e damagedError) Error() string {
+	return e.err.Error()
+}
+
+// inspectFile opens the segment file read-only and passes it to inspect
+func inspectFile(file wal.SegmentFileInfo, inspect func(seg *wal.Segment, file wal.SegmentFileInfo) error) error {
+	seg, err := wal.OpenSegmentReadOnly(file.Path)
+	if err != nil {
+		return err
+	}
+	defer seg.Close()
+	return inspect(seg, file)
+}
+
+// printRecords prints the position and payload of every record of seg. The
+// records of the blocks after one with a damaged chunk are still printed,
+// the damage is reported at the end.
+func printRecords(w io.Writer, seg *wal.Segment, format string) error {
+	var damaged error
+	for blockID := 0; int64(blockID)*int64(seg.BlockSize()) < seg.Size(); blockID++ {
+		positions, records, err := seg.RecordsInBlock(blockID)
+		for i, pos := range positions[:len(records)] {
+			if err := printRecord(w, pos, records[i], format); err != nil {
+				return err
+			}
+		}
+		if err != nil && damaged == nil {
+			damaged = fmt.Errorf("block %d: %w", blockID, err)
+		}
+	}
+	// The records of a block end at its first damaged chunk without an error
+	if err := seg.QuickVerify(); err != nil {
+		damaged = err
+	}
+	if damaged != nil {
+		return damagedError{damaged}
+	}
+	return nil
+}
+
+// printRecord prints a record at pos in the given format
+func printRecord(w io.Writer, pos *wal.Position, data []byte, format string) error {
+	var err error
+	switch format {
+	case "hex":
+		_, err = fmt.Fprintf(w, "%d:%d:%d length=%d %s\n", pos.SegmentId, pos.BlockId, pos.Offset, len(data), hex.EncodeToString(data))
+	case "length":
+		_, err = fmt.Fprintf(w, "%d:%d:%d length=%d\n", pos.SegmentId, pos.BlockId, pos.Offset, len(data))
+	default:
+		_, err = fmt.Fprintf(w, "%d:%d:%d length=%d %q\n", pos.SegmentId, pos.BlockId, pos.Offset, len(data), data)
+	}
+	return err
+}
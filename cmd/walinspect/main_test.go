@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ongniud/wal"
+)
+
+// writeWAL writes n records to a WAL in dir spread over several segments
+func writeWAL(t *testing.T, dir string, n int) []*wal.Position {
+	w, err := wal.Open(wal.Options{
+		Directory:    dir,
+		SegmentSize:  4 * wal.KB,
+		SyncInterval: 1 * time.Hour,
+		BlockSize:    1 * wal.KB,
+	})
+	assert.NoError(t, err)
+	var positions []*wal.Position
+	for i := 0; i < n; i++ {
+		pos, err := w.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, w.Close())
+	return positions
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	positions := writeWAL(t, dir, 500)
+	last := positions[len(positions)-1]
+	assert.Greater(t, last.SegmentId, 1)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, run([]string{"list", dir}, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, last.SegmentId+2, "a header and a line per segment")
+	assert.Contains(t, lines[1], filepath.Join(dir, "seg_0.log"))
+
+	stdout.Reset()
+	assert.Equal(t, 0, run([]string{"verify", dir}, &stdout, &stderr))
+	assert.Equal(t, last.SegmentId+1, strings.Count(stdout.String(), " ok\n"))
+
+	stdout.Reset()
+	assert.Equal(t, 0, run([]string{"dump", "-segment", "0", dir}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "segment 0 ")
+	assert.NotContains(t, stdout.String(), "segment 1 ")
+
+	stdout.Reset()
+	assert.Equal(t, 0, run([]string{"records", dir}, &stdout, &stderr))
+	lines = strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, len(positions))
+	assert.Equal(t, `0:0:`+fmt.Sprint(positions[0].Offset)+` length=8 "record 0"`, lines[0])
+
+	stdout.Reset()
+	assert.Equal(t, 0, run([]string{"records", "-format", "hex", "-segment", "0", dir}, &stdout, &stderr))
+	assert.True(t, strings.HasSuffix(strings.SplitN(stdout.String(), "\n", 2)[0], " 7265636f72642030"))
+
+	stdout.Reset()
+	assert.Equal(t, 0, run([]string{"records", "-format", "length", "-segment", "0", dir}, &stdout, &stderr))
+	assert.True(t, strings.HasSuffix(strings.SplitN(stdout.String(), "\n", 2)[0], " length=8"))
+
+	assert.Equal(t, 2, run([]string{"records", "-format", "base64", dir}, &stdout, &stderr))
+	assert.Equal(t, 2, run([]string{"unknown", dir}, &stdout, &stderr))
+	assert.Equal(t, 2, run([]string{"list"}, &stdout, &stderr))
+	assert.Equal(t, 2, run([]string{"dump", "-segment", "1000", dir}, &stdout, &stderr))
+}
+
+func TestRun_Damaged(t *testing.T) {
+	dir := t.TempDir()
+	positions := writeWAL(t, dir, 500)
+
+	// Damage a record in the second block of the first segment
+	var damaged *wal.Position
+	after := -1 // A record of the block after it
+	for i, pos := range positions {
+		if pos.SegmentId == 0 && pos.BlockId == 1 && damaged == nil {
+			damaged = pos
+		}
+		if pos.SegmentId == 0 && pos.BlockId == 2 && after < 0 {
+			after = i
+		}
+	}
+	path := filepath.Join(dir, "seg_0.log")
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[1*wal.KB+damaged.Offset+12] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 1, run([]string{"verify", dir}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "segment 0 damaged")
+	assert.Contains(t, stdout.String(), "segment 1 ok")
+
+	// The records of the other blocks are still printed
+	stdout.Reset()
+	assert.Equal(t, 1, run([]string{"records", "-segment", "0", dir}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), `"record 0"`)
+	assert.Contains(t, stdout.String(), "segment 0 damaged")
+	assert.Contains(t, stdout.String(), fmt.Sprintf(`"record %d"`, after+1))
+}
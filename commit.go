@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// committer batches the fsyncs of records written with Synced durability
+// into group commits, see Options.MaxCommitDelay. After the first record of
+// a group arrives, the group waits a window for more records. The window
+// adapts to the arrival rate: it doubles while groups collect several
+// records and halves down to zero, syncing right away, while records arrive
+// one at a time.
+type committer struct {
+	maxDelay time.Duration
+	adaptive bool            // Whether the window adapts, a fixed MaxCommitDelay otherwise
+	reqC     chan chan error // Records waiting for a commit, answered with its result
+
+	next   time.Duration // Window of the next group
+	window atomic.Int64  // Window of the latest group, in nanoseconds
+}
+
+func newCommitter(maxDelay time.Duration) *committer {
+	return &committer{
+		maxDelay: maxDelay,
+		adaptive: true,
+		reqC:     make(chan chan error),
+	}
+}
+
+// commit waits for the group commit of the records written so far
+func (c *committer) commit(closeC <-chan struct{}) error {
+	return c.commitContext(context.Background(), closeC)
+}
+
+// commitContext waits for the group commit like commit, giving up with
+// ctx.Err() when ctx is done. The commit goes on without the caller.
+func (c *committer) commitContext(ctx context.Context, closeC <-chan struct{}) error {
+	done := make(chan error, 1)
+	select {
+	case c.reqC <- done:
+	case <-closeC:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// nextWindow returns how long the next group waits for more records
+func (c *committer) nextWindow() time.Duration {
+	if !c.adaptive {
+		return c.maxDelay
+	}
+	return c.next
+}
+
+// adapt sizes the window of the next group after a group of n records
+func (c *committer) adapt(n int) {
+	if n > 1 {
+		c.next = min(max(2*c.next, c.maxDelay/16), c.maxDelay)
+		return
+	}
+	if c.next /= 2; c.next < c.maxDelay/64 {
+		c.next = 0
+	}
+}
+
+// groupCommit syncs the active segment once per group of records waiting
+// for a commit until the WAL is closed
+func (w *WAL) groupCommit() {
+	c := w.committer
+	for {
+		var waiters []chan error
+		select {
+		case done := <-c.reqC:
+			waiters = append(waiters, done)
+		case <-w.closeC:
+			return
+		}
+		// Records that arrived during the previous commit
+	drain:
+		for {
+			select {
+			case done := <-c.reqC:
+				waiters = append(waiters, done)
+			default:
+				break drain
+			}
+		}
+
+		window := c.nextWindow()
+		c.window.Store(int64(window))
+		if window > 0 {
+			timer := time.NewTimer(window)
+		collect:
+			for {
+				select {
+				case done := <-c.reqC:
+					waiters = append(waiters, done)
+				case <-timer.C:
+					break collect
+				case <-w.closeC:
+					timer.Stop()
+					break collect
+				}
+			}
+		}
+		c.adapt(len(waiters))
+
+		err := w.commitSync()
+		for _, done := range waiters {
+			done <- err
+		}
+	}
+}
+
+// commitSync flushes the active segment and syncs its file. Unlike
+// Segment.Sync, the fsync runs without holding the lock, so writers can
+// queue up the next group meanwhile.
+func (w *WAL) commitSync() error {
+	w.mu.Lock()
+	if w.isClosed() {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if err := w.checkFence(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	if err := w.segment.flushBlock(false); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	fd, err := w.segment.file()
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	var indexFd File
+	if idx := w.seqIndex; idx != nil {
+		if err := idx.flush(); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		indexFd = idx.fd
+	}
+	end := w.segment.positionAt(w.segment.Size())
+	w.notifyFlushed()
+	w.mu.Unlock()
+
+	if err := syncFile(fd, w.opts.SyncMethod); err != nil {
+		if w.isClosed() {
+			return ErrClosed
+		}
+		return err
+	}
+	w.stats.syncs.Add(1)
+	w.mu.Lock()
+	w.hookSynced(end)
+	w.mu.Unlock()
+	if indexFd != nil {
+		// After the segment, so the index only refers to durable records
+		if err := indexFd.Sync(); err != nil && !w.isClosed() {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Error constants
+var (
+	ErrInvalidCompression = errors.New("the compressed record cannot be decompressed")
+)
+
+// Compression is the compression of the record payloads, see
+// Options.Compression. Compressed records are marked in their chunk
+// headers along with their codec, so segments may mix records compressed
+// differently and uncompressed ones.
+type Compression byte
+
+const (
+	// CompressionNone stores records as they are
+	CompressionNone Compression = iota
+	// CompressionSnappy stores records compressed with snappy
+	CompressionSnappy
+	// CompressionZstd stores records compressed with zstd, which is slower
+	// than snappy but compresses better
+	CompressionZstd
+)
+
+// The zstd encoder and decoder are safe for concurrent use and shared by
+// all WALs. They are created on first use.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		return dec
+	})
+)
+
+// compress returns data compressed with the compression of the segment in
+// a pooled buffer the caller frees, along with the flags marking the codec
+// in the chunk headers. It returns nil if compression is off or does not
+// make data smaller.
+func (s *Segment) compress(data []byte) ([]byte, ChunkType) {
+	if s.opts.compression == CompressionNone || len(data) == 0 {
+		return nil, 0
+	}
+	pool := s.pool()
+	var buf, encoded []byte
+	flags := kCompressedFlag
+	switch s.opts.compression {
+	case CompressionZstd:
+		// Compressed data not smaller than data is dropped anyway, so it
+		// never has to outgrow the pooled buffer
+		buf = pool.Alloc(len(data))
+		encoded = zstdEncoder().EncodeAll(data, buf[:0])
+		flags |= kZstdFlag
+	default:
+		buf = pool.Alloc(snappy.MaxEncodedLen(len(data)))
+		encoded = snappy.Encode(buf[:cap(buf)], data)
+	}
+	if len(encoded) >= len(data) {
+		pool.Free(buf)
+		return nil, 0
+	}
+	return encoded, flags
+}
+
+// decompress returns the data of a record compressed with the codec marked
+// by flags
+func decompress(data []byte, flags ChunkType) ([]byte, error) {
+	var decoded []byte
+	var err error
+	if flags&kZstdFlag != 0 {
+		decoded, err = zstdDecoder().DecodeAll(data, nil)
+	} else {
+		decoded, err = snappy.Decode(nil, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCompression, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,159 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Compression(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	var records [][]byte
+	for i := 0; i < 10; i++ {
+		records = append(records, []byte(fmt.Sprintf(`{"id":%d,"name":"plain record","tags":["a","b"]}`, i)))
+	}
+
+	// Uncompressed records first, then compressed ones in the same segment
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for _, record := range records {
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	opts.Compression = CompressionSnappy
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	rnd := rand.New(rand.NewSource(1))
+	var large bytes.Buffer // Compresses to several blocks
+	for large.Len() < 8*blockSize {
+		fmt.Fprintf(&large, `{"id":%d,"value":%d,"name":"compressed record"},`, large.Len(), rnd.Int63())
+	}
+	random := make([]byte, 1000)
+	rnd.Read(random)
+	compressed := [][]byte{
+		large.Bytes(),
+		[]byte(`{"tags":["tag","tag","tag","tag","tag","tag","tag","tag","tag","tag"]}`),
+		random, // Stored as it is
+	}
+	physical := wal.stats.physicalBytes.Load()
+	for _, record := range compressed {
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Less(t, wal.stats.physicalBytes.Load()-physical, int64(len(compressed[0])/2))
+	assert.Greater(t, positions[12].BlockId, positions[10].BlockId+1)
+
+	types := func(pos *Position) ChunkType {
+		blockData, err := wal.segment.readBlock(pos.BlockId)
+		assert.NoError(t, err)
+		chk, err := wal.segment.readChunk(blockData[pos.Offset:], true)
+		assert.NoError(t, err)
+		return chk.chunkType
+	}
+	assert.Equal(t, kFullType, types(positions[0]))
+	assert.Equal(t, kFirstType|kCompressedFlag, types(positions[10]))
+	assert.Equal(t, kFullType|kCompressedFlag, types(positions[11]))
+	assert.Zero(t, types(positions[12])&kCompressedFlag, "stored as it is")
+
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data, "record %d", i)
+	}
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	for i := range records {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data, "record %d", i)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func TestWAL_CompressionZstd(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+		Compression:  CompressionSnappy,
+	}
+	var records [][]byte
+	for i := 0; i < 4; i++ {
+		records = append(records, bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"name":"json record"},`, i)), 200))
+	}
+
+	// Snappy records first, then zstd ones in the same segment
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for _, record := range records[:2] {
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	opts.Compression = CompressionZstd
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	physical := wal.stats.physicalBytes.Load()
+	for _, record := range records[2:] {
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Less(t, wal.stats.physicalBytes.Load()-physical, int64(len(records[2])/10))
+
+	types := func(pos *Position) ChunkType {
+		blockData, err := wal.segment.readBlock(pos.BlockId)
+		assert.NoError(t, err)
+		chk, err := wal.segment.readChunk(blockData[pos.Offset:], true)
+		assert.NoError(t, err)
+		return chk.chunkType
+	}
+	assert.Equal(t, kFullType|kCompressedFlag, types(positions[0]))
+	assert.Equal(t, kFullType|kCompressedFlag|kZstdFlag, types(positions[2]))
+	assert.Equal(t, "full(zstd)", types(positions[2]).String())
+
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data, "record %d", i)
+		data, err = r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data, "record %d", i)
+	}
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+
+	_, err = decompress([]byte("not zstd"), kCompressedFlag|kZstdFlag)
+	assert.ErrorIs(t, err, ErrInvalidCompression)
+}
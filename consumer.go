@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidConsumerOffset = errors.New("invalid consumer offset")
+
+// Consumer reads the WAL like a queue. The position of the last record it
+// acknowledged is stored durably under its name in the WAL directory, so a
+// consumer created again with the same name resumes right after it.
+type Consumer struct {
+	name   string
+	path   string
+	wal    *WAL
+	reader *Reader
+	mu     sync.Mutex
+}
+
+// NewConsumer returns the consumer with the given name, starting after the
+// last record it acknowledged, or at the first record of the WAL if it never
+// acknowledged one. Consumers with different names have independent offsets.
+func (w *WAL) NewConsumer(name string) (*Consumer, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid consumer name %q", name)
+	}
+	c := &Consumer{
+		name: name,
+		path: consumerPath(w.opts.Directory, name),
+		wal:  w,
+	}
+
+	acked, ok, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	start := acked
+	if !ok {
+		w.mu.Lock()
+		infos := w.segmentInfos()
+		w.mu.Unlock()
+		start = Position{SegmentId: infos[0].Id}
+	}
+	r, err := w.NewReader(&start)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// Skip the acknowledged record
+		if _, _, err := r.next(); err != nil {
+			r.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("acknowledged record of consumer %q not found at %+v", name, acked)
+			}
+			return nil, err
+		}
+	}
+	c.reader = r
+	return c, nil
+}
+
+// consumerPath returns the path of the offset file of the named consumer
+func consumerPath(dir, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("consumer_%s.offset", name))
+}
+
+// Name returns the name of the consumer
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Next returns the next record and its position, or io.EOF at the end of
+// the WAL. Next can be called again after io.EOF to pick up records written
+// since.
+func (c *Consumer) Next() ([]byte, *Position, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, pos, err := c.reader.next()
+	if err == io.EOF && c.reader.pos != nil {
+		// The reader is done at the end of the WAL, continue with a new one
+		// from where it stopped
+		start := *c.reader.pos
+		r, rerr := c.wal.NewReader(&start)
+		if rerr != nil {
+			return nil, nil, rerr
+		}
+		c.reader = r
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &pos, nil
+}
+
+// Ack durably records pos, the position of a record returned by Next, as
+// consumed. Consumers created later with the same name start after it.
+func (c *Consumer) Ack(pos *Position) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.wal.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return writePositionFile(c.wal.opts.FS, c.path, pos)
+}
+
+// load reads the last acknowledged position, reporting false if there is none
+func (c *Consumer) load() (Position, bool, error) {
+	pos, ok, err := readPositionFile(c.wal.opts.FS, c.path)
+	if errors.Is(err, errInvalidPositionFile) {
+		return Position{}, false, fmt.Errorf("%w: %s", ErrInvalidConsumerOffset, c.path)
+	}
+	return pos, ok, err
+}
+
+// Close releases the reader of the consumer. The acknowledged offset stays.
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reader.Close()
+}
@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Consumer(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+
+	// Consume half of the records
+	c, err := wal.NewConsumer("indexer")
+	assert.NoError(t, err)
+	for i := 0; i < n/2; i++ {
+		data, pos, err := c.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+		assert.NoError(t, c.Ack(pos))
+	}
+	// Read one more without acknowledging it
+	_, _, err = c.Next()
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	assert.NoError(t, wal.Close())
+
+	// Restart and resume after the last acknowledged record
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	c, err = wal.NewConsumer("indexer")
+	assert.NoError(t, err)
+	defer c.Close()
+	for i := n / 2; i < n; i++ {
+		data, _, err := c.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, _, err = c.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// Records written after io.EOF are picked up
+	_, err = wal.Write([]byte("late"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	data, _, err := c.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "late", string(data))
+
+	// Another consumer has its own offset
+	other, err := wal.NewConsumer("mirror")
+	assert.NoError(t, err)
+	defer other.Close()
+	data, _, err = other.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "record 0", string(data))
+
+	_, err = wal.NewConsumer("../escape")
+	assert.Error(t, err)
+}
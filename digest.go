@@ -0,0 +1,48 @@
+package wal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Digest returns a SHA-256 digest of the record sequence of the WAL: the
+// length and payload of every record in order, tombstoned records left out.
+// It does not depend on the physical layout, such as how records are split
+// into chunks, padded or spread over segments, so two WALs holding the same
+// records have the same digest. Buffered records are flushed first and
+// writes wait until the digest is computed.
+func (w *WAL) Digest() ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.opts.ReadOnly {
+		if err := w.segment.flushBlock(false); err != nil {
+			return nil, err
+		}
+	}
+
+	h := sha256.New()
+	var length [binary.MaxVarintLen64]byte
+	for _, info := range w.segmentInfos() {
+		seg, ok := w.lookupSegment(info.Id)
+		if !ok {
+			return nil, fmt.Errorf("segment %d not found", info.Id)
+		}
+		pos := Position{SegmentId: info.Id}
+		for {
+			data, _, next, err := seg.readNext(pos)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("segment %d: %w", info.Id, err)
+			}
+			h.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+			h.Write(data)
+			pos = next
+		}
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,46 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Digest(t *testing.T) {
+	records := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), 3*blockSize)}
+	for i := 0; i < 100; i++ {
+		records = append(records, []byte(fmt.Sprintf("record %d", i)))
+	}
+	digest := func(segmentSize int64, records [][]byte) []byte {
+		wal, err := Open(Options{
+			Directory:    t.TempDir(),
+			SegmentSize:  segmentSize,
+			SyncInterval: 1 * time.Hour,
+		})
+		assert.NoError(t, err)
+		defer wal.Close()
+		for _, record := range records {
+			_, err := wal.Write(record)
+			assert.NoError(t, err)
+		}
+		d, err := wal.Digest()
+		assert.NoError(t, err)
+		return d
+	}
+
+	// The same records laid out in one segment or in many
+	d := digest(1*MB, records)
+	assert.Len(t, d, 32)
+	assert.Equal(t, d, digest(256, records))
+
+	tampered := append([][]byte{}, records...)
+	tampered[5] = []byte("record X")
+	assert.NotEqual(t, d, digest(1*MB, tampered))
+	assert.NotEqual(t, d, digest(1*MB, records[:len(records)-1]))
+	// Record boundaries are part of the digest
+	split := append([][]byte{[]byte("fir"), []byte("st")}, records[1:]...)
+	assert.NotEqual(t, d, digest(1*MB, split))
+}
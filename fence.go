@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fenceFile is the name of the file in Options.Directory holding the highest
+// fencing token the WAL was opened with
+const fenceFile = "fence"
+
+// fenceFileSize is the size of the fence file: the token followed by its
+// crc32
+const fenceFileSize = 8 + 4
+
+var ErrFenced = errors.New("fenced by a writer with a higher fencing token, see Options.FencingToken")
+
+// readFenceFile returns the token stored in the fence file at path, 0 if
+// there is none
+func readFenceFile(fsys FS, path string) (uint64, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != fenceFileSize ||
+		crc32.ChecksumIEEE(data[:8]) != binary.LittleEndian.Uint32(data[8:]) {
+		return 0, fmt.Errorf("invalid fence file %s", path)
+	}
+	return binary.LittleEndian.Uint64(data[:8]), nil
+}
+
+// acquireFence checks that no writer with a higher fencing token opened the
+// WAL, either according to the fence file or to the segments it created,
+// and stores Options.FencingToken in the fence file if it is higher.
+func (w *WAL) acquireFence() error {
+	path := filepath.Join(w.opts.Directory, fenceFile)
+	stored, err := readFenceFile(w.opts.FS, path)
+	if err != nil {
+		return err
+	}
+	for _, seg := range w.segments {
+		stored = max(stored, seg.header.fence)
+	}
+	if w.opts.FencingToken < stored {
+		return fmt.Errorf("%w: token %d, the WAL was opened with %d", ErrFenced, w.opts.FencingToken, stored)
+	}
+	if w.opts.FencingToken == stored {
+		return nil
+	}
+	buf := binary.LittleEndian.AppendUint64(nil, w.opts.FencingToken)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return writeFileAtomic(w.opts.FS, path, buf)
+}
+
+// checkFence returns ErrFenced once a writer with a higher fencing token
+// opened the WAL. It is called before data is synced, so that a fenced
+// writer does not make its records durable.
+func (w *WAL) checkFence() error {
+	if w.fenced {
+		return ErrFenced
+	}
+	if w.opts.FencingToken == 0 || w.opts.ReadOnly {
+		return nil
+	}
+	stored, err := readFenceFile(w.opts.FS, filepath.Join(w.opts.Directory, fenceFile))
+	if err != nil {
+		return err
+	}
+	if stored > w.opts.FencingToken {
+		w.fenced = true
+		return ErrFenced
+	}
+	return nil
+}
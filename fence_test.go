@@ -0,0 +1,56 @@
+package wal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_FencingToken(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  4096,
+		SyncInterval: 1 * time.Hour,
+		FencingToken: 1,
+	}
+	stale, err := Open(opts)
+	assert.NoError(t, err)
+	_, err = stale.Write([]byte("old owner"))
+	assert.NoError(t, err)
+	assert.NoError(t, stale.Sync())
+
+	opts.FencingToken = 2
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// The stale handle can no longer make records durable
+	_, err = stale.Write([]byte("split brain"))
+	assert.NoError(t, err, "buffered until synced")
+	assert.ErrorIs(t, stale.Sync(), ErrFenced)
+	_, err = stale.WriteLevel([]byte("split brain"), Synced)
+	assert.ErrorIs(t, err, ErrFenced)
+	_, err = stale.Write([]byte("split brain"))
+	assert.ErrorIs(t, err, ErrFenced)
+	assert.ErrorIs(t, stale.Close(), ErrFenced)
+
+	// Neither can a writer opening with the old token
+	opts.FencingToken = 1
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrFenced)
+
+	pos, err := wal.Write([]byte("new owner"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pos.SegmentId, "the new owner starts a segment")
+	assert.Equal(t, uint64(2), wal.segment.header.fence)
+	assert.NoError(t, wal.Sync())
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	for _, want := range []string{"old owner", "new owner"} {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// formatFile is the name of the file in Options.Directory recording the
+// Options.FormatID of the WAL
+const formatFile = "format"
+
+// formatFileSize is the size of the format file: the format id followed by
+// its crc32
+const formatFileSize = 4 + 4
+
+var ErrFormatMismatch = errors.New("the WAL was written with another format id, see Options.FormatID")
+
+// readFormatFile returns the format id stored in the format file at path,
+// reporting false if there is none
+func readFormatFile(fsys FS, path string) ([4]byte, bool, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return [4]byte{}, false, nil
+	}
+	if err != nil {
+		return [4]byte{}, false, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return [4]byte{}, false, err
+	}
+	if len(data) != formatFileSize ||
+		crc32.ChecksumIEEE(data[:4]) != binary.LittleEndian.Uint32(data[4:]) {
+		return [4]byte{}, false, fmt.Errorf("invalid format file %s", path)
+	}
+	return [4]byte(data[:4]), true, nil
+}
+
+// checkFormatID returns ErrFormatMismatch if the WAL records another format
+// id than Options.FormatID, and reports whether it records none yet
+func (w *WAL) checkFormatID() (bool, error) {
+	stored, ok, err := readFormatFile(w.opts.FS, filepath.Join(w.opts.Directory, formatFile))
+	if err != nil {
+		return false, err
+	}
+	if ok && stored != w.opts.FormatID {
+		return false, fmt.Errorf("%w: %q, configured %q", ErrFormatMismatch, stored[:], w.opts.FormatID[:])
+	}
+	return !ok, nil
+}
+
+// writeFormatID records Options.FormatID in the format file
+func (w *WAL) writeFormatID() error {
+	buf := append([]byte(nil), w.opts.FormatID[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return writeFileAtomic(w.opts.FS, filepath.Join(w.opts.Directory, formatFile), buf)
+}
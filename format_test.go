@@ -0,0 +1,39 @@
+package wal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_FormatID(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		FormatID:     [4]byte{'O', 'R', 'D', '1'},
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	_, err = wal.Write([]byte("order"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	for _, id := range [][4]byte{{'U', 'S', 'R', '1'}, {'O', 'R', 'D', '2'}, {}} {
+		other := opts
+		other.FormatID = id
+		_, err = Open(other)
+		assert.ErrorIs(t, err, ErrFormatMismatch)
+		other.ReadOnly = true
+		_, err = Open(other)
+		assert.ErrorIs(t, err, ErrFormatMismatch)
+	}
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	data, err := wal.Read(&Position{Offset: segmentHeaderSize})
+	assert.NoError(t, err)
+	assert.Equal(t, "order", string(data))
+}
@@ -0,0 +1,46 @@
+package wal
+
+import "errors"
+
+var ErrFrozen = errors.New("the WAL is frozen, see WAL.Freeze")
+
+// Freeze makes the WAL reject writes with ErrFrozen until Unfreeze is called,
+// e.g. to serve a log whose ingestion is complete. The records written so
+// far are synced first so that readers see all of them. Reads are not
+// affected.
+func (w *WAL) Freeze() error {
+	if w.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if err := w.syncActive(); err != nil {
+		return err
+	}
+	w.notifyFlushed()
+	pos := w.segment.positionAt(w.segment.Size())
+	w.frozenAt = &pos
+	return nil
+}
+
+// Unfreeze lifts a Freeze, writes are accepted again
+func (w *WAL) Unfreeze() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.frozenAt = nil
+}
+
+// FrozenAt returns the end of the WAL at the time it was frozen, or nil if
+// it is not frozen
+func (w *WAL) FrozenAt() *Position {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.frozenAt == nil {
+		return nil
+	}
+	pos := *w.frozenAt
+	return &pos
+}
@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Freeze(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	var positions []*Position
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.FrozenAt())
+
+	assert.NoError(t, wal.Freeze())
+	frozenAt := wal.FrozenAt()
+	assert.NotNil(t, frozenAt)
+	_, err = wal.Write([]byte("rejected"))
+	assert.ErrorIs(t, err, ErrFrozen)
+	_, err = wal.WriteBatch([][]byte{[]byte("rejected")})
+	assert.ErrorIs(t, err, ErrFrozen)
+
+	// Reads are not affected
+	data, err := wal.Read(positions[3])
+	assert.NoError(t, err)
+	assert.Equal(t, "record 3", string(data))
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	for i := 0; i < 10; i++ {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+
+	wal.Unfreeze()
+	assert.Nil(t, wal.FrozenAt())
+	pos, err := wal.Write([]byte("record 10"))
+	assert.NoError(t, err)
+	assert.Equal(t, *frozenAt, *pos, "writes resume at the freeze point")
+}
@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FS is the file system the WAL keeps its segment files in
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// File is an open segment file
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// osFS implements FS with the os package
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// moveFile moves src to dst, falling back to copy and delete when the file
+// cannot be renamed, e.g. because dst is on another device.
+func moveFile(fs FS, src, dst string) error {
+	if err := fs.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return fs.Remove(src)
+}
+
+// walkFiles calls fn with the path, relative to root, of every file below
+// root
+func walkFiles(fs FS, root string, fn func(path string) error) error {
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := fs.ReadDir(filepath.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(rel, entry.Name())
+			if entry.IsDir() {
+				err = walk(path)
+			} else {
+				err = fn(path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("")
+}
+
+// modTime returns the modification time of the file at path, looked up in
+// the entries of its directory as FS has no stat
+func modTime(fs FS, path string) (time.Time, error) {
+	entries, err := fs.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(path) {
+			info, err := entry.Info()
+			if err != nil {
+				return time.Time{}, err
+			}
+			return info.ModTime(), nil
+		}
+	}
+	return time.Time{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+// positionFileSize is the size of a position file: an encoded Position
+// followed by its crc32
+const positionFileSize = 12 + 4
+
+var errInvalidPositionFile = errors.New("invalid position file")
+
+// writePositionFile durably stores pos in the file at path. A new file is
+// written and renamed over the old one, so a crash leaves either the
+// previous or the new position behind.
+func writePositionFile(fsys FS, path string, pos *Position) error {
+	buf := make([]byte, 0, positionFileSize)
+	buf = append(buf, pos.Encode()...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return writeFileAtomic(fsys, path, buf)
+}
+
+// writeFileAtomic durably replaces the file at path with one holding data
+func writeFileAtomic(fsys FS, path string, buf []byte) error {
+	tmp := path + ".tmp"
+	f, err := fsys.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
+
+// readPositionFile reads the position stored by writePositionFile, reporting
+// false if there is no such file
+func readPositionFile(fsys FS, path string) (Position, bool, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Position{}, false, nil
+	}
+	if err != nil {
+		return Position{}, false, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return Position{}, false, err
+	}
+	if len(data) != positionFileSize ||
+		crc32.ChecksumIEEE(data[:12]) != binary.LittleEndian.Uint32(data[12:]) {
+		return Position{}, false, errInvalidPositionFile
+	}
+	var pos Position
+	if err := pos.Decode(data[:12]); err != nil {
+		return Position{}, false, err
+	}
+	return pos, true, nil
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// readOnlyFS behaves like a read-only mount: anything that would create or
+// modify a file fails with EROFS.
+type readOnlyFS struct {
+	osFS
+}
+
+func (fs readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EROFS}
+	}
+	return fs.osFS.OpenFile(name, flag, perm)
+}
+
+func (readOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EROFS}
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EROFS}
+}
+
+// countingFS counts the writes and syncs of the files it opens. Syncs
+// take at least syncDelay and fail with EIO while failSync is set.
+type countingFS struct {
+	osFS
+	writes, syncs *atomic.Int64
+	syncDelay     time.Duration
+	failSync      *atomic.Bool
+}
+
+func newCountingFS() countingFS {
+	return countingFS{writes: &atomic.Int64{}, syncs: &atomic.Int64{}, failSync: &atomic.Bool{}}
+}
+
+func (fs countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{File: f, fs: fs}, nil
+}
+
+type countingFile struct {
+	File
+	fs countingFS
+}
+
+func (f countingFile) Write(p []byte) (int, error) {
+	f.fs.writes.Add(1)
+	return f.File.Write(p)
+}
+
+func (f countingFile) Sync() error {
+	f.fs.syncs.Add(1)
+	time.Sleep(f.fs.syncDelay)
+	if f.fs.failSync.Load() {
+		return &os.PathError{Op: "sync", Err: syscall.EIO}
+	}
+	return f.File.Sync()
+}
+
+// stallingFS opens files whose reads block until release is closed while
+// stall is set.
+type stallingFS struct {
+	osFS
+	stall   *atomic.Bool
+	release chan struct{}
+}
+
+func newStallingFS() stallingFS {
+	return stallingFS{stall: &atomic.Bool{}, release: make(chan struct{})}
+}
+
+func (fs stallingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return stallingFile{File: f, fs: fs}, nil
+}
+
+type stallingFile struct {
+	File
+	fs stallingFS
+}
+
+func (f stallingFile) Read(p []byte) (int, error) {
+	if f.fs.stall.Load() {
+		<-f.fs.release
+	}
+	return f.File.Read(p)
+}
+
+func (f stallingFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fs.stall.Load() {
+		<-f.fs.release
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// trackingFS counts the files it opens that are not closed yet. Opening a
+// file named failOpen fails.
+type trackingFS struct {
+	osFS
+	open     *atomic.Int64
+	failOpen string
+}
+
+func newTrackingFS(failOpen string) trackingFS {
+	return trackingFS{open: &atomic.Int64{}, failOpen: failOpen}
+}
+
+func (fs trackingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if filepath.Base(name) == fs.failOpen {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EIO}
+	}
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.open.Add(1)
+	return &trackingFile{File: f, fs: fs}, nil
+}
+
+type trackingFile struct {
+	File
+	fs     trackingFS
+	closed atomic.Bool
+}
+
+func (f *trackingFile) Close() error {
+	if !f.closed.Swap(true) {
+		f.fs.open.Add(-1)
+	}
+	return f.File.Close()
+}
@@ -3,6 +3,8 @@ module github.com/ongniud/wal
 go 1.22.3
 
 require (
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.11
 	github.com/ongniud/slice-pool v0.0.0-20250304041630-cbb7ba094dc9
 	github.com/stretchr/testify v1.10.0
 )
@@ -0,0 +1,96 @@
+package wal
+
+import "bytes"
+
+// hookRecord is a record written while hooks are registered, see
+// RegisterHook
+type hookRecord struct {
+	pos  Position
+	data []byte
+}
+
+// RegisterHook registers fn to be called with every record written from
+// now on once it was synced, in the order of the records, e.g. to ship
+// them to followers. The hooks are called one record at a time on a
+// goroutine of the WAL, outside of its lock, so they may use the WAL, but
+// a slow hook holds back the records after it. Records discarded before
+// they were synced, like those of a failed atomic batch, are never passed,
+// and neither are checkpoint records. fn must not modify data. Records
+// synced by Close are passed before the goroutine exits.
+func (w *WAL) RegisterHook(fn func(pos *Position, data []byte)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = append(w.hooks, fn)
+	if w.hookC == nil {
+		w.hookC = make(chan struct{}, 1)
+		go w.runHooks()
+	}
+}
+
+// keepForHooks keeps a copy of the record written at pos until it is
+// synced and passed to the hooks
+func (w *WAL) keepForHooks(pos *Position, data []byte, flags ChunkType) {
+	if len(w.hooks) == 0 || flags&kCheckpointFlag != 0 {
+		return
+	}
+	w.unsynced = append(w.unsynced, hookRecord{pos: *pos, data: bytes.Clone(data)})
+}
+
+// hookSynced queues the records written before end, which were synced,
+// for the hooks
+func (w *WAL) hookSynced(end Position) {
+	n := 0
+	for n < len(w.unsynced) && comparePositions(w.unsynced[n].pos, end) < 0 {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	w.synced = append(w.synced, w.unsynced[:n]...)
+	w.unsynced = append(w.unsynced[:0], w.unsynced[n:]...)
+	select {
+	case w.hookC <- struct{}{}:
+	default: // The hooks are already due
+	}
+}
+
+// dropUnsynced discards the records written at or after end from the
+// records waiting for a sync, as they were cut off the WAL
+func (w *WAL) dropUnsynced(end Position) {
+	n := len(w.unsynced)
+	for n > 0 && comparePositions(w.unsynced[n-1].pos, end) >= 0 {
+		n--
+	}
+	w.unsynced = w.unsynced[:n]
+}
+
+// runHooks calls the hooks with the synced records until the WAL is closed
+func (w *WAL) runHooks() {
+	for {
+		if w.callHooks() {
+			continue
+		}
+		select {
+		case <-w.hookC:
+		case <-w.closeC:
+			w.callHooks() // Pass what Close synced, once it released the lock
+			return
+		}
+	}
+}
+
+// callHooks calls the hooks with the records synced so far and reports
+// whether there were any
+func (w *WAL) callHooks() bool {
+	w.mu.Lock()
+	records, hooks := w.synced, w.hooks
+	w.synced = nil
+	w.mu.Unlock()
+	for _, rec := range records {
+		for _, fn := range hooks {
+			pos := rec.pos
+			fn(&pos, rec.data)
+		}
+	}
+	return len(records) > 0
+}
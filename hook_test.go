@@ -0,0 +1,83 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_RegisterHook(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+		NoSplit:      true,
+	})
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	var got []string
+	var gotPositions []Position
+	wal.RegisterHook(func(pos *Position, data []byte) {
+		if string(data) != "closed" {
+			// Hooks run outside of the lock and may use the WAL
+			read, err := wal.Read(pos)
+			assert.NoError(t, err)
+			assert.Equal(t, data, read)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, string(data))
+		gotPositions = append(gotPositions, *pos)
+	})
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), got...)
+	}
+
+	var want []string
+	var positions []Position
+	for i := 0; i < 20; i++ {
+		data := fmt.Sprintf("record %d", i)
+		pos, err := wal.Write([]byte(data))
+		assert.NoError(t, err)
+		want = append(want, data)
+		positions = append(positions, *pos)
+	}
+	assert.Greater(t, positions[19].SegmentId, positions[0].SegmentId)
+	_, err = wal.WriteCheckpoint([]byte("checkpoint")) // Syncs, but is not passed on
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(received()) == len(want) }, time.Second, time.Millisecond)
+	assert.Equal(t, want, received())
+	mu.Lock()
+	assert.Equal(t, positions, gotPositions)
+	mu.Unlock()
+
+	// Buffered records wait for the sync
+	_, err = wal.Write([]byte("buffered"))
+	assert.NoError(t, err)
+	want = append(want, "buffered")
+	assert.Never(t, func() bool { return len(received()) == len(want) }, 20*time.Millisecond, time.Millisecond)
+	assert.NoError(t, wal.Sync())
+	assert.Eventually(t, func() bool { return len(received()) == len(want) }, time.Second, time.Millisecond)
+
+	// A failed atomic batch is never passed on, a committed one is
+	_, err = wal.WriteAtomicBatch([][]byte{[]byte("rolled back"), make([]byte, blockSize)})
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	_, err = wal.WriteAtomicBatch([][]byte{[]byte("batch 0"), []byte("batch 1")})
+	assert.NoError(t, err)
+	want = append(want, "batch 0", "batch 1")
+	assert.Eventually(t, func() bool { return len(received()) == len(want) }, time.Second, time.Millisecond)
+
+	// Close syncs the rest
+	_, err = wal.Write([]byte("closed"))
+	assert.NoError(t, err)
+	want = append(want, "closed")
+	assert.NoError(t, wal.Close())
+	assert.Eventually(t, func() bool { return len(received()) == len(want) }, time.Second, time.Millisecond)
+	assert.Equal(t, want, received())
+}
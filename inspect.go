@@ -0,0 +1,115 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SegmentFileInfo describes a segment file found by ListSegmentFiles
+type SegmentFileInfo struct {
+	Id   int
+	Path string
+	Size int64
+}
+
+// ListSegmentFiles returns the segment files with the default naming below
+// dir ordered by id. It only reads the directory, so it can be used by
+// tooling on the directory of a WAL opened by another process. The size of
+// the active segment is a snapshot and may lag behind buffered records.
+func ListSegmentFiles(dir string) ([]SegmentFileInfo, error) {
+	var infos []SegmentFileInfo
+	err := walkFiles(osFS{}, dir, func(path string) error {
+		id, ok := defaultParsePath(path)
+		if !ok || filepath.Clean(defaultPathFor(id)) != path {
+			return nil
+		}
+		fi, err := os.Stat(filepath.Join(dir, path))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Purged in the meantime
+			}
+			return err
+		}
+		infos = append(infos, SegmentFileInfo{Id: id, Path: filepath.Join(dir, path), Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos, nil
+}
+
+// OpenSegmentReadOnly opens the segment file at path, named like the
+// default segment files, for reading only. The segment covers the data in
+// the file when it is opened and does not start any goroutine, so it does
+// not interfere with a WAL writing the file.
+func OpenSegmentReadOnly(path string) (*Segment, error) {
+	id, ok := defaultParsePath(filepath.Base(path))
+	if !ok {
+		return nil, fmt.Errorf("%s is not a segment file", path)
+	}
+	return newSegment(id, path, segmentOptions{fs: osFS{}, readOnly: true, stats: &ioStats{}})
+}
+
+// BlockRef describes the block of a segment holding a position, see
+// WAL.BlockOf
+type BlockRef struct {
+	SegmentId int
+	BlockId   int
+	Offset    int64 // Offset of the block in the segment file
+	Size      int   // Size of the blocks of the segment
+	Used      int   // Bytes of the block in use by chunks and the segment header, the rest is padding or free
+	Active    bool  // Whether records are still appended to the block
+}
+
+// BlockOf returns the block of the segment holding pos, for debugging
+// positions. The fill state of the active block changes as records are
+// written.
+func (w *WAL) BlockOf(pos *Position) (BlockRef, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return BlockRef{}, fmt.Errorf("segment %d not found", pos.SegmentId)
+	}
+	if seg.singleRecord() {
+		return BlockRef{}, fmt.Errorf("segment %d holds a single record and has no blocks", pos.SegmentId)
+	}
+	last := seg.currentBlock
+	if pos.BlockId < 0 || pos.BlockId > last.id || pos.Offset < 0 || pos.Offset >= seg.blockSize {
+		return BlockRef{}, fmt.Errorf("position %+v is out of range", *pos)
+	}
+	ref := BlockRef{
+		SegmentId: seg.id,
+		BlockId:   pos.BlockId,
+		Offset:    int64(pos.BlockId) * int64(seg.blockSize),
+		Size:      seg.blockSize,
+		Active:    seg == w.segment && pos.BlockId == last.id,
+	}
+	if pos.BlockId == last.id {
+		ref.Used = len(last.data)
+		return ref, nil
+	}
+
+	// Flushed blocks are used up to their padding
+	blockData, err := seg.readBlock(pos.BlockId)
+	if err != nil {
+		return BlockRef{}, err
+	}
+	ref.Used = 0
+	if pos.BlockId == 0 {
+		ref.Used = seg.dataStart
+	}
+	headerSize := seg.chunkHeaderSize()
+	for ref.Used+headerSize <= len(blockData) {
+		chk, err := seg.readChunk(blockData[ref.Used:], false)
+		if err != nil || len(chk.data) == 0 && isZero(blockData[ref.Used+headerSize:]) {
+			break
+		}
+		ref.Used += headerSize + len(chk.data)
+	}
+	return ref, nil
+}
@@ -0,0 +1,107 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListSegmentFiles(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{
+		Directory:    dir,
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+	var positions []*Position
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+
+	files, err := ListSegmentFiles(dir)
+	assert.NoError(t, err)
+	segments := wal.Segments()
+	assert.Len(t, files, len(segments))
+	for i, info := range segments {
+		assert.Equal(t, info.Id, files[i].Id)
+		assert.Equal(t, info.Path, files[i].Path)
+		assert.Equal(t, info.Size, files[i].Size)
+	}
+
+	// Read the first segment while the WAL has it open
+	seg, err := OpenSegmentReadOnly(files[0].Path)
+	assert.NoError(t, err)
+	defer seg.Close()
+	for i, pos := range positions {
+		if pos.SegmentId != files[0].Id {
+			break
+		}
+		data, err := seg.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = seg.Write([]byte("rejected"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	_, err = wal.Write([]byte("still writable"))
+	assert.NoError(t, err)
+}
+
+func TestWAL_BlockOf(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	first, err := wal.Write([]byte("first"))
+	assert.NoError(t, err)
+	large, err := wal.Write(make([]byte, 2*blockSize))
+	assert.NoError(t, err)
+	last, err := wal.Write([]byte("last"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	hs := ChecksumCRC32.chunkHeaderSize()
+	ref, err := wal.BlockOf(first)
+	assert.NoError(t, err)
+	assert.Equal(t, BlockRef{SegmentId: first.SegmentId, BlockId: 0, Offset: 0, Size: blockSize, Used: blockSize}, ref)
+
+	ref, err = wal.BlockOf(&Position{SegmentId: large.SegmentId, BlockId: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(blockSize), ref.Offset)
+	assert.Equal(t, blockSize, ref.Used, "filled by the middle chunk")
+	assert.False(t, ref.Active)
+
+	ref, err = wal.BlockOf(last)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ref.BlockId)
+	assert.Equal(t, int64(2*blockSize), ref.Offset)
+	assert.Zero(t, ref.Offset%blockSize)
+	assert.Equal(t, last.Offset+hs+len("last"), ref.Used)
+	assert.True(t, ref.Active)
+
+	// The block before the active one ends with padding
+	_, err = wal.Write(make([]byte, blockSize-ref.Used-hs-5))
+	assert.NoError(t, err)
+	_, err = wal.Write(make([]byte, 100))
+	assert.NoError(t, err)
+	ref, err = wal.BlockOf(last)
+	assert.NoError(t, err)
+	assert.Equal(t, blockSize-5, ref.Used)
+	assert.False(t, ref.Active)
+
+	_, err = wal.BlockOf(&Position{SegmentId: last.SegmentId, BlockId: 9})
+	assert.Error(t, err)
+	_, err = wal.BlockOf(&Position{SegmentId: 42})
+	assert.Error(t, err)
+}
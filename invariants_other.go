@@ -0,0 +1,11 @@
+//go:build !walcheck
+
+package wal
+
+// Without -tags walcheck the invariant checks compile to nothing.
+
+func (s *Segment) checkBlock(op string) {}
+
+func checkChunkSequence(first bool, prev, next ChunkType) {}
+
+func (s *Segment) checkAdvance(op string, prev, next Position) {}
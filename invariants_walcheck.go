@@ -0,0 +1,47 @@
+//go:build walcheck
+
+package wal
+
+import "fmt"
+
+// Invariant checks compiled in with -tags walcheck. Each check panics with
+// context when an invariant is violated.
+
+// checkBlock checks the buffer of the current block of the segment
+func (s *Segment) checkBlock(op string) {
+	b := s.currentBlock
+	if b.flushed > len(b.data) {
+		panic(fmt.Sprintf("walcheck: %s: segment %d block %d: flushed %d beyond buffered %d", op, s.id, b.id, b.flushed, len(b.data)))
+	}
+	if len(b.data) > s.blockSize {
+		panic(fmt.Sprintf("walcheck: %s: segment %d block %d: buffered %d bytes, more than a block", op, s.id, b.id, len(b.data)))
+	}
+}
+
+// checkChunkSequence checks that a chunk of type next may follow one of type
+// prev within a record, prev being ignored for the first chunk.
+func checkChunkSequence(first bool, prev, next ChunkType) {
+	var ok bool
+	if first {
+		ok = next == kFullType || next == kFirstType
+	} else {
+		ok = (prev == kFirstType || prev == kMiddleType) && (next == kMiddleType || next == kLastType)
+	}
+	if !ok {
+		panic(fmt.Sprintf("walcheck: chunk of type %v written after %v (first: %v)", next, prev, first))
+	}
+}
+
+// checkAdvance checks that next lies after prev within a segment and points
+// into a block
+func (s *Segment) checkAdvance(op string, prev, next Position) {
+	if next.Offset < 0 || next.Offset > s.blockSize {
+		panic(fmt.Sprintf("walcheck: %s: position %+v points outside its block", op, next))
+	}
+	if next.SegmentId != prev.SegmentId {
+		return
+	}
+	if next.BlockId < prev.BlockId || next.BlockId == prev.BlockId && next.Offset <= prev.Offset {
+		panic(fmt.Sprintf("walcheck: %s: position %+v does not advance past %+v", op, next, prev))
+	}
+}
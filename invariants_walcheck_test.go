@@ -0,0 +1,63 @@
+//go:build walcheck
+
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalcheck_WriteReadRotate(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  4 * blockSize,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records [][]byte
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("record %d", i))
+		if i%10 == 0 {
+			data = bytes.Repeat(data, blockSize/4) // Spans several blocks
+		}
+		pos, err := wal.Write(data)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, data)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, wal.segment.Id(), 0)
+
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data)
+	}
+}
+
+func TestWalcheck_Violations(t *testing.T) {
+	s := &Segment{blockSize: blockSize}
+	assert.Panics(t, func() {
+		s.checkAdvance("test", Position{BlockId: 1, Offset: 10}, Position{BlockId: 1, Offset: 10})
+	})
+	assert.Panics(t, func() {
+		s.checkAdvance("test", Position{}, Position{Offset: blockSize + 1})
+	})
+	assert.NotPanics(t, func() {
+		s.checkAdvance("test", Position{SegmentId: 1, BlockId: 3}, Position{SegmentId: 2})
+	})
+	assert.Panics(t, func() { checkChunkSequence(true, 0, kMiddleType) })
+	assert.Panics(t, func() { checkChunkSequence(false, kFullType, kLastType) })
+	assert.NotPanics(t, func() { checkChunkSequence(false, kMiddleType, kLastType) })
+
+	seg := &Segment{currentBlock: &block{data: make([]byte, 10), flushed: 11}}
+	assert.Panics(t, func() { seg.checkBlock("test") })
+}
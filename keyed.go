@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrNoKeyIndex  = errors.New("the key index is disabled, see Options.KeyIndex")
+	ErrKeyNotFound = errors.New("no record with the key")
+)
+
+// WriteKeyed writes data as a record stored under key. Get returns the
+// record written last for a key. Keyed records are ordinary records to
+// readers, which see data only. It is synced like Write.
+func (w *WAL) WriteKeyed(key []byte, data []byte) (*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := w.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer w.mu.Unlock()
+
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(key)))
+	payload := w.pool.Alloc(n + len(key) + len(data))
+	payload = append(append(append(payload, length[:n]...), key...), data...)
+	pos, err := w.write(payload, kKeyedFlag)
+	w.pool.Free(payload)
+	if err != nil {
+		return nil, err
+	}
+	if w.keys != nil {
+		w.keys[string(key)] = *pos
+	}
+	if err := w.syncWritten(); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+// Get returns the record written last with WriteKeyed under key. It
+// returns ErrKeyNotFound if there is none or its segment was purged, and
+// ErrTombstoned if it was erased. The buffered block of the active segment
+// is flushed if it holds the record. It requires Options.KeyIndex.
+func (w *WAL) Get(key []byte) ([]byte, error) {
+	if !w.opts.KeyIndex {
+		return nil, ErrNoKeyIndex
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pos, ok := w.keys[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if seg == w.segment && !w.opts.ReadOnly {
+		if err := seg.flushBlock(false); err != nil {
+			return nil, err
+		}
+	}
+	return seg.Read(&pos)
+}
+
+// rebuildKeys rebuilds the key index with Options.KeyIndex after records
+// were dropped, w.mu held
+func (w *WAL) rebuildKeys() error {
+	if !w.opts.KeyIndex {
+		return nil
+	}
+	return w.buildKeys()
+}
+
+// buildKeys builds the key index by replaying the keyed records of all
+// segments. A tombstoned keyed record, which keeps its key, stays the
+// latest record of its key.
+func (w *WAL) buildKeys() error {
+	if !w.opts.ReadOnly {
+		if err := w.segment.flushBlock(false); err != nil {
+			return err
+		}
+	}
+	keys := make(map[string]Position)
+	for _, info := range w.segmentInfos() {
+		seg := w.segments[info.Id]
+		pos := Position{SegmentId: info.Id}
+		for {
+			_, at, next, err := seg.scanNext(pos, false)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != ErrTombstoned && err != errCheckpoint {
+				return fmt.Errorf("segment %d: %w", info.Id, err)
+			}
+			stored, _, keyed, err := seg.readStored(nil, &at)
+			if err != nil && err != ErrTombstoned && err != errCheckpoint {
+				return fmt.Errorf("segment %d: %w", info.Id, err)
+			}
+			if keyed {
+				if seg.chained() {
+					stored = stored[chainHashSize:]
+				}
+				key, _, _ := splitKeyed(stored)
+				keys[string(key)] = at
+			}
+			pos = next
+		}
+	}
+	w.keys = keys
+	return nil
+}
+
+// splitKeyed splits the payload of a keyed record into its key and data,
+// reporting false if the payload is malformed
+func splitKeyed(payload []byte) (key, data []byte, ok bool) {
+	length, n := binary.Uvarint(payload)
+	if n <= 0 || length > uint64(len(payload)-n) {
+		return nil, nil, false
+	}
+	return payload[n : n+int(length)], payload[n+int(length):], true
+}
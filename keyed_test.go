@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_GetReturnsLatestKeyedRecord(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+		KeyIndex:     true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := wal.WriteKeyed([]byte("a"), []byte(fmt.Sprintf("a%d", i)))
+		assert.NoError(t, err)
+		_, err = wal.WriteKeyed([]byte("b"), []byte(fmt.Sprintf("b%d", i)))
+		assert.NoError(t, err)
+		_, err = wal.Write([]byte("plain"))
+		assert.NoError(t, err)
+	}
+	data, err := wal.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a9", string(data))
+	_, err = wal.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.NoError(t, wal.Close())
+
+	// The index is rebuilt by replaying the keyed records
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	data, err = wal.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b9", string(data))
+	pos, err := wal.WriteKeyed([]byte("b"), []byte("b10"))
+	assert.NoError(t, err)
+	data, err = wal.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b10", string(data))
+
+	// Readers see the data without the key
+	data, err = wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, "b10", string(data))
+}
+
+func TestWAL_GetRequiresKeyIndex(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+	_, err = wal.WriteKeyed([]byte("k"), []byte("value"))
+	assert.NoError(t, err)
+	_, err = wal.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrNoKeyIndex)
+}
+
+func TestWAL_OverwriteKeyed(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * GB,
+		SyncInterval:   1 * time.Hour,
+		AllowOverwrite: true,
+		KeyIndex:       true,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+	pos, err := wal.WriteKeyed([]byte("k"), []byte("value"))
+	assert.NoError(t, err)
+
+	// Only the data after the key is compared and replaced
+	assert.ErrorIs(t, wal.Overwrite(pos, []byte("VALUE!!")), ErrLengthMismatch)
+	assert.NoError(t, wal.Overwrite(pos, []byte("VALUE")))
+	data, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, "VALUE", string(data))
+	data, err = wal.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "VALUE", string(data))
+}
+
+func TestWAL_TombstoneKeyed(t *testing.T) {
+	opts := Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * GB,
+		SyncInterval:   1 * time.Hour,
+		AllowOverwrite: true,
+		KeyIndex:       true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	_, err = wal.WriteKeyed([]byte("k"), []byte("v1"))
+	assert.NoError(t, err)
+	pos, err := wal.WriteKeyed([]byte("k"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Tombstone(pos))
+	_, err = wal.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrTombstoned)
+	assert.NoError(t, wal.Close())
+
+	// The erased record stays the latest of its key, v1 does not come back
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	_, err = wal.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrTombstoned)
+	_, err = wal.Read(pos)
+	assert.ErrorIs(t, err, ErrTombstoned)
+}
@@ -0,0 +1,111 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	opts := Options{
+		Directory:        filepath.Join(t.TempDir(), "wal"),
+		ArchiveDirectory: filepath.Join(t.TempDir(), "archive"),
+		FS:               fs,
+		SegmentSize:      4 * KB,
+		SyncInterval:     1 * time.Hour,
+		BlockSize:        1 * KB,
+		AllowOverwrite:   true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var positions []*Position
+	var records []string
+	for i := 0; i < 100; i++ {
+		record := fmt.Sprintf("record %d %s", i, make([]byte, i*10))
+		pos, err := wal.Write([]byte(record))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.Greater(t, wal.segment.Id(), 2)
+	replaced := []byte(records[1])
+	copy(replaced, "REPLACED")
+	records[1] = string(replaced)
+	assert.NoError(t, wal.Overwrite(positions[1], replaced))
+	assert.NoError(t, wal.Close())
+
+	// Nothing is stored on disk
+	_, err = os.Stat(opts.Directory)
+	assert.True(t, os.IsNotExist(err))
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	start := *positions[0]
+	reader, err := wal.NewReader(&start)
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := range positions {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], string(data))
+	}
+
+	// Purged segments are moved to the archive directory of fs
+	assert.NoError(t, wal.Purge(positions[0].SegmentId))
+	data, err := wal.Read(positions[0])
+	assert.NoError(t, err)
+	assert.Equal(t, records[0], string(data))
+	entries, err := fs.ReadDir(opts.ArchiveDirectory)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMemFS_Crash(t *testing.T) {
+	fs := NewMemFS()
+	opts := Options{
+		Directory:    "wal",
+		FS:           fs,
+		SegmentSize:  4 * KB,
+		SyncInterval: 1 * time.Hour,
+		BlockSize:    1 * KB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var synced []*Position
+	for i := 0; i < 50; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("synced %d", i)))
+		assert.NoError(t, err)
+		synced = append(synced, pos)
+	}
+	assert.NoError(t, wal.Sync())
+	for i := 0; i < 10; i++ {
+		_, err := wal.WriteLevel([]byte(fmt.Sprintf("flushed %d", i)), Flushed)
+		assert.NoError(t, err)
+	}
+
+	// The records flushed but not synced are lost
+	fs.Crash()
+	_ = wal.Close()
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	start := *synced[0]
+	reader, err := wal.NewReader(&start)
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := range synced {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("synced %d", i), string(data))
+	}
+	_, err = reader.Next()
+	assert.Error(t, err)
+}
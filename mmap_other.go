@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package wal
+
+// mmapFile is not supported on this platform.
+func mmapFile(f File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmap is not supported on this platform.
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
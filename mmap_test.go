@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_MmapSealedSegments(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("memory mapping is not supported on", runtime.GOOS)
+	}
+	opts := Options{
+		Directory:          t.TempDir(),
+		SegmentSize:        4 * KB,
+		SyncInterval:       1 * time.Hour,
+		BlockSize:          1 * KB,
+		MmapSealedSegments: true,
+		AllowOverwrite:     true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records []string
+	for i := 0; i < 100; i++ {
+		record := fmt.Sprintf("record %d %s", i, make([]byte, i*10))
+		pos, err := wal.Write([]byte(record))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, wal.segment.Id(), 2)
+
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], string(data))
+	}
+	first := wal.segments[positions[0].SegmentId]
+	assert.NotNil(t, first.mapped, "the sealed segment is mapped")
+	assert.Equal(t, first.Size(), int64(len(first.mapped)))
+	assert.Nil(t, wal.segment.mapped, "the active segment is read from its file")
+
+	// Overwrites of sealed segments show through the mapping
+	replaced := []byte(records[1])
+	copy(replaced, "REPLACED")
+	assert.NoError(t, wal.Overwrite(positions[1], replaced))
+	data, err := wal.Read(positions[1])
+	assert.NoError(t, err)
+	assert.Equal(t, replaced, data)
+
+	// Releasing the segment drops the mapping, the next read maps it again
+	wal.mu.Lock()
+	assert.NoError(t, first.release())
+	wal.mu.Unlock()
+	assert.Nil(t, first.mapped)
+	reader, err := wal.NewReader(positions[0])
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := range positions {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		if i != 1 {
+			assert.Equal(t, records[i], string(data))
+		}
+	}
+	assert.NotNil(t, first.mapped)
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package wal
+
+import "syscall"
+
+// mmapFile maps the first size bytes of f read-only. Only files of the os
+// package, which expose their descriptor, can be mapped.
+func mmapFile(f File, size int64) ([]byte, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok || size <= 0 || int64(int(size)) != size {
+		return nil, errMmapUnsupported
+	}
+	return syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap unmaps data mapped by mmapFile
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
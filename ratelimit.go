@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a byte rate. Bytes are taken where
+// they are read, possibly running into debt, and the debt is waited for
+// later, outside of any lock. A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil if rate
+// is zero. Up to burst bytes, a block, can be read at once without waiting.
+func newRateLimiter(rate int64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call, l.mu held
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// take takes n bytes from the bucket without waiting
+func (l *rateLimiter) take(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+}
+
+// wait blocks until the bucket is out of debt or done is closed
+func (l *rateLimiter) wait(done <-chan struct{}) {
+	l.waitContext(context.Background(), done)
+}
+
+// waitContext blocks like wait, returning early when ctx is done as well
+func (l *rateLimiter) waitContext(ctx context.Context, done <-chan struct{}) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.refill(time.Now())
+	debt := -l.tokens
+	l.mu.Unlock()
+	if debt <= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(debt / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	case <-ctx.Done():
+	}
+}
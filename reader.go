@@ -1,64 +1,246 @@
 package wal
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
 
+// ErrNoNewData is returned by Reader.TryNext when a follower has caught up
+// with the WAL
+var ErrNoNewData = errors.New("no new data in the WAL yet")
+
 // Reader reads entries from the WAL starting at a given position
 type Reader struct {
 	wal     *WAL
 	pos     *Position
 	current *Segment
 	closed  bool
+	follow  bool          // Wait for new data at the end of the WAL instead of returning io.EOF
+	end     *Position     // Position the reader stops at, nil to read to the end of the WAL
+	closeC  chan struct{} // Closed by Close to wake up a waiting follower
+	once    sync.Once
 	mu      sync.Mutex
 }
 
 // Next reads the next entry from the WAL
 func (r *Reader) Next() ([]byte, error) {
+	entry, _, err := r.next()
+	return entry, err
+}
+
+// NextContext reads the next entry like Next, but stops waiting, for new
+// data in follow mode or for Options.ReadRateLimit, when ctx is done and
+// returns ctx.Err(). The reader stays at the entry, a later call reads it.
+// A read already issued to the disk is waited for, see WAL.ReadContext.
+func (r *Reader) NextContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	entry, _, err := r.nextContext(ctx, r.follow)
+	return entry, err
+}
 
-	if r.closed {
-		return nil, io.EOF
+// TryNext reads the next entry like Next without waiting for more data: a
+// reader created by NewReaderFollow returns ErrNoNewData once it has caught
+// up, and a later call picks up the entries flushed since, on segments
+// rotated in the meantime too. Other readers return io.EOF at the end of
+// the WAL as Next does.
+func (r *Reader) TryNext() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, _, err := r.nextLocked(false)
+	if err == io.EOF && r.follow && !r.closed {
+		return nil, ErrNoNewData
 	}
+	return entry, err
+}
 
+// next reads the next entry from the WAL and returns it with its position
+func (r *Reader) next() ([]byte, Position, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nextLocked(r.follow)
+}
+
+// NextUntilBytes returns the following records for as long as their total
+// size stays within budget, along with the position to resume reading from
+// with a new Reader. It stops early at the end of the WAL, without waiting
+// for more data in follow mode once it has a record to return, and returns
+// io.EOF if there is none. A record larger than budget on its own is left
+// unread and reported as an error.
+func (r *Reader) NextUntilBytes(budget int) ([][]byte, *Position, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records [][]byte
+	used := 0
 	for {
-		entry, err := r.current.Read(r.pos)
+		if r.pos == nil {
+			return nil, nil, io.EOF // Closed
+		}
+		resume, current, closed := *r.pos, r.current, r.closed
+		entry, _, err := r.nextLocked(r.follow && len(records) == 0)
+		if err == io.EOF && len(records) > 0 {
+			return records, &resume, nil
+		}
 		if err != nil {
+			return records, &resume, err
+		}
+		if used+len(entry) > budget {
+			// Unread the record
+			*r.pos, r.current, r.closed = resume, current, closed
+			if len(records) == 0 {
+				return nil, &resume, fmt.Errorf("record of %d bytes exceeds the budget of %d bytes", len(entry), budget)
+			}
+			return records, &resume, nil
+		}
+		used += len(entry)
+		records = append(records, entry)
+	}
+}
+
+// nextLocked reads the next entry with r.mu held. At the end of the WAL it
+// waits for more data if wait is set, returns io.EOF otherwise and closes
+// the reader unless it is following the WAL.
+func (r *Reader) nextLocked(wait bool) ([]byte, Position, error) {
+	return r.nextContext(context.Background(), wait)
+}
+
+// nextContext reads the next entry like nextLocked, giving up waiting when
+// ctx is done
+func (r *Reader) nextContext(ctx context.Context, wait bool) ([]byte, Position, error) {
+	if r.closed {
+		return nil, Position{}, io.EOF
+	}
+
+	for {
+		if r.end != nil && comparePositions(*r.pos, *r.end) >= 0 {
+			return nil, Position{}, io.EOF
+		}
+		r.wal.readLimiter.waitContext(ctx, r.closeC)
+		if err := ctx.Err(); err != nil {
+			return nil, Position{}, err
+		}
+		// Read under the shared lock like WAL.Read, concurrently with other
+		// readers
+		r.wal.mu.RLock()
+		if r.follow && r.wal.isClosed() {
+			// Woken up by the final flush of Close
+			r.wal.mu.RUnlock()
+			r.closed = true
+			return nil, Position{}, io.EOF
+		}
+		r.current.skipHeader(r.pos)
+		r.current.readMu.Lock()
+		entry, next, err := r.current.read(r.pos)
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			r.current.readMu.Unlock()
+			r.wal.mu.RUnlock()
+			if err == ErrTombstoned || err == errCheckpoint {
+				// Skip the erased or checkpoint record
+				r.pos.BlockId, r.pos.Offset = next.BlockId, next.Offset
+				continue
+			}
 			if err == ErrEndOfBlock {
 				r.pos.BlockId++
 				r.pos.Offset = 0
-				continue // Continue to read from the next segment
+				continue // Continue to read from the next block
 			}
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				// Current segment is exhausted, move to the next segment
-				nextSegmentId := r.pos.SegmentId + 1
-				nextSegment, ok := r.wal.segments[nextSegmentId]
-				if !ok {
-					// No more segments, return EOF
-					r.closed = true
-					return nil, io.EOF
-				}
-				r.current = nextSegment
-				r.pos = &Position{
-					SegmentId: nextSegmentId,
-					BlockId:   0,
-					Offset:    0,
-				}
-				continue // Continue to read from the next segment
+			if err != nil {
+				return nil, Position{}, err
 			}
-			return nil, err
+			// Update the position
+			at := *r.pos
+			r.pos.BlockId, r.pos.Offset = next.BlockId, next.Offset
+			r.current.checkAdvance("reader", at, *r.pos)
+			return entry, at, nil
+		}
+		flushed := r.current.flushedSize()
+		padding := true
+		if err == io.EOF && r.current.fileOffset(*r.pos)+int64(r.current.chunkHeaderSize()) <= flushed {
+			var perr error
+			if padding, perr = r.current.isPadding(*r.pos); perr != nil {
+				err = perr
+			}
+		}
+		r.current.readMu.Unlock()
+		r.wal.mu.RUnlock()
+
+		// Looking up the next segment may open it, see WAL.lockRead
+		r.wal.mu.Lock()
+		if r.current.flushedSize() != flushed {
+			// Flushed meanwhile, e.g. by the rotation to the next segment
+			r.wal.mu.Unlock()
+			continue
 		}
+		nextSegmentId := r.pos.SegmentId + 1
+		nextSegment, ok := r.wal.lookupSegment(nextSegmentId)
+		flushedC := r.wal.flushedC
+		r.wal.mu.Unlock()
 
-		// Update the position
-		r.pos.Offset += chunkHeaderSize + len(entry)
-		return entry, nil
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, Position{}, err
+		}
+		if !padding {
+			at := *r.pos
+			r.pos.Offset += r.current.chunkHeaderSize()
+			return []byte{}, at, nil
+		}
+		if err == io.EOF && int64(r.pos.BlockId+1)*int64(r.current.blockSize) <= flushed {
+			// The rest of the block is padding, continue with the next one
+			r.pos.BlockId++
+			r.pos.Offset = 0
+			continue
+		}
+		if ok {
+			// Current segment is exhausted, move to the next segment
+			r.current = nextSegment
+			r.pos = &Position{
+				SegmentId: nextSegmentId,
+				BlockId:   0,
+				Offset:    0,
+			}
+			continue // Continue to read from the next segment
+		}
+		if wait {
+			if err := r.wait(ctx, flushedC); err != nil {
+				return nil, Position{}, err
+			}
+			continue
+		}
+		if r.follow {
+			return nil, Position{}, io.EOF
+		}
+		// No more segments, return EOF
+		r.closed = true
+		return nil, Position{}, io.EOF
+	}
+}
+
+// wait blocks a follower until more data is flushed, returning io.EOF if
+// the reader or the WAL is closed first, and ctx.Err() if ctx is done.
+func (r *Reader) wait(ctx context.Context, flushedC <-chan struct{}) error {
+	select {
+	case <-flushedC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.closeC:
+		return io.EOF
+	case <-r.wal.closeC:
+		r.closed = true
+		return io.EOF
 	}
 }
 
-// Close closes the Reader
+// Close closes the Reader, waking up a follower waiting in Next
 func (r *Reader) Close() error {
+	r.once.Do(func() { close(r.closeC) })
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -71,3 +253,96 @@ func (r *Reader) Close() error {
 	r.pos = nil     // Release the current position
 	return nil
 }
+
+// ReaderStream returns the payloads of the records from the given position
+// on as one contiguous stream, without any chunk header or padding, e.g. to
+// pipe the WAL into a parser or hasher. Records are read one at a time as
+// the stream is consumed. Reading returns io.EOF at the end of the WAL.
+func (w *WAL) ReaderStream(from *Position) (io.ReadCloser, error) {
+	start := *from
+	r, err := w.NewReader(&start)
+	if err != nil {
+		return nil, err
+	}
+	return &recordStream{reader: r}, nil
+}
+
+// recordStream implements ReaderStream on top of a Reader
+type recordStream struct {
+	reader *Reader
+	rest   []byte // Unread bytes of the current record
+}
+
+func (s *recordStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(s.rest) == 0 {
+		data, err := s.reader.Next()
+		if err != nil {
+			return 0, err
+		}
+		s.rest = data
+	}
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
+}
+
+func (s *recordStream) Close() error {
+	s.rest = nil
+	return s.reader.Close()
+}
+
+// SegmentReverseIterator yields the records of a single segment from the
+// last to the first
+type SegmentReverseIterator struct {
+	seg       *Segment
+	mu        sync.Locker // Guards reads from the segment, if set
+	positions []Position
+}
+
+// ReverseIterator returns an iterator over the records of the segment, from
+// the last to the first. It covers the records flushed to the segment file
+// when it is created, using the record index of the segment, which is built
+// by a forward scan the first time it is needed.
+func (s *Segment) ReverseIterator() (*SegmentReverseIterator, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	index, err := s.recordIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &SegmentReverseIterator{
+		seg:       s,
+		positions: index[:len(index):len(index)],
+	}, nil
+}
+
+// Next returns the record preceding the one returned last, or io.EOF once
+// the first record of the segment was returned.
+func (it *SegmentReverseIterator) Next() ([]byte, error) {
+	if len(it.positions) == 0 {
+		return nil, io.EOF
+	}
+	it.seg.opts.readLimiter.wait(nil)
+	if it.mu != nil {
+		it.mu.Lock()
+		defer it.mu.Unlock()
+	}
+	for len(it.positions) > 0 {
+		pos := it.positions[len(it.positions)-1]
+		// Records tombstoned since the index was built are skipped in
+		// place, readNext would return the record following them
+		data, _, _, err := it.seg.scanNext(pos, false)
+		if err != nil && err != ErrTombstoned && err != errCheckpoint {
+			return nil, err
+		}
+		it.positions = it.positions[:len(it.positions)-1]
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, io.EOF
+}
@@ -1,11 +1,17 @@
 package wal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestReader(t *testing.T) {
@@ -68,3 +74,638 @@ func TestReader(t *testing.T) {
 		log.Printf("Read entry: %s", string(entry))
 	}
 }
+
+func TestReader_FollowWaitsForFlushedData(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	reader, err := wal.NewReaderFollow(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		for {
+			data, err := reader.Next()
+			results <- result{data, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Buffered records are not visible yet, the follower must wait rather
+	// than report EOF.
+	_, err = wal.Write([]byte("entry0"))
+	assert.NoError(t, err)
+	select {
+	case res := <-results:
+		t.Fatalf("Next returned before data was flushed: %q, %v", res.data, res.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NoError(t, wal.Sync())
+	res := <-results
+	assert.NoError(t, res.err)
+	assert.Equal(t, []byte("entry0"), res.data)
+
+	// Follow the writer into rotated segments.
+	for i := 1; i < 10; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("entry%d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, wal.segment.Id(), 0)
+	for i := 1; i < 10; i++ {
+		res := <-results
+		assert.NoError(t, res.err)
+		assert.Equal(t, []byte(fmt.Sprintf("entry%d", i)), res.data)
+	}
+
+	assert.NoError(t, wal.Close())
+	res = <-results
+	assert.Equal(t, io.EOF, res.err)
+}
+
+func TestReader_FollowClose(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	reader, err := wal.NewReaderFollow(&Position{})
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := reader.Next()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestReader_NextContext(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	reader, err := wal.NewReaderFollow(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	// A follower stops waiting for new data on the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = reader.NextContext(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// and picks up the data flushed later
+	_, err = wal.Write([]byte("record"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	data, err := reader.NextContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record"), data)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = reader.NextContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReader_TryNext(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  128,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	reader, err := wal.NewReaderFollow(&Position{})
+	assert.NoError(t, err)
+	_, err = reader.TryNext()
+	assert.ErrorIs(t, err, ErrNoNewData)
+
+	// Entries written after catching up are picked up, across rotations
+	for round := 0; round < 3; round++ {
+		first := wal.segment.Id()
+		var want [][]byte
+		for i := 0; i < 10; i++ {
+			entry := []byte(fmt.Sprintf("round %d entry %d", round, i))
+			_, err := wal.Write(entry)
+			assert.NoError(t, err)
+			want = append(want, entry)
+		}
+		assert.NoError(t, wal.Sync())
+		assert.Greater(t, wal.segment.Id(), first)
+		for _, entry := range want {
+			data, err := reader.TryNext()
+			assert.NoError(t, err)
+			assert.Equal(t, entry, data)
+		}
+		_, err = reader.TryNext()
+		assert.ErrorIs(t, err, ErrNoNewData)
+	}
+
+	assert.NoError(t, reader.Close())
+	_, err = reader.TryNext()
+	assert.Equal(t, io.EOF, err)
+
+	// A reader that does not follow the WAL ends at its end
+	reader, err = wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 30; i++ {
+		_, err := reader.TryNext()
+		assert.NoError(t, err)
+	}
+	_, err = reader.TryNext()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_MultiBlockEntries(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var entries [][]byte
+	for i := 0; i < 5; i++ {
+		entry := make([]byte, blockSize*2)
+		for j := range entry {
+			entry[j] = byte(i + j%251)
+		}
+		entries = append(entries, entry, []byte(fmt.Sprintf("small %d", i)))
+	}
+	var positions []*Position
+	for _, entry := range entries {
+		pos, err := wal.Write(entry)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i, want := range entries {
+		entry, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, want, entry, "entry %d", i)
+	}
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// The segment reports where each entry ends
+	for i, pos := range positions[:len(positions)-1] {
+		entry, next, err := wal.segment.ReadWithNext(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, entries[i], entry)
+		assert.Equal(t, *positions[i+1], *next)
+	}
+}
+
+func TestReader_ConcurrentWithRead(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var entries [][]byte
+	for i := 0; i < 40; i++ {
+		entry := bytes.Repeat([]byte{byte(i)}, 100+i*1499)
+		pos, err := wal.Write(entry)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, wal.Sync())
+
+	// Two readers and random reads share the cached block of the segment
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader, err := wal.NewReader(&Position{})
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer reader.Close()
+			for i, want := range entries {
+				entry, err := reader.Next()
+				if !assert.NoError(t, err) || !assert.Equal(t, want, entry, "entry %d", i) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 100; n++ {
+			i := n * 7 % len(positions)
+			entry, err := wal.Read(positions[i])
+			if !assert.NoError(t, err) || !assert.Equal(t, entries[i], entry, "entry %d", i) {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestWAL_NewReaderFromStart(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// An empty WAL
+	reader, err := wal.NewReaderFromStart()
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	var positions []*Position
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+
+	// Segment 0 was truncated away
+	assert.Greater(t, positions[20].SegmentId, 0)
+	assert.NoError(t, wal.Truncate(positions[20]))
+	first := 0
+	for positions[first].SegmentId < positions[20].SegmentId {
+		first++
+	}
+	reader, err = wal.NewReaderFromStart()
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := first; i < len(positions); i++ {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWAL_NewRangeReader(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, positions[30].SegmentId, positions[5].SegmentId)
+
+	for _, tt := range []struct {
+		name       string
+		start, end int
+	}{
+		{"across segments", 5, 30},
+		{"single record", 7, 8},
+		{"empty", 12, 12},
+		{"from the first record", 0, 39},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := wal.NewRangeReader(positions[tt.start], positions[tt.end])
+			assert.NoError(t, err)
+			defer reader.Close()
+			for i := tt.start; i < tt.end; i++ {
+				data, err := reader.Next()
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+			}
+			_, err = reader.Next()
+			assert.Equal(t, io.EOF, err)
+			_, err = reader.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+
+	// An end beyond the WAL reads to its end
+	reader, err := wal.NewRangeReader(positions[35], &Position{SegmentId: positions[39].SegmentId + 10})
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := 35; i < 40; i++ {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = wal.NewRangeReader(positions[10], positions[9])
+	assert.ErrorContains(t, err, "is after its end")
+}
+
+func TestReader_NextUntilBytes(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record-%02d", i))) // 9 bytes each
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+
+	var all []string
+	pos := &Position{}
+	for {
+		reader, err := wal.NewReader(pos)
+		assert.NoError(t, err)
+		records, resume, err := reader.NextUntilBytes(40)
+		assert.NoError(t, reader.Close())
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(records), 4)
+		assert.NotEmpty(t, records)
+		for _, record := range records {
+			all = append(all, string(record))
+		}
+		pos = resume
+	}
+	assert.Len(t, all, 20)
+	for i, record := range all {
+		assert.Equal(t, fmt.Sprintf("record-%02d", i), record)
+	}
+
+	// A record that exceeds the budget on its own is left unread
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	_, _, err = reader.NextUntilBytes(5)
+	assert.Error(t, err)
+	data, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "record-00", string(data))
+}
+
+func TestReader_ReadRateLimit(t *testing.T) {
+	opts := Options{
+		Directory:     t.TempDir(),
+		SegmentSize:   1 * MB,
+		SyncInterval:  1 * time.Hour,
+		ReadRateLimit: 1 * MB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// Records of 4 KB including the chunk header, the first one making room
+	// for the segment header, fill 16 blocks exactly
+	_, err = wal.Write(make([]byte, 4*KB-segmentHeaderSize-ChecksumCRC32.chunkHeaderSize()))
+	assert.NoError(t, err)
+	for i := 1; i < 16*blockSize/(4*KB); i++ {
+		_, err := wal.Write(make([]byte, 4*KB-ChecksumCRC32.chunkHeaderSize()))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+	size := wal.segment.flushedSize()
+
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	start := time.Now()
+	for {
+		if _, err := reader.Next(); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+	// Everything beyond the first block has to wait for the limit
+	minimum := time.Duration(float64(size-blockSize) / float64(opts.ReadRateLimit) * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), minimum)
+}
+
+func TestSegment_ReverseIterator(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var records [][]byte
+	write := func(data []byte) {
+		_, err := wal.Write(data)
+		assert.NoError(t, err)
+		records = append(records, data)
+	}
+	for i := 0; i < 5; i++ {
+		write([]byte(fmt.Sprintf("record %d", i)))
+	}
+	write([]byte{})
+	write(make([]byte, 2*blockSize)) // Spans three blocks
+	// Leave too little room for a chunk header so the block gets padded
+	used := int(wal.segment.Size() % blockSize)
+	write(make([]byte, blockSize-used-ChecksumCRC32.chunkHeaderSize()-4))
+	write([]byte("after padding"))
+
+	reverse := func() [][]byte {
+		it, err := wal.ReverseIterator(0)
+		assert.NoError(t, err)
+		var got [][]byte
+		for {
+			data, err := it.Next()
+			if err == io.EOF {
+				return got
+			}
+			assert.NoError(t, err)
+			got = append(got, data)
+		}
+	}
+	reversed := func() [][]byte {
+		var out [][]byte
+		for i := len(records) - 1; i >= 0; i-- {
+			out = append(out, records[i])
+		}
+		return out
+	}
+
+	assert.Equal(t, reversed(), reverse())
+
+	// The index picks up records written after it was built.
+	write([]byte("late record"))
+	assert.Equal(t, reversed(), reverse())
+}
+
+func TestSegment_ReverseIteratorTombstone(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * MB,
+		SyncInterval:   1 * time.Hour,
+		AllowOverwrite: true,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for _, data := range []string{"r0", "r1", "r2"} {
+		pos, err := wal.Write([]byte(data))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	it, err := wal.ReverseIterator(0)
+	assert.NoError(t, err)
+
+	// A record tombstoned during the iteration is skipped
+	var got []string
+	for {
+		data, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		got = append(got, string(data))
+		if len(got) == 1 {
+			assert.NoError(t, wal.Tombstone(positions[1]))
+		}
+	}
+	assert.Equal(t, []string{"r2", "r0"}, got)
+}
+
+func TestWAL_RebuildIndex(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  128,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %02d", i)))
+		assert.NoError(t, err)
+	}
+	first := func(segmentId int) string {
+		it, err := wal.ReverseIterator(segmentId)
+		assert.NoError(t, err)
+		data, err := it.Next()
+		assert.NoError(t, err)
+		return string(data)
+	}
+	last := first(0)
+
+	// Lose the index: it claims the segment was scanned with no records
+	seg := wal.segments[0]
+	seg.index = nil
+	seg.indexNext = Position{SegmentId: 0, BlockId: 1}
+	it, err := wal.ReverseIterator(0)
+	assert.NoError(t, err)
+	_, err = it.Next()
+	assert.Equal(t, io.EOF, err)
+
+	assert.NoError(t, wal.RebuildIndex(0))
+	assert.Equal(t, last, first(0))
+
+	// The active segment is flushed and indexed as well
+	assert.NoError(t, wal.RebuildIndexes())
+	assert.Equal(t, "record 19", first(wal.segment.Id()))
+	assert.Error(t, wal.RebuildIndex(99))
+}
+
+func TestWAL_ReaderStream(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64 * KB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 60; i++ {
+		_, err := wal.Write(bytes.Repeat([]byte{byte(i)}, i*997%5000))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, len(wal.segments), 1)
+
+	reader, err := wal.NewReaderFromStart()
+	assert.NoError(t, err)
+	defer reader.Close()
+	var want []byte
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		want = append(want, data...)
+	}
+
+	start := Position{SegmentId: wal.firstSegmentId()}
+	stream, err := wal.ReaderStream(&start)
+	assert.NoError(t, err)
+	got, err := io.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, Position{SegmentId: wal.firstSegmentId()}, start, "the position is not advanced")
+
+	// Small buffers split records across reads
+	stream, err = wal.ReaderStream(&start)
+	assert.NoError(t, err)
+	defer stream.Close()
+	got, err = io.ReadAll(iotest.OneByteReader(stream))
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,220 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// RecoverTo makes the record at pos the last record of the WAL, for crash
+// recovery up to a position processed durably elsewhere. The data up to and
+// including the record is verified first and an error is returned, leaving
+// the WAL untouched, if any of it is corrupt. Then everything after the
+// record is discarded like TruncateAfter does.
+func (w *WAL) RecoverTo(pos *Position) error {
+	if w.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.truncateAfter(pos, true)
+}
+
+// TruncateAfter discards everything written after the record at pos: the
+// rest of its segment, partial blocks included, and all later segments. New
+// records are appended right after it. A nil pos discards every record and
+// appending resumes at the start of the oldest segment, the sequence numbers
+// of Options.SequenceIndex restarting from 0. Unlike RecoverTo it
+// only reads the record at pos, so its cost does not grow with the WAL, e.g.
+// to drop a conflicting suffix of a replicated log.
+func (w *WAL) TruncateAfter(pos *Position) error {
+	if w.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.truncateAfter(pos, false)
+}
+
+// truncateAfter is TruncateAfter with w.mu held, verifying the data up to
+// the record at pos first if verify is set
+func (w *WAL) truncateAfter(pos *Position, verify bool) error {
+	infos := w.segmentInfos()
+	var seg *Segment
+	var next Position
+	if pos == nil {
+		seg = w.segments[infos[0].Id]
+		next = Position{SegmentId: seg.id}
+		seg.skipHeader(&next)
+	} else {
+		var ok bool
+		if seg, ok = w.segments[pos.SegmentId]; !ok {
+			return fmt.Errorf("segment %d not found", pos.SegmentId)
+		}
+	}
+	if err := w.segment.flushBlock(false); err != nil {
+		return err
+	}
+	if pos != nil {
+		var err error
+		_, next, err = seg.read(pos)
+		if err != nil && err != ErrTombstoned && err != errCheckpoint {
+			return fmt.Errorf("record at %+v: %w", *pos, err)
+		}
+	}
+	end := seg.fileOffset(next)
+
+	for _, info := range infos {
+		if !verify || info.Id > seg.id {
+			break
+		}
+		s := w.segments[info.Id]
+		size := s.flushedSize()
+		if s == seg {
+			size = end
+		}
+		fd, err := s.file()
+		if err != nil {
+			return err
+		}
+		if err := verifySegmentData(fd, size, s.dataStart, s.header, nil); err != nil {
+			return fmt.Errorf("segment %d: %w", info.Id, err)
+		}
+	}
+
+	for _, info := range infos {
+		if info.Id <= seg.id {
+			continue
+		}
+		s := w.segments[info.Id]
+		if err := s.release(); err != nil {
+			return err
+		}
+		s.closed = true
+		delete(w.segments, info.Id)
+		if err := w.opts.FS.Remove(s.path); err != nil {
+			return err
+		}
+	}
+
+	if w.opts.Archiver != nil && w.archivedTo > seg.id {
+		// The segment is written to again, so it is archived anew
+		if err := w.setArchived(seg.id); err != nil {
+			return err
+		}
+	}
+
+	// Cut the segment after the record and reopen it as the active segment
+	if err := seg.release(); err != nil {
+		return err
+	}
+	seg.closed = true
+	if err := truncateFile(w.opts.FS, seg.path, end); err != nil {
+		return err
+	}
+	active, err := newSegment(seg.id, seg.path, w.segmentOptions())
+	if err != nil {
+		return err
+	}
+	w.segments[seg.id] = active
+	w.segment = active
+	w.dropUnsynced(next)
+	w.notifyFlushed()
+
+	if err := w.rebuildKeys(); err != nil {
+		return err
+	}
+	if w.seqIndex != nil {
+		if err := w.seqIndex.truncate(w.seqIndex.search(next)); err != nil {
+			return err
+		}
+		if len(w.seqIndex.positions) == 0 {
+			w.seqIndex.first = 0 // Like an empty index file is loaded
+		}
+	}
+	if w.opts.HashChain {
+		w.chainHash = [chainHashSize]byte{}
+		if err := w.loadChainHash(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepairReport describes the torn tail discarded by Options.RepairOnOpen
+type RepairReport struct {
+	SegmentId      int   // The active segment that was repaired
+	Offset         int64 // End of its last intact record, where it was cut
+	DiscardedBytes int64 // Number of bytes discarded after Offset
+	Err            error // The problem found at Offset
+}
+
+// RepairReport returns what Options.RepairOnOpen discarded when the WAL was
+// opened, nil if the active segment was intact
+func (w *WAL) RepairReport() *RepairReport {
+	return w.repair
+}
+
+// repairActive scans the active segment for the last intact record and cuts
+// a torn or corrupt tail after it, see Options.RepairOnOpen
+func (w *WAL) repairActive() error {
+	seg := w.segment
+	pos := Position{SegmentId: seg.id}
+	var problem error
+	for {
+		_, _, next, err := seg.readNext(pos)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			problem = err
+			break
+		}
+		pos = next
+	}
+	end := max(seg.fileOffset(pos), int64(seg.dataStart))
+	size := seg.flushedSize()
+	if err := w.cutActive(end); err != nil {
+		return err
+	}
+	w.repair = &RepairReport{SegmentId: seg.id, Offset: end, DiscardedBytes: size - end, Err: problem}
+	return nil
+}
+
+// cutActive discards the flushed data of the active segment after end and
+// reopens it, so new records are appended at end
+func (w *WAL) cutActive(end int64) error {
+	seg := w.segment
+	if err := seg.release(); err != nil {
+		return err
+	}
+	seg.closed = true
+	if err := truncateFile(w.opts.FS, seg.path, end); err != nil {
+		return err
+	}
+	active, err := newSegment(seg.id, seg.path, w.segmentOptions())
+	if err != nil {
+		return err
+	}
+	w.segments[seg.id] = active
+	w.segment = active
+	w.dropUnsynced(seg.positionAt(end))
+	return nil
+}
+
+// truncateFile cuts the file at path to size bytes and syncs it
+func truncateFile(fsys FS, path string, size int64) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,247 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_RecoverTo(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+	good := positions[30]
+	assert.Less(t, good.SegmentId, positions[59].SegmentId)
+
+	// Corrupt a record after the good position and leave a torn tail
+	path := wal.opts.segmentPath(opts.Directory, positions[40].SegmentId)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	raw[positions[40].Offset+ChecksumCRC32.chunkHeaderSize()] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+	last := wal.opts.segmentPath(opts.Directory, positions[59].SegmentId)
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0x12, 0x34, 0x56})
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.RecoverTo(good))
+	assert.Equal(t, good.SegmentId, wal.segment.Id())
+	for i := 31; i < 40; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// The log resumes cleanly after the good position
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func TestWAL_RecoverToCorruptPrefix(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	path := wal.opts.segmentPath(opts.Directory, positions[5].SegmentId)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	raw[positions[5].Offset+ChecksumCRC32.chunkHeaderSize()] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	segments := len(wal.Segments())
+	assert.ErrorIs(t, wal.RecoverTo(positions[50]), ErrInvalidCRC)
+	assert.Len(t, wal.Segments(), segments, "nothing is discarded")
+}
+
+func TestWAL_TruncateAfter(t *testing.T) {
+	opts := Options{
+		Directory:     t.TempDir(),
+		SegmentSize:   256,
+		SyncInterval:  1 * time.Hour,
+		SequenceIndex: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	// Corrupt data before the position does not stop the truncation
+	path := wal.opts.segmentPath(opts.Directory, positions[5].SegmentId)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	raw[positions[5].Offset+ChecksumCRC32.chunkHeaderSize()] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+
+	records := func() []string {
+		r, err := wal.NewReader(positions[40])
+		assert.NoError(t, err)
+		var got []string
+		for {
+			data, err := r.Next()
+			if err == io.EOF {
+				return got
+			}
+			assert.NoError(t, err)
+			got = append(got, string(data))
+		}
+	}
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.TruncateAfter(positions[41]))
+	assert.Equal(t, positions[41].SegmentId, wal.segment.Id())
+	next, err := wal.NextSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), next)
+	_, err = wal.Write([]byte("replaced 42"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, []string{"record 40", "record 41", "replaced 42"}, records())
+	data, err := wal.ReadBySeq(42)
+	assert.NoError(t, err)
+	assert.Equal(t, "replaced 42", string(data))
+
+	// A nil position discards every record
+	assert.NoError(t, wal.TruncateAfter(nil))
+	assert.Len(t, wal.Segments(), 1)
+	next, err = wal.NextSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), next)
+	pos, err := wal.Write([]byte("fresh"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	data, err = r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", string(data))
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	data, err = wal.ReadBySeq(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", string(data))
+	assert.Equal(t, 0, pos.SegmentId)
+}
+
+func TestWAL_RepairOnOpen(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var last *Position
+	for i := 0; i < 20; i++ {
+		last, err = wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+	intact := wal.segment.fileOffset(*last) + int64(ChecksumCRC32.chunkHeaderSize()+len("record 19"))
+
+	// A crash in the middle of a flush left a torn chunk behind the padding
+	path := wal.segment.path
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	torn := []byte{0xde, 0xad, 0xbe, 0xef, 0x40, 0x00, 0x00, 't', 'o', 'r', 'n'}
+	assert.NoError(t, os.WriteFile(path, append(raw, torn...), 0644))
+
+	readOnly := opts
+	readOnly.ReadOnly = true
+	wal, err = Open(readOnly)
+	assert.NoError(t, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, report.Errors, "the torn chunk is found without repair")
+	assert.Nil(t, wal.RepairReport())
+	assert.NoError(t, wal.Close())
+
+	opts.RepairOnOpen = true
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	repair := wal.RepairReport()
+	assert.NotNil(t, repair)
+	assert.Equal(t, wal.segment.Id(), repair.SegmentId)
+	assert.Equal(t, intact, repair.Offset)
+	assert.Equal(t, int64(len(raw)+len(torn))-intact, repair.DiscardedBytes)
+	assert.Error(t, repair.Err)
+	for i := 20; i < 25; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// The repaired segment was appended to cleanly
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Nil(t, wal.RepairReport())
+	r, err := wal.NewReaderFromStart()
+	assert.NoError(t, err)
+	defer r.Close()
+	for i := 0; i < 25; i++ {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err = wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+}
@@ -0,0 +1,265 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+)
+
+// SegmentRepair describes what Repair discarded from a damaged segment
+type SegmentRepair struct {
+	SegmentId int
+	Path      string
+	Discarded []ByteRange // Ranges of the segment file whose records were discarded, in order
+	Err       error       // The first problem found in the segment
+}
+
+// ByteRange is a range of bytes of a file
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// Repair salvages the intact records of the WAL configured by opts, which
+// must not be open, and returns what it discarded from each damaged
+// segment. Every damaged segment is rewritten as a clean file that keeps
+// the records whose chunks all have valid CRCs at their positions, so
+// positions held elsewhere stay valid:
+//
+//   - A damaged chunk and the rest of its block are replaced by padding,
+//     or cut off at the end of the file.
+//   - The intact chunks of records that lost other chunks are marked as
+//     erased, readers skip them as if they were tombstoned.
+//
+// Records after a discarded one no longer verify with Options.HashChain.
+// Single record segments are left as they are.
+func Repair(opts Options) ([]SegmentRepair, error) {
+	opts, err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	ids, dirs, err := opts.findSegments()
+	if err != nil {
+		return nil, err
+	}
+	var repairs []SegmentRepair
+	for _, id := range ids {
+		repair, err := repairSegment(opts.FS, id, opts.segmentPath(dirs[id], id))
+		if err != nil {
+			return repairs, fmt.Errorf("failed to repair segment %d: %w", id, err)
+		}
+		if repair != nil {
+			repairs = append(repairs, *repair)
+		}
+	}
+	return repairs, nil
+}
+
+// repairSegment rewrites the segment file at path if it is damaged, see
+// Repair, and returns what was discarded, nil if it is intact
+func repairSegment(fsys FS, id int, path string) (*SegmentRepair, error) {
+	seg, err := newSegment(id, path, segmentOptions{fs: fsys, readOnly: true, stats: &ioStats{}})
+	if err != nil {
+		return nil, err
+	}
+	defer seg.Close()
+	if seg.singleRecord() {
+		return nil, nil
+	}
+	src, err := seg.file()
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".repair"
+	dst, err := fsys.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := segmentRepairer{
+		seg:    seg,
+		dst:    dst,
+		size:   seg.Size(),
+		repair: SegmentRepair{SegmentId: id, Path: path},
+	}
+	err = r.run(src)
+	if err == nil && r.repair.Err == nil {
+		err = dst.Close()
+		if err == nil {
+			return nil, fsys.Remove(tmp) // Intact
+		}
+	}
+	if err == nil {
+		err = r.finish()
+	}
+	if err != nil {
+		_ = dst.Close()
+		_ = fsys.Remove(tmp)
+		return nil, err
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return &r.repair, nil
+}
+
+// repairChunk is an intact chunk of a segment being repaired
+type repairChunk struct {
+	offset int64 // Offset of the chunk in the segment file
+	length int
+	sum    uint64
+}
+
+// segmentRepairer copies a segment file, discarding what is damaged, see
+// Repair
+type segmentRepairer struct {
+	seg     *Segment
+	dst     File
+	size    int64         // Size of the segment file
+	end     int64         // Size of the repaired file
+	record  []repairChunk // Intact chunks of the record being copied
+	patches []repairChunk // Chunks to mark as erased once their block is written
+	repair  SegmentRepair
+}
+
+// run copies the segment block by block from src to dst
+func (r *segmentRepairer) run(src File) error {
+	s := r.seg
+	format := s.chunkFormat()
+	headerSize := format.headerSize()
+	r.end = r.size
+	data := make([]byte, s.blockSize)
+	for blockID := 0; int64(blockID)*int64(s.blockSize) < r.size; blockID++ {
+		blockStart := int64(blockID) * int64(s.blockSize)
+		data = data[:min(int64(s.blockSize), r.size-blockStart)]
+		if _, err := src.ReadAt(data, blockStart); err != nil {
+			return fmt.Errorf("block %d: %w", blockID, err)
+		}
+		offset := 0
+		if blockID == 0 {
+			offset = s.dataStart
+		}
+		for offset+headerSize <= len(data) {
+			sum, length, chunkType := format.parseHeader(data[offset:])
+			if sum == 0 && length == 0 && chunkType == 0 && isZero(data[offset:]) {
+				break // Padding
+			}
+			base := chunkType &^ (kTombstoneFlag | kCheckpointFlag | kKeyedFlag | kBatchFlag | kCompressedFlag | kZstdFlag)
+			ref := repairChunk{offset: blockStart + int64(offset), length: length, sum: sum}
+			var problem error
+			switch {
+			case offset+headerSize+length > len(data):
+				problem = fmt.Errorf("block %d offset %d: chunk exceeds block", blockID, offset)
+			case !format.checksum.matches(data[offset+headerSize:offset+headerSize+length], sum):
+				problem = fmt.Errorf("block %d offset %d: %w", blockID, offset, ErrInvalidCRC)
+			case base > kLastType:
+				problem = fmt.Errorf("block %d offset %d: unknown chunk type %v", blockID, offset, chunkType)
+			}
+			if problem != nil {
+				// The chunks after it cannot be found, drop the rest of the block
+				r.fail(problem)
+				r.eraseRecord()
+				r.discard(ref.offset, blockStart+int64(len(data)))
+				clear(data[offset:])
+				if blockStart+int64(len(data)) == r.size {
+					r.end = ref.offset // The end of the file
+				}
+				break
+			}
+
+			r.track(ref, base, blockID, offset)
+			offset += headerSize + length
+		}
+		if _, err := r.dst.WriteAt(data, blockStart); err != nil {
+			return err
+		}
+		if err := r.applyPatches(); err != nil {
+			return err
+		}
+	}
+	if len(r.record) > 0 {
+		r.fail(fmt.Errorf("incomplete record at offset %d", r.record[0].offset))
+		r.end = min(r.end, r.record[0].offset)
+		r.discard(r.record[0].offset, r.size)
+		r.record = nil
+	}
+	return nil
+}
+
+// track follows the records through their intact chunks, erasing the
+// chunks of the records that turn out to be broken
+func (r *segmentRepairer) track(ref repairChunk, base ChunkType, blockID, offset int) {
+	switch {
+	case base == kFullType || base == kFirstType:
+		if len(r.record) > 0 {
+			r.fail(fmt.Errorf("block %d offset %d: record before it is incomplete", blockID, offset))
+			r.eraseRecord()
+		}
+		if base == kFirstType {
+			r.record = append(r.record, ref)
+		}
+	case len(r.record) == 0:
+		r.fail(fmt.Errorf("block %d offset %d: unexpected chunk type %v", blockID, offset, base))
+		r.record = append(r.record, ref)
+		r.eraseRecord()
+	default:
+		r.record = append(r.record, ref)
+		if base == kLastType {
+			r.record = r.record[:0]
+		}
+	}
+}
+
+// fail records problem unless an earlier one was found
+func (r *segmentRepairer) fail(problem error) {
+	if r.repair.Err == nil {
+		r.repair.Err = problem
+	}
+}
+
+// discard records the bytes from start to end as discarded
+func (r *segmentRepairer) discard(start, end int64) {
+	ranges := r.repair.Discarded
+	if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == start {
+		ranges[n-1].Length += end - start
+		return
+	}
+	r.repair.Discarded = append(ranges, ByteRange{Offset: start, Length: end - start})
+}
+
+// eraseRecord marks the intact chunks of the record being copied as erased
+func (r *segmentRepairer) eraseRecord() {
+	headerSize := int64(r.seg.chunkHeaderSize())
+	for _, ref := range r.record {
+		r.discard(ref.offset, ref.offset+headerSize+int64(ref.length))
+	}
+	r.patches = append(r.patches, r.record...)
+	r.record = r.record[:0]
+}
+
+// applyPatches rewrites the headers of the erased chunks as those of
+// tombstoned full records, keeping their checksums, which only cover the
+// payload
+func (r *segmentRepairer) applyPatches() error {
+	header := make([]byte, r.seg.chunkHeaderSize())
+	for _, ref := range r.patches {
+		if ref.offset >= r.end {
+			continue // Cut off
+		}
+		r.seg.chunkFormat().putHeader(header, ref.sum, ref.length, kFullType|kTombstoneFlag)
+		if _, err := r.dst.WriteAt(header, ref.offset); err != nil {
+			return err
+		}
+	}
+	r.patches = r.patches[:0]
+	return nil
+}
+
+// finish cuts the repaired file at its end and syncs it
+func (r *segmentRepairer) finish() error {
+	if err := r.dst.Truncate(r.end); err != nil {
+		return err
+	}
+	if err := r.dst.Sync(); err != nil {
+		return err
+	}
+	return r.dst.Close()
+}
@@ -0,0 +1,174 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepair(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  8 * KB,
+		SyncInterval: 1 * time.Hour,
+		BlockSize:    1 * KB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	var records []string
+	for i := 0; i < 200; i++ {
+		record := fmt.Sprintf("record %d %s", i, make([]byte, i%7*20))
+		if i == 150 {
+			record = fmt.Sprintf("record %d %s", i, make([]byte, 2500)) // Spans several blocks
+		}
+		pos, err := wal.Write([]byte(record))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Close())
+	headerSize := ChecksumCRC32.chunkHeaderSize()
+
+	// Nothing to repair
+	repairs, err := Repair(opts)
+	assert.NoError(t, err)
+	assert.Empty(t, repairs)
+
+	// Damage a record in the second block of the first segment and the first
+	// chunk of the record spanning several blocks
+	small := -1
+	for i, pos := range positions {
+		if pos.SegmentId == 0 && pos.BlockId == 1 {
+			small = i
+			break
+		}
+	}
+	big := 150
+	assert.NotEqual(t, positions[small].SegmentId, positions[big].SegmentId)
+	damaged := []int{small, big}
+	for _, i := range damaged {
+		pos := positions[i]
+		path := wal.segments[pos.SegmentId].path
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		data[wal.segment.fileOffset(*pos)+int64(headerSize)+1] ^= 0xff
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+	}
+
+	repairs, err = Repair(opts)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 2)
+	for j, i := range damaged {
+		pos := positions[i]
+		repair := repairs[j]
+		assert.Equal(t, pos.SegmentId, repair.SegmentId)
+		assert.Equal(t, wal.segments[pos.SegmentId].path, repair.Path)
+		assert.True(t, errors.Is(repair.Err, ErrInvalidCRC))
+		assert.NotEmpty(t, repair.Discarded)
+		assert.Equal(t, wal.segment.fileOffset(*pos), repair.Discarded[0].Offset)
+	}
+	// The chunks of the large record in the following blocks are discarded too
+	last := repairs[1].Discarded[len(repairs[1].Discarded)-1]
+	assert.Greater(t, last.Offset+last.Length, wal.segment.fileOffset(*positions[big])+int64(len(records[big])))
+
+	// A record is lost if it starts in a damaged block after the damaged chunk
+	lost := func(i int) bool {
+		for _, d := range damaged {
+			p, q := positions[i], positions[d]
+			if p.SegmentId == q.SegmentId && p.BlockId == q.BlockId && p.Offset >= q.Offset {
+				return true
+			}
+		}
+		return false
+	}
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	var expected []string
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		if lost(i) {
+			assert.Error(t, err, "record %d", i)
+			continue
+		}
+		assert.NoError(t, err, "record %d", i)
+		assert.Equal(t, records[i], string(data))
+		expected = append(expected, records[i])
+	}
+	assert.Less(t, len(expected), len(records))
+
+	// Readers skip the erased chunks
+	start := *positions[0]
+	reader, err := wal.NewReader(&start)
+	assert.NoError(t, err)
+	var read []string
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		read = append(read, string(data))
+	}
+	assert.Equal(t, expected, read)
+	assert.NoError(t, wal.Close())
+
+	repairs, err = Repair(opts)
+	assert.NoError(t, err)
+	assert.Empty(t, repairs, "the repaired segments are clean")
+}
+
+func TestRepair_TornTail(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		BlockSize:    1 * KB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var last *Position
+	for i := 0; i < 10; i++ {
+		last, err = wal.Write([]byte(fmt.Sprintf("record %d %s", i, make([]byte, 300))))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// A crash cut the last record short
+	path := wal.segment.path
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	start := wal.segment.fileOffset(*last)
+	cut := start + int64(ChecksumCRC32.chunkHeaderSize()) + 100
+	assert.NoError(t, os.WriteFile(path, data[:cut], 0644))
+
+	repairs, err := Repair(opts)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 1)
+	assert.Equal(t, []ByteRange{{Offset: start, Length: cut - start}}, repairs[0].Discarded)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, start, info.Size())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	_, err = wal.Read(last)
+	assert.Error(t, err)
+	pos, err := wal.Write([]byte("after repair"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	data, err = wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, "after repair", string(data))
+}
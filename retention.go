@@ -0,0 +1,74 @@
+package wal
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRetentionInterval bounds the interval the age of the segments is
+// checked at with Options.MaxAge, so that long ages are still enforced
+// promptly
+const maxRetentionInterval = time.Minute
+
+// retentionInterval returns the interval the background janitor checks the
+// age of the segments at
+func (o Options) retentionInterval() time.Duration {
+	return max(min(o.MaxAge/2, maxRetentionInterval), time.Millisecond)
+}
+
+// applyRetention purges the oldest sealed segments as long as the WAL
+// exceeds Options.MaxSegments or MaxTotalSize, or they are older than
+// MaxAge at now. The segments are purged in order, so the WAL keeps a
+// contiguous range of segments.
+func (w *WAL) applyRetention(now time.Time) error {
+	if w.opts.MaxSegments == 0 && w.opts.MaxTotalSize == 0 && w.opts.MaxAge == 0 {
+		return nil
+	}
+	infos := w.segmentInfos()
+	count, total := len(infos), int64(0)
+	for _, info := range infos {
+		total += info.Size
+	}
+	for _, info := range infos {
+		if info.Active {
+			break
+		}
+		expired := w.opts.MaxAge > 0 && now.Sub(w.segments[info.Id].sealedAt) >= w.opts.MaxAge
+		if !expired && (w.opts.MaxSegments == 0 || count <= w.opts.MaxSegments) &&
+			(w.opts.MaxTotalSize == 0 || total <= w.opts.MaxTotalSize) {
+			break
+		}
+		if err := w.purge(info.Id); err != nil {
+			return fmt.Errorf("failed to purge segment %d: %w", info.Id, err)
+		}
+		count--
+		total -= info.Size
+	}
+	return nil
+}
+
+// retainSegments purges the segments older than Options.MaxAge until the
+// WAL is closed
+func (w *WAL) retainSegments() {
+	ticker := time.NewTicker(w.opts.retentionInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.retain(now)
+		case <-w.closeC:
+			return
+		}
+	}
+}
+
+// retain applies the retention limits at now, reporting a failure to
+// Options.ErrorHandler
+func (w *WAL) retain(now time.Time) {
+	w.mu.Lock()
+	err := w.applyRetention(now)
+	w.mu.Unlock()
+	if err != nil {
+		w.handleError(fmt.Errorf("retention: %w", err))
+	}
+}
@@ -0,0 +1,79 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Retention(t *testing.T) {
+	// contiguous checks that the WAL keeps a range of segments ending with
+	// the active one and returns its first id
+	contiguous := func(t *testing.T, wal *WAL) int {
+		infos := wal.Segments()
+		for i, info := range infos {
+			assert.Equal(t, infos[0].Id+i, info.Id)
+		}
+		assert.True(t, infos[len(infos)-1].Active)
+		return infos[0].Id
+	}
+	write := func(t *testing.T, wal *WAL, n int) {
+		for i := 0; i < n; i++ {
+			_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+			assert.NoError(t, err)
+		}
+	}
+
+	t.Run("max segments", func(t *testing.T) {
+		dir := t.TempDir()
+		wal, err := Open(Options{Directory: dir, SegmentSize: 64, SyncInterval: time.Hour, MaxSegments: 3})
+		assert.NoError(t, err)
+		defer wal.Close()
+
+		write(t, wal, 20)
+		assert.Greater(t, wal.segment.Id(), 3)
+		assert.Len(t, wal.Segments(), 3)
+		first := contiguous(t, wal)
+		for id := 0; id < first; id++ {
+			_, err := os.Stat(wal.opts.segmentPath(dir, id))
+			assert.True(t, os.IsNotExist(err), "segment %d", id)
+		}
+	})
+
+	t.Run("max total size", func(t *testing.T) {
+		wal, err := Open(Options{Directory: t.TempDir(), SegmentSize: 64, SyncInterval: time.Hour, MaxTotalSize: 200})
+		assert.NoError(t, err)
+		defer wal.Close()
+
+		write(t, wal, 20)
+		assert.Greater(t, contiguous(t, wal), 0)
+		var total int64
+		for _, info := range wal.Segments() {
+			total += info.Size
+		}
+		assert.LessOrEqual(t, total, int64(200+64), "the active segment grows after the rotation")
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		dir := t.TempDir()
+		wal, err := Open(Options{Directory: dir, SegmentSize: 64, SyncInterval: time.Hour})
+		assert.NoError(t, err)
+		write(t, wal, 20)
+		active := wal.segment.Id()
+		assert.NoError(t, wal.Close())
+
+		// The age of the segments sealed before is their modification time
+		wal, err = Open(Options{Directory: dir, SegmentSize: 64, SyncInterval: time.Hour, MaxAge: 20 * time.Millisecond})
+		assert.NoError(t, err)
+		defer wal.Close()
+		assert.Eventually(t, func() bool { return len(wal.Segments()) == 1 }, time.Second, 5*time.Millisecond)
+		assert.Equal(t, active, contiguous(t, wal))
+
+		write(t, wal, 20)
+		assert.Greater(t, len(wal.Segments()), 1)
+		assert.Eventually(t, func() bool { return len(wal.Segments()) == 1 }, time.Second, 5*time.Millisecond)
+	})
+}
@@ -0,0 +1,222 @@
+package wal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler runs the background tasks of WALs, such as the periodic sync
+// and scrubbing, on a fixed number of goroutines shared by all the WALs
+// using it, see Options.BackgroundScheduler. A task never runs concurrently
+// with itself.
+type Scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*schedTask            // Tasks due to run, in order
+	tasks   map[*schedTask]struct{} // Registered tasks
+	closed  bool
+	wakeC   chan struct{} // Wakes up dispatch when a periodic task was scheduled
+	closeC  chan struct{}
+	running atomic.Int64 // Number of tasks running
+	wg      sync.WaitGroup
+}
+
+// schedTask is a task of a Scheduler. Periodic tasks run every interval,
+// measured from the end of the previous run, others when triggered.
+type schedTask struct {
+	run      func()
+	interval time.Duration // 0 for a task that runs when triggered
+	due      time.Time     // When a periodic task runs next, zero while it is queued or running
+
+	queued   bool // In the queue of the scheduler
+	active   bool // Running on a worker
+	again    bool // Triggered while running, runs once more
+	canceled bool
+}
+
+// NewScheduler starts a Scheduler running tasks on the given number of
+// goroutines, at least one, plus one queuing the periodic tasks when they
+// are due.
+func NewScheduler(workers int) *Scheduler {
+	s := &Scheduler{
+		tasks:  make(map[*schedTask]struct{}),
+		wakeC:  make(chan struct{}, 1),
+		closeC: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < max(workers, 1); i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	s.wg.Add(1)
+	go s.dispatch()
+	return s
+}
+
+// Close stops the goroutines of the scheduler after the running tasks are
+// done. The WALs using it should be closed first, their remaining tasks do
+// not run anymore.
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.closeC)
+	s.queue = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Tasks returns the number of background tasks registered by the open WALs
+// using the scheduler
+func (s *Scheduler) Tasks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tasks)
+}
+
+// Running returns the number of background tasks running right now, at most
+// the number of goroutines of the scheduler
+func (s *Scheduler) Running() int {
+	return int(s.running.Load())
+}
+
+// every registers a task running run every interval
+func (s *Scheduler) every(interval time.Duration, run func()) *schedTask {
+	t := &schedTask{run: run, interval: interval}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[t] = struct{}{}
+	s.scheduleLocked(t)
+	return t
+}
+
+// scheduleLocked sets when the periodic task t runs next, with s.mu held
+func (s *Scheduler) scheduleLocked(t *schedTask) {
+	t.due = time.Now().Add(t.interval)
+	select {
+	case s.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch queues the periodic tasks when they are due until the scheduler
+// is closed
+func (s *Scheduler) dispatch() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		var next time.Time
+		for t := range s.tasks {
+			switch {
+			case t.due.IsZero():
+			case !t.due.After(now):
+				t.due = time.Time{}
+				s.queueLocked(t)
+			case next.IsZero() || t.due.Before(next):
+				next = t.due
+			}
+		}
+		s.mu.Unlock()
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wakeC:
+		case <-s.closeC:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// onTrigger registers a task running run whenever it is triggered
+func (s *Scheduler) onTrigger(run func()) *schedTask {
+	t := &schedTask{run: run}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[t] = struct{}{}
+	return t
+}
+
+// trigger queues the task to run. Triggers arriving before it runs are
+// coalesced, one arriving while it runs makes it run once more.
+func (s *Scheduler) trigger(t *schedTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed || t.canceled || t.queued:
+	case t.active:
+		t.again = true
+	default:
+		s.queueLocked(t)
+	}
+}
+
+// queueLocked queues t to run on the next free worker, with s.mu held
+func (s *Scheduler) queueLocked(t *schedTask) {
+	t.queued = true
+	s.queue = append(s.queue, t)
+	s.cond.Signal()
+}
+
+// cancel unregisters the task. A run in progress is not waited for.
+func (s *Scheduler) cancel(t *schedTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.canceled = true
+	if t.queued {
+		for i, queued := range s.queue {
+			if queued == t {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+		t.queued = false
+	}
+	delete(s.tasks, t)
+}
+
+// work runs the queued tasks until the scheduler is closed
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+		t := s.queue[0]
+		s.queue = s.queue[1:]
+		t.queued, t.active = false, true
+		s.mu.Unlock()
+
+		s.running.Add(1)
+		t.run()
+		s.running.Add(-1)
+
+		s.mu.Lock()
+		t.active = false
+		switch {
+		case s.closed || t.canceled:
+		case t.again:
+			t.again = false
+			s.queueLocked(t)
+		case t.interval > 0:
+			s.scheduleLocked(t)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler_SharedByWALs(t *testing.T) {
+	const workers, wals = 2, 50
+	scheduler := NewScheduler(workers)
+	defer scheduler.Close()
+	baseline := runtime.NumGoroutine()
+
+	var opened []*WAL
+	for i := 0; i < wals; i++ {
+		wal, err := Open(Options{
+			Directory:           t.TempDir(),
+			SegmentSize:         1 * GB,
+			SyncInterval:        5 * time.Millisecond,
+			SegmentIdleTimeout:  time.Second,
+			BackgroundScheduler: scheduler,
+		})
+		assert.NoError(t, err)
+		opened = append(opened, wal)
+	}
+	// The sync, the release of idle segments and the sync of appends
+	assert.Equal(t, 3*wals, scheduler.Tasks())
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline+5, "no goroutines per WAL")
+
+	var futures []*Future
+	for _, wal := range opened {
+		_, err := wal.Write([]byte("synced in the background"))
+		assert.NoError(t, err)
+		_, f := wal.Append([]byte("appended"))
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		assert.NoError(t, f.Err())
+	}
+	assert.Eventually(t, func() bool {
+		for _, wal := range opened {
+			wal.mu.Lock()
+			flushed := wal.segment.flushedSize() == wal.segment.Size()
+			wal.mu.Unlock()
+			if !flushed {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 5*time.Millisecond)
+	assert.LessOrEqual(t, scheduler.Running(), workers)
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline+5)
+
+	for _, wal := range opened {
+		assert.NoError(t, wal.Close())
+	}
+	assert.Equal(t, 0, scheduler.Tasks())
+}
+
+func TestScheduler_Trigger(t *testing.T) {
+	scheduler := NewScheduler(1)
+	defer scheduler.Close()
+
+	runs := make(chan struct{}, 10)
+	release := make(chan struct{})
+	task := scheduler.onTrigger(func() {
+		runs <- struct{}{}
+		<-release
+	})
+	scheduler.trigger(task)
+	<-runs
+	// Triggers while it runs make it run once more
+	scheduler.trigger(task)
+	scheduler.trigger(task)
+	release <- struct{}{}
+	<-runs
+	release <- struct{}{}
+	select {
+	case <-runs:
+		t.Fatal("the triggers were not coalesced")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	scheduler.cancel(task)
+	scheduler.trigger(task)
+	select {
+	case <-runs:
+		t.Fatal("a canceled task ran")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, 0, scheduler.Tasks())
+}
@@ -0,0 +1,273 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultScrubBytesPerSecond is the rate sealed segments are read at by the
+// scrubber unless Options.ScrubBytesPerSecond is set.
+const DefaultScrubBytesPerSecond = 16 * MB
+
+// QuickVerify checks the CRC and the chunk type sequence of every chunk in
+// the flushed part of the segment, without reassembling the records. It
+// returns the first problem found, wrapping ErrInvalidCRC for a checksum
+// mismatch.
+func (s *Segment) QuickVerify() error {
+	if s.closed {
+		return ErrClosed
+	}
+	fd, err := s.file()
+	if err != nil {
+		return err
+	}
+	return verifySegmentData(fd, s.flushedSize(), s.dataStart, s.header, nil)
+}
+
+// verifyChunks checks the chunks in the first size bytes of a segment file
+// with blocks of blockSize bytes whose chunks start at dataStart. If set, pace is called after each block
+// and stops the scan when it returns an error.
+func verifyChunks(r io.ReaderAt, size int64, blockSize, dataStart int, format chunkFormat, pace func() error) error {
+	chunkHeaderSize := format.headerSize()
+	buf := make([]byte, blockSize)
+	inRecord := false
+	for blockID := 0; int64(blockID)*int64(blockSize) < size; blockID++ {
+		n := blockSize
+		if rest := size - int64(blockID)*int64(blockSize); rest < int64(blockSize) {
+			n = int(rest)
+		}
+		data := buf[:n]
+		if _, err := r.ReadAt(data, int64(blockID)*int64(blockSize)); err != nil {
+			return fmt.Errorf("block %d: %w", blockID, err)
+		}
+		offset := 0
+		if blockID == 0 {
+			offset = dataStart
+		}
+		for offset+chunkHeaderSize <= len(data) {
+			expectedCRC, length, chunkType := format.parseHeader(data[offset:])
+			chunkType &^= kTombstoneFlag | kCheckpointFlag | kKeyedFlag | kBatchFlag | kCompressedFlag | kZstdFlag
+			if expectedCRC == 0 && length == 0 && data[offset+chunkHeaderSize-1] == 0 && isZero(data[offset:]) {
+				break // Padding
+			}
+			if offset+chunkHeaderSize+length > len(data) {
+				return fmt.Errorf("block %d offset %d: chunk exceeds block", blockID, offset)
+			}
+			payload := data[offset+chunkHeaderSize : offset+chunkHeaderSize+length]
+			if !format.checksum.matches(payload, expectedCRC) {
+				return fmt.Errorf("block %d offset %d: %w", blockID, offset, ErrInvalidCRC)
+			}
+			switch {
+			case !inRecord && (chunkType == kFullType || chunkType == kFirstType),
+				inRecord && (chunkType == kMiddleType || chunkType == kLastType):
+				inRecord = chunkType == kFirstType || chunkType == kMiddleType
+			default:
+				return fmt.Errorf("block %d offset %d: unexpected chunk type %v", blockID, offset, ChunkType(data[offset+chunkHeaderSize-1]))
+			}
+			offset += chunkHeaderSize + length
+		}
+		if pace != nil {
+			if err := pace(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scrub verifies one sealed segment per Options.ScrubInterval, going
+// round-robin over the sealed segments, until the WAL is closed.
+func (w *WAL) scrub() {
+	ticker := time.NewTicker(w.opts.ScrubInterval)
+	defer ticker.Stop()
+	next := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.closeC:
+			return
+		}
+		next = w.scrubNext(next)
+	}
+}
+
+// scrubNext scrubs the sealed segment with the lowest id not below next,
+// see nextScrubSegment, and returns where the next scrub continues
+func (w *WAL) scrubNext(next int) int {
+	id, path, ok := w.nextScrubSegment(next)
+	if !ok {
+		return next
+	}
+	if err := w.scrubSegment(path); err != nil && err != ErrClosed {
+		if w.opts.OnScrubError != nil {
+			w.opts.OnScrubError(id, err)
+		} else {
+			w.handleError(fmt.Errorf("scrub of segment %d: %w", id, err))
+		}
+	}
+	return id + 1
+}
+
+// nextScrubSegment returns the sealed segment with the lowest id not below
+// from, wrapping around to the lowest id.
+func (w *WAL) nextScrubSegment(from int) (int, string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var ids []int
+	for id, seg := range w.segments {
+		if seg != w.segment {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, "", false
+	}
+	sort.Ints(ids)
+	i := sort.SearchInts(ids, from)
+	if i == len(ids) {
+		i = 0
+	}
+	return ids[i], w.segments[ids[i]].path, true
+}
+
+// scrubSegment verifies the segment file at path through a handle of its
+// own, so neither writers nor readers of the WAL are blocked. The reads are
+// paced to Options.ScrubBytesPerSecond.
+func (w *WAL) scrubSegment(path string) error {
+	perBlock := time.Duration(float64(w.opts.BlockSize) / float64(w.opts.ScrubBytesPerSecond) * float64(time.Second))
+	_, err := w.verifySegmentFile(path, -1, func() error {
+		select {
+		case <-time.After(perBlock):
+			return nil
+		case <-w.closeC:
+			return ErrClosed
+		}
+	})
+	return err
+}
+
+// verifySegmentFile verifies the first size bytes of the segment file at
+// path, or all of it if size is negative, through a handle of its own and
+// returns the number of bytes verified. A file purged in the meantime is
+// skipped.
+func (w *WAL) verifySegmentFile(path string, size int64, pace func() error) (int64, error) {
+	f, err := w.opts.FS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil // Purged in the meantime
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	if size < 0 {
+		if size, err = f.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	dataStart := 0
+	var header segmentHeader
+	if size >= segmentHeaderSize {
+		buf := make([]byte, segmentHeaderSize)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			return 0, err
+		}
+		var ok bool
+		if header, ok = decodeSegmentHeader(buf); ok {
+			dataStart = segmentHeaderSize
+		}
+	}
+	return size, verifySegmentData(f, size, dataStart, header, pace)
+}
+
+// VerifyReport is the result of Verify and VerifyParallel
+type VerifyReport struct {
+	Segments int            // Number of segments verified
+	Bytes    int64          // Number of bytes verified
+	Errors   []SegmentError // The first problem of each damaged segment, ordered by segment id
+}
+
+// SegmentError is a problem found in a segment
+type SegmentError struct {
+	SegmentId int
+	Err       error
+}
+
+func (e SegmentError) Error() string {
+	return fmt.Sprintf("segment %d: %v", e.SegmentId, e.Err)
+}
+
+func (e SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// Verify checks the CRC and the chunk type sequence of every chunk of every
+// segment, like QuickVerify, and reports the damaged segments. The buffered
+// block of the active segment is flushed first. Neither writers nor readers
+// are blocked while the segments are read.
+func (w *WAL) Verify() (*VerifyReport, error) {
+	return w.verify(1)
+}
+
+// VerifyParallel is Verify with the segments spread over the given number of
+// worker goroutines. Records never span segments, so every segment is
+// verified on its own. The report is the same as that of Verify.
+func (w *WAL) VerifyParallel(workers int) (*VerifyReport, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("workers must be positive, got %d", workers)
+	}
+	return w.verify(workers)
+}
+
+func (w *WAL) verify(workers int) (*VerifyReport, error) {
+	type job struct {
+		id   int
+		path string
+		size int64
+	}
+	w.mu.Lock()
+	if !w.opts.ReadOnly {
+		if err := w.segment.flushBlock(false); err != nil {
+			w.mu.Unlock()
+			return nil, err
+		}
+	}
+	var jobs []job
+	for _, info := range w.segmentInfos() {
+		seg := w.segments[info.Id]
+		jobs = append(jobs, job{id: info.Id, path: seg.path, size: seg.flushedSize()})
+	}
+	w.mu.Unlock()
+
+	sizes := make([]int64, len(jobs))
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				sizes[j], errs[j] = w.verifySegmentFile(jobs[j].path, jobs[j].size, nil)
+			}
+		}()
+	}
+	for j := range jobs {
+		next <- j
+	}
+	close(next)
+	wg.Wait()
+
+	report := &VerifyReport{Segments: len(jobs)}
+	for j, job := range jobs {
+		report.Bytes += sizes[j]
+		if errs[j] != nil {
+			report.Errors = append(report.Errors, SegmentError{SegmentId: job.id, Err: errs[j]})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_Scrub(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 60; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.Greater(t, wal.segment.Id(), 2)
+	for _, info := range wal.Segments() {
+		if !info.Active {
+			assert.NoError(t, wal.segments[info.Id].QuickVerify())
+		}
+	}
+	assert.NoError(t, wal.Close())
+
+	// Flip a payload byte of record 1 in the first segment
+	path := wal.opts.segmentPath(opts.Directory, 1)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	i := bytes.Index(raw, []byte("record"))
+	assert.GreaterOrEqual(t, i, 0)
+	raw[i] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+
+	type failure struct {
+		id  int
+		err error
+	}
+	failures := make(chan failure, 16)
+	opts.ScrubInterval = 5 * time.Millisecond
+	opts.OnScrubError = func(id int, err error) {
+		failures <- failure{id, err}
+	}
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	select {
+	case f := <-failures:
+		assert.Equal(t, 1, f.id)
+		assert.ErrorIs(t, f.err, ErrInvalidCRC)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scrubber did not report the corrupted segment")
+	}
+	assert.ErrorIs(t, wal.segments[1].QuickVerify(), ErrInvalidCRC)
+	assert.NoError(t, wal.segments[0].QuickVerify())
+}
+
+func TestWAL_VerifyParallel(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * KB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	_, err = wal.Write(bytes.Repeat([]byte("x"), 3*blockSize))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	last := wal.segment.Id()
+	assert.Greater(t, last, 3)
+
+	// Corrupt a few segments, the last one in the middle of a record
+	// spanning blocks
+	corrupt := func(id int, at func(raw []byte) int) {
+		path := wal.opts.segmentPath(opts.Directory, id)
+		raw, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		raw[at(raw)] ^= 0xff
+		assert.NoError(t, os.WriteFile(path, raw, 0644))
+	}
+	lastRecord := func(raw []byte) int { return bytes.LastIndex(raw, []byte("record")) }
+	corrupt(1, lastRecord)
+	corrupt(3, lastRecord)
+	corrupt(last, func(raw []byte) int { return blockSize + 100 })
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	serial, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, len(wal.Segments()), serial.Segments)
+	var damaged []int
+	for _, e := range serial.Errors {
+		assert.ErrorIs(t, e, ErrInvalidCRC)
+		damaged = append(damaged, e.SegmentId)
+	}
+	assert.Equal(t, []int{1, 3, last}, damaged)
+
+	for _, workers := range []int{2, 4, 16} {
+		parallel, err := wal.VerifyParallel(workers)
+		assert.NoError(t, err)
+		assert.Equal(t, serial, parallel)
+	}
+	_, err = wal.VerifyParallel(0)
+	assert.Error(t, err)
+}
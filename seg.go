@@ -1,17 +1,31 @@
 package wal
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"hash/crc64"
 	"io"
+	"math"
+	"math/bits"
 	"os"
+	"sync"
+	"time"
 
 	sp "github.com/ongniud/slice-pool"
 )
 
+// Sizes of the default buffer pool, those of sp.NewSlicePoolDefault
+const (
+	defaultPoolMin    = 16
+	defaultPoolMax    = 1024
+	defaultPoolFactor = 2
+)
+
 var (
 	bp = sp.NewSlicePoolDefault[byte]()
 )
@@ -23,10 +37,12 @@ const (
 	GB = 1024 * MB
 )
 
-// Block size, currently set to 128 bytes (originally 32KB)
+// blockSize is the default block size, see Options.BlockSize. Segments
+// record their block size in their header, legacy segments use blockSize.
 const (
-	blockSize       = 32 * KB
-	chunkHeaderSize = 7
+	blockSize    = 32 * KB
+	minBlockSize = 64      // Holds the segment header and a chunk header
+	maxBlockSize = 64 * KB // The length of a chunk is stored in 16 bits
 )
 
 // ChunkType represents the type of chunk, stored as a byte
@@ -38,26 +54,315 @@ const (
 	kFirstType
 	kMiddleType
 	kLastType
+
+	// kTombstoneFlag is set on every chunk of a record erased by Tombstone
+	kTombstoneFlag ChunkType = 0x80
+	// kCheckpointFlag is set on every chunk of a checkpoint record
+	kCheckpointFlag ChunkType = 0x40
+	// kKeyedFlag is set on every chunk of a record written by WriteKeyed,
+	// whose payload starts with its key
+	kKeyedFlag ChunkType = 0x20
+	// kBatchFlag is set on every chunk of the records of an atomic batch
+	// but the last one, whose durability commits the batch
+	kBatchFlag ChunkType = 0x10
+	// kCompressedFlag is set on every chunk of a record stored compressed,
+	// see Options.Compression
+	kCompressedFlag ChunkType = 0x08
+	// kZstdFlag is set along with kCompressedFlag on the chunks of a record
+	// compressed with zstd rather than snappy
+	kZstdFlag ChunkType = 0x04
 )
 
+// String returns the name of the chunk type
+func (t ChunkType) String() string {
+	if t&kTombstoneFlag != 0 {
+		return (t &^ kTombstoneFlag).String() + "(tombstone)"
+	}
+	if t&kCheckpointFlag != 0 {
+		return (t &^ kCheckpointFlag).String() + "(checkpoint)"
+	}
+	if t&kKeyedFlag != 0 {
+		return (t &^ kKeyedFlag).String() + "(keyed)"
+	}
+	if t&kBatchFlag != 0 {
+		return (t &^ kBatchFlag).String() + "(batch)"
+	}
+	if t&kCompressedFlag != 0 {
+		if t&kZstdFlag != 0 {
+			return (t &^ (kCompressedFlag | kZstdFlag)).String() + "(zstd)"
+		}
+		return (t &^ kCompressedFlag).String() + "(compressed)"
+	}
+	switch t {
+	case kFullType:
+		return "full"
+	case kFirstType:
+		return "first"
+	case kMiddleType:
+		return "middle"
+	case kLastType:
+		return "last"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// ChunkLayout is the order of the fields in a chunk header. The layout of a
+// segment is recorded in its header, legacy segments use LayoutCRCFirst.
+type ChunkLayout byte
+
+const (
+	// LayoutCRCFirst stores checksum length(2) type(1)
+	LayoutCRCFirst ChunkLayout = iota
+	// LayoutLengthFirst stores length(2) checksum type(1), so a streaming
+	// decoder learns the payload length before the checksum
+	LayoutLengthFirst
+)
+
+// ChecksumType is the checksum of the chunk payloads. The checksum type of a
+// segment is recorded in its header, legacy segments use ChecksumCRC32.
+type ChecksumType byte
+
+const (
+	// ChecksumCRC32 stores the CRC-32 (IEEE) of a chunk in 4 bytes
+	ChecksumCRC32 ChecksumType = iota
+	// ChecksumCRC64 stores the CRC-64 (ECMA) of a chunk in 8 bytes
+	ChecksumCRC64
+	// checksumNone stores 0 in the 4 bytes of the checksum and skips its
+	// verification, see Options.NoChecksum
+	checksumNone
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// size returns the number of bytes of the checksum in a chunk header
+func (c ChecksumType) size() int {
+	if c == ChecksumCRC64 {
+		return 8
+	}
+	return 4
+}
+
+// sum returns the checksum of data
+func (c ChecksumType) sum(data []byte) uint64 {
+	switch c {
+	case ChecksumCRC64:
+		return crc64.Checksum(data, crc64Table)
+	case checksumNone:
+		return 0
+	}
+	return uint64(crc32.ChecksumIEEE(data))
+}
+
+// matches reports whether expected is the checksum of data. Without a
+// checksum any data matches.
+func (c ChecksumType) matches(data []byte, expected uint64) bool {
+	return c == checksumNone || c.sum(data) == expected
+}
+
+// chunkHeaderSize returns the size of a chunk header holding the checksum:
+// the checksum, a 2 byte length and the chunk type
+func (c ChecksumType) chunkHeaderSize() int {
+	return c.size() + 3
+}
+
+// chunkFormat describes the chunk headers of a segment
+type chunkFormat struct {
+	layout   ChunkLayout
+	checksum ChecksumType
+}
+
+// headerSize returns the size of a chunk header
+func (f chunkFormat) headerSize() int {
+	return f.checksum.chunkHeaderSize()
+}
+
+// putHeader encodes a chunk header into buf
+func (f chunkFormat) putHeader(buf []byte, sum uint64, length int, chunkType ChunkType) {
+	n := f.checksum.size()
+	sumAt := 0
+	if f.layout == LayoutLengthFirst {
+		binary.LittleEndian.PutUint16(buf[0:2], uint16(length))
+		sumAt = 2
+	} else {
+		binary.LittleEndian.PutUint16(buf[n:n+2], uint16(length))
+	}
+	if n == 8 {
+		binary.LittleEndian.PutUint64(buf[sumAt:], sum)
+	} else {
+		binary.LittleEndian.PutUint32(buf[sumAt:], uint32(sum))
+	}
+	buf[n+2] = byte(chunkType)
+}
+
+// parseHeader decodes the chunk header at the start of buf
+func (f chunkFormat) parseHeader(buf []byte) (sum uint64, length int, chunkType ChunkType) {
+	n := f.checksum.size()
+	sumAt := 0
+	if f.layout == LayoutLengthFirst {
+		length = int(binary.LittleEndian.Uint16(buf[0:2]))
+		sumAt = 2
+	} else {
+		length = int(binary.LittleEndian.Uint16(buf[n : n+2]))
+	}
+	if n == 8 {
+		sum = binary.LittleEndian.Uint64(buf[sumAt:])
+	} else {
+		sum = uint64(binary.LittleEndian.Uint32(buf[sumAt:]))
+	}
+	return sum, length, ChunkType(buf[n+2])
+}
+
 // Error constants
 var (
-	ErrClosed     = errors.New("the segment file is closed")
+	ErrClosed            = errors.New("the segment file is closed")
+	ErrUnsupportedFormat = errors.New("unsupported segment format")
+	ErrTombstoned        = errors.New("the record was erased by a tombstone")
+
+	// errCheckpoint is returned by read along with the state of a
+	// checkpoint record, which readers skip
+	errCheckpoint = errors.New("checkpoint record")
 	ErrInvalidCRC = errors.New("invalid crc, the data may be corrupted")
 	ErrEndOfBlock = errors.New("reach the end of block")
+
+	ErrLengthMismatch = errors.New("data length does not match the stored record")
+	ErrReadOnly       = errors.New("the segment file is opened read-only")
+	ErrRecordTooLong  = errors.New("record has more chunks than allowed")
+	ErrSegmentSealed  = errors.New("the segment is sealed")
+	ErrRecordTooLarge = errors.New("record does not fit in a block")
 )
 
 var (
-	paddingBlock = make([]byte, blockSize)
+	paddingBlock = make([]byte, maxBlockSize)
+)
+
+// errMmapUnsupported is returned by mmapFile for files it cannot map
+var errMmapUnsupported = errors.New("the file cannot be memory-mapped")
+
+// Every segment file created by this package starts with a header describing
+// its format. Files without one are legacy segments and hold chunks from the
+// very first byte.
+const (
+	segmentHeaderSize    = 32
+	segmentHeaderVersion = 1
 )
 
-// Segment represents the Write-Ahead Log segment
+var segmentMagic = [4]byte{'W', 'A', 'L', 'S'}
+
+// segmentHeader is the decoded header of a segment file. The layout is
+//
+//	magic(4) version(1) layout(1) flags(1) blockShift(1) checksum(1) reserved(3) epoch(8) fence(8) crc(4)
+//
+// with the crc covering the preceding 28 bytes.
+type segmentHeader struct {
+	version  byte         // 0 for legacy segments without a header
+	layout   ChunkLayout  // Layout of the chunk headers in the segment
+	checksum ChecksumType // Checksum of the chunks in the segment
+	flags    byte         // segmentFlag bits
+	epoch    uint64       // Application defined epoch the segment was created in
+	fence    uint64       // Fencing token of the writer that created the segment
+
+	// Block size of the segment, stored as its base 2 logarithm. Zero for
+	// headers written before the block size was configurable, which use
+	// blockSize.
+	blockSize int
+}
+
+// segmentFlagHashChain marks segments whose records are prefixed with their
+// chain hash, see Options.HashChain
+const segmentFlagHashChain byte = 1 << 0
+
+// segmentFlagSingleRecord marks segments holding a single unframed record,
+// see Options.SingleRecordSegments
+const segmentFlagSingleRecord byte = 1 << 1
+
+// encode returns the on-disk representation of the header
+func (h segmentHeader) encode() []byte {
+	buf := make([]byte, segmentHeaderSize)
+	copy(buf[0:4], segmentMagic[:])
+	buf[4] = h.version
+	buf[5] = byte(h.layout)
+	buf[6] = h.flags
+	if h.blockSize != 0 {
+		buf[7] = byte(bits.TrailingZeros(uint(h.blockSize)))
+	}
+	buf[8] = byte(h.checksum)
+	binary.LittleEndian.PutUint64(buf[12:20], h.epoch)
+	binary.LittleEndian.PutUint64(buf[20:28], h.fence)
+	binary.LittleEndian.PutUint32(buf[28:32], crc32.ChecksumIEEE(buf[:28]))
+	return buf
+}
+
+// decodeSegmentHeader parses a segment header, reporting false if data does
+// not start with a valid one
+func decodeSegmentHeader(data []byte) (segmentHeader, bool) {
+	if len(data) < segmentHeaderSize || [4]byte(data[0:4]) != segmentMagic {
+		return segmentHeader{}, false
+	}
+	if crc32.ChecksumIEEE(data[:28]) != binary.LittleEndian.Uint32(data[28:32]) {
+		return segmentHeader{}, false
+	}
+	header := segmentHeader{
+		version:  data[4],
+		layout:   ChunkLayout(data[5]),
+		checksum: ChecksumType(data[8]),
+		flags:    data[6],
+		epoch:    binary.LittleEndian.Uint64(data[12:20]),
+		fence:    binary.LittleEndian.Uint64(data[20:28]),
+	}
+	if shift := data[7]; shift != 0 {
+		header.blockSize = 1 << min(shift, 31)
+	}
+	return header, true
+}
+
+// Segment represents the Write-Ahead Log segment. Its read methods may be
+// called concurrently; writes must not overlap with any other call.
 type Segment struct {
+	readMu       sync.Mutex      // Serializes the reads sharing cachedBlock
+	readCtx      context.Context // Context of the read in progress, see WAL.ReadContext, guarded by readMu
 	id           int
-	fd           *os.File
+	path         string
+	fd           File
 	closed       bool
+	sealed       bool      // Rotated away from, no more records are appended
+	sealedAt     time.Time // When it was sealed, see Options.MaxAge
 	currentBlock *block
 	cachedBlock  *block // 缓存最近读取的块
+	opts         segmentOptions
+	header       segmentHeader
+	dataStart    int   // Offset of the first chunk in block 0
+	blockSize    int   // Size of the blocks of the segment, see Options.BlockSize
+	rawSize      int64 // Size of a single record segment holding its record, 0 otherwise
+
+	index     []Position // Start positions of the records scanned so far
+	indexNext Position   // Position the next scan for the index starts at
+
+	lastUsed time.Time // When the file was accessed last, see release
+	mapped   []byte    // Mapping of the file of the sealed segment, see Options.MmapSealedSegments
+}
+
+// segmentOptions holds the settings a Segment is opened with
+type segmentOptions struct {
+	fs                 FS   // File system holding the segment file
+	readOnly           bool // Open the file read-only and reject writes
+	checksumSampleRate int  // Verify the CRC of one in every n chunks
+	maxChunks          int  // Abort reading a record after this many chunks, 0 for no limit
+	epoch              uint64
+	fence              uint64       // Fencing token stamped into new segments
+	layout             ChunkLayout  // Chunk layout of new segments
+	checksum           ChecksumType // Chunk checksum of new segments
+	hashChain          bool         // Prefix the records of new segments with their chain hash
+	compression        Compression  // Compression of the records written
+	noSplit            bool         // Store every record as a single chunk
+	blockSize          int          // Block size of new segments, blockSize if 0
+	singleRecord       bool         // Store a single unframed record in new segments
+	mmap               bool         // Read the blocks of the sealed segment from a mapping of its file
+	syncMethod         SyncMethod   // How the file is synced
+	preallocate        int64        // Bytes of disk space reserved for a new file, 0 for none
+	stats              *ioStats
+	readLimiter        *rateLimiter        // Charged for the blocks read from the file
+	pool               *sp.SlicePool[byte] // Pool of the chunk headers, bp if nil
+	blockCache         *blockCache         // Cache shared with the other segments, nil if disabled
 }
 
 // block represents a block structure
@@ -69,7 +374,28 @@ type block struct {
 
 // NewSegment creates a new Segment
 func NewSegment(id int, path string) (*Segment, error) {
-	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644) // os.O_TRUNC
+	return newSegment(id, path, segmentOptions{fs: osFS{}, stats: &ioStats{}})
+}
+
+// openFlag returns the flags the segment file is opened with
+func (o segmentOptions) openFlag() int {
+	switch {
+	case o.readOnly:
+		return os.O_RDONLY
+	case o.syncMethod == SyncDsync:
+		return os.O_RDWR | os.O_APPEND | oDSync
+	default:
+		return os.O_RDWR | os.O_APPEND
+	}
+}
+
+// newSegment opens the segment file at path with the given options
+func newSegment(id int, path string, opts segmentOptions) (*Segment, error) {
+	flag := opts.openFlag()
+	if !opts.readOnly {
+		flag |= os.O_CREATE
+	}
+	fd, err := opts.fs.OpenFile(path, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -80,10 +406,54 @@ func NewSegment(id int, path string) (*Segment, error) {
 		return nil, err
 	}
 
+	var header segmentHeader
+	var hasHeader bool
+	if offset >= segmentHeaderSize {
+		buf := make([]byte, segmentHeaderSize)
+		if _, err := fd.ReadAt(buf, 0); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+		header, hasHeader = decodeSegmentHeader(buf)
+	}
+	if hasHeader && header.version > segmentHeaderVersion {
+		_ = fd.Close()
+		return nil, fmt.Errorf("%w: %s uses unknown format version %d", ErrUnsupportedFormat, path, header.version)
+	}
+	if hasHeader && header.layout > LayoutLengthFirst {
+		_ = fd.Close()
+		return nil, fmt.Errorf("%w: %s uses unknown chunk layout %d", ErrUnsupportedFormat, path, header.layout)
+	}
+	if hasHeader && header.checksum > checksumNone {
+		_ = fd.Close()
+		return nil, fmt.Errorf("%w: %s uses unknown checksum type %d", ErrUnsupportedFormat, path, header.checksum)
+	}
+
+	size := blockSize
+	switch {
+	case offset == 0 && !opts.readOnly && opts.blockSize != 0:
+		size = opts.blockSize // A new segment
+	case hasHeader && header.blockSize != 0:
+		size = header.blockSize
+	}
+	if size < minBlockSize || size > maxBlockSize {
+		_ = fd.Close()
+		return nil, fmt.Errorf("%w: %s uses unsupported block size %d", ErrUnsupportedFormat, path, size)
+	}
+
+	if !opts.readOnly && offset > 0 && offset%int64(size) == 0 && header.flags&segmentFlagSingleRecord == 0 {
+		// Close padded the last block. Drop the padding so that new chunks
+		// continue the block instead of starting the next one.
+		if offset, err = trimPadding(fd, offset, size, hasHeader, header); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+
 	// Calculate the number of existing blocks
-	blockCount := int(offset / int64(blockSize))
-	blockOccupy := offset % blockSize
-	blockData := make([]byte, 0, blockSize)
+	blockCount := int(offset / int64(size))
+	blockOccupy := offset % int64(size)
+	blockData := make([]byte, 0, size)
 	if blockOccupy != 0 {
 		if _, err := fd.Seek(offset-blockOccupy, io.SeekStart); err != nil {
 			return nil, err
@@ -95,32 +465,141 @@ func NewSegment(id int, path string) (*Segment, error) {
 		}
 		blockData = append(blockData, occupy...)
 	}
+	flushed := len(blockData)
+	if offset == 0 && !opts.readOnly {
+		if opts.preallocate > 0 {
+			if err := preallocate(fd, opts.preallocate); err != nil {
+				_ = fd.Close()
+				return nil, err
+			}
+		}
+		// A new segment, the header is flushed along with the first chunks
+		header = segmentHeader{version: segmentHeaderVersion, layout: opts.layout, checksum: opts.checksum, epoch: opts.epoch, fence: opts.fence, blockSize: size}
+		if opts.hashChain {
+			header.flags |= segmentFlagHashChain
+		}
+		if opts.singleRecord {
+			header.flags |= segmentFlagSingleRecord
+		}
+		hasHeader = true
+		blockData = append(blockData, header.encode()...)
+	}
+	dataStart := 0
+	if hasHeader {
+		dataStart = segmentHeaderSize
+	}
 
 	seg := &Segment{
-		fd: fd,
-		id: id,
+		fd:        fd,
+		id:        id,
+		path:      path,
+		opts:      opts,
+		header:    header,
+		dataStart: dataStart,
+		blockSize: size,
 		currentBlock: &block{
 			id:      blockCount,
 			data:    blockData,
-			flushed: len(blockData),
+			flushed: flushed,
 		},
 		cachedBlock: &block{
 			id:   -1,
-			data: make([]byte, blockSize),
+			data: make([]byte, size),
 		},
+		lastUsed: time.Now(),
+	}
+	if seg.singleRecord() && offset > int64(dataStart) {
+		seg.rawSize = offset
 	}
 	return seg, nil
 }
 
+// trimPadding truncates the trailing padding of the last block of the
+// segment file of the given size, returning the new size. Padding is only
+// recognized after the last complete chunk of the block.
+func trimPadding(fd File, size int64, blockSize int, hasHeader bool, header segmentHeader) (int64, error) {
+	blockStart := size - int64(blockSize)
+	data := make([]byte, blockSize)
+	if _, err := fd.ReadAt(data, blockStart); err != nil {
+		return 0, err
+	}
+	offset := 0
+	if blockStart == 0 && hasHeader {
+		offset = segmentHeaderSize
+	}
+	format := chunkFormat{layout: header.layout, checksum: header.checksum}
+	for offset < len(data) && !isZero(data[offset:]) {
+		if offset+format.headerSize() > len(data) {
+			return size, nil // Not a chunk, leave the block alone
+		}
+		_, length, _ := format.parseHeader(data[offset:])
+		offset += format.headerSize() + length
+	}
+	if offset >= len(data) {
+		return size, nil
+	}
+	if err := fd.Truncate(blockStart + int64(offset)); err != nil {
+		return 0, err
+	}
+	return blockStart + int64(offset), nil
+}
+
 // Size returns the total disk space occupied by the current Segment
+// including data still buffered in the current block
 func (s *Segment) Size() int64 {
-	if s.currentBlock.flushed == 0 {
-		return int64(s.currentBlock.id * blockSize)
+	if s.rawSize > 0 {
+		return s.rawSize
+	}
+	return int64(s.currentBlock.id*s.blockSize + len(s.currentBlock.data))
+}
+
+// flushedSize returns the number of bytes written to the segment file,
+// leaving out data still buffered in the current block
+func (s *Segment) flushedSize() int64 {
+	if s.rawSize > 0 {
+		return s.rawSize
 	}
-	if s.currentBlock.id <= 0 {
-		return int64(s.currentBlock.flushed)
+	return int64(s.currentBlock.id*s.blockSize + s.currentBlock.flushed)
+}
+
+// empty reports whether no record was written to the segment
+func (s *Segment) empty() bool {
+	return s.Size() <= int64(s.dataStart)
+}
+
+// skipHeader moves a position pointing into the segment header to the first
+// chunk of the segment
+func (s *Segment) skipHeader(pos *Position) {
+	if pos.BlockId == 0 && pos.Offset < s.dataStart {
+		pos.Offset = s.dataStart
 	}
-	return int64((s.currentBlock.id-1)*blockSize + s.currentBlock.flushed)
+}
+
+// legacy reports whether the segment uses an older format than new segments,
+// e.g. has no segment header. Such segments are read as is but not appended
+// to.
+func (s *Segment) legacy() bool {
+	return s.header.version < segmentHeaderVersion
+}
+
+// chunkFormat returns the format of the chunk headers of the segment
+func (s *Segment) chunkFormat() chunkFormat {
+	return chunkFormat{layout: s.header.layout, checksum: s.header.checksum}
+}
+
+// chunkHeaderSize returns the size of the chunk headers of the segment
+func (s *Segment) chunkHeaderSize() int {
+	return s.header.checksum.chunkHeaderSize()
+}
+
+// chained reports whether the records of the segment carry a chain hash
+func (s *Segment) chained() bool {
+	return s.header.flags&segmentFlagHashChain != 0
+}
+
+// Epoch returns the epoch the segment was created in, 0 for legacy segments
+func (s *Segment) Epoch() uint64 {
+	return s.header.epoch
 }
 
 // Id returns the ID of the Segment
@@ -128,41 +607,89 @@ func (s *Segment) Id() int {
 	return s.id
 }
 
+// BlockSize returns the size of the blocks of the segment
+func (s *Segment) BlockSize() int {
+	return s.blockSize
+}
+
 // Write writes data and returns the Position
 func (s *Segment) Write(data []byte) (*Position, error) {
+	return s.write(data, 0)
+}
+
+// write writes data with flags set on the type of every chunk
+func (s *Segment) write(data []byte, flags ChunkType) (*Position, error) {
 	if s.closed {
 		return nil, ErrClosed
 	}
+	if s.opts.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.sealed {
+		return nil, ErrSegmentSealed
+	}
+	if s.singleRecord() {
+		return s.writeSingle(data, flags)
+	}
+	if compressed, codec := s.compress(data); compressed != nil {
+		defer s.pool().Free(compressed)
+		data = compressed
+		flags |= codec
+	}
+	if s.opts.noSplit && len(data) > s.blockSize-s.chunkHeaderSize() {
+		return nil, fmt.Errorf("%w: %d bytes with NoSplit, at most %d allowed", ErrRecordTooLarge, len(data), s.blockSize-s.chunkHeaderSize())
+	}
 
 	chunks := s.splitIntoChunks(data)
-	var pos *Position
+	var pos, prev *Position
 	for i, chk := range chunks {
-		if len(s.currentBlock.data)+chunkHeaderSize+len(chk.data) > blockSize {
+		if i > 0 {
+			checkChunkSequence(false, chunks[i-1].chunkType, chk.chunkType)
+		} else {
+			checkChunkSequence(true, 0, chk.chunkType)
+		}
+		if len(s.currentBlock.data)+s.chunkHeaderSize()+len(chk.data) > s.blockSize {
 			if err := s.flushBlock(true); err != nil {
 				return nil, err
 			}
 		}
-		position, err := s.writeChunk(chk.data, chk.chunkType)
+		position, err := s.writeChunk(chk.data, chk.chunkType|flags)
 		if err != nil {
 			return nil, err
 		}
+		s.checkBlock("write")
 		if i == 0 {
 			pos = position
+		} else {
+			s.checkAdvance("write", *prev, *position)
 		}
+		prev = position
 	}
 	return pos, nil
 }
 
+// pool returns the buffer pool of the segment, see Options.PoolMax
+func (s *Segment) pool() *sp.SlicePool[byte] {
+	if s.opts.pool == nil {
+		return bp
+	}
+	return s.opts.pool
+}
+
 // writeChunk writes a chunk and returns the Position
 func (s *Segment) writeChunk(data []byte, chunkType ChunkType) (*Position, error) {
-	header := bp.Alloc(chunkHeaderSize)[0:chunkHeaderSize]
-	binary.LittleEndian.PutUint32(header[:4], crc32.ChecksumIEEE(data))
-	binary.LittleEndian.PutUint16(header[4:6], uint16(len(data)))
-	header[6] = byte(chunkType)
+	if len(data) > math.MaxUint16 {
+		// Blocks are small enough for chunks to fit, see maxBlockSize
+		return nil, fmt.Errorf("chunk of %d bytes exceeds the %d bytes its length field holds", len(data), math.MaxUint16)
+	}
+	pool := s.pool()
+	headerSize := s.chunkHeaderSize()
+	header := pool.Alloc(headerSize)[0:headerSize]
+	s.chunkFormat().putHeader(header, s.header.checksum.sum(data), len(data), chunkType)
 	offset := len(s.currentBlock.data)
 	s.currentBlock.data = append(s.currentBlock.data, header...)
 	s.currentBlock.data = append(s.currentBlock.data, data...)
-	bp.Free(header)
+	pool.Free(header)
 	return &Position{
 		SegmentId: s.id,
 		BlockId:   s.currentBlock.id,
@@ -172,27 +699,49 @@ func (s *Segment) writeChunk(data []byte, chunkType ChunkType) (*Position, error
 
 // flushBlock flushes the block to disk
 func (s *Segment) flushBlock(padding bool) error {
+	if s.rawSize > 0 {
+		return nil // The record was written directly
+	}
+	if s.singleRecord() {
+		padding = false // There is no block grid to align to
+	}
 	data := s.currentBlock.data[s.currentBlock.flushed:]
 	if len(data) == 0 && !padding {
 		return nil
 	}
-	if padding && len(s.currentBlock.data) < blockSize {
-		paddingSize := blockSize - len(s.currentBlock.data)
+	if padding && len(s.currentBlock.data) < s.blockSize {
+		paddingSize := s.blockSize - len(s.currentBlock.data)
+		s.opts.stats.paddingBytes.Add(int64(paddingSize))
 		s.currentBlock.data = append(s.currentBlock.data, paddingBlock[0:paddingSize]...)
 		data = s.currentBlock.data[s.currentBlock.flushed:]
 	}
 
-	n, err := s.fd.Write(data)
+	fd, err := s.file()
+	if err != nil {
+		return err
+	}
+	n, err := fd.Write(data)
+	s.opts.stats.physicalBytes.Add(int64(n))
 	if err != nil {
 		return err
 	}
 
 	s.currentBlock.flushed += n
-	if s.currentBlock.flushed == blockSize {
+	if s.cachedBlock.id == s.currentBlock.id {
+		s.cachedBlock.id = -1 // The cached copy of this block is stale now
+	}
+	if s.currentBlock.flushed == s.blockSize {
 		s.currentBlock.id++
 		s.currentBlock.flushed = 0
-		s.currentBlock.data = s.currentBlock.data[:0]
+		if cap(s.currentBlock.data) > s.blockSize {
+			// Don't keep a buffer that grew beyond a block for the rest of
+			// the segment's life
+			s.currentBlock.data = make([]byte, 0, s.blockSize)
+		} else {
+			s.currentBlock.data = s.currentBlock.data[:0]
+		}
 	}
+	s.checkBlock("flush")
 	return nil
 }
 
@@ -204,11 +753,15 @@ type chunk struct {
 
 // splitIntoChunks splits the data into chunks
 func (s *Segment) splitIntoChunks(data []byte) []chunk {
+	if s.opts.noSplit {
+		// write starts a new block if the record does not fit
+		return []chunk{{data: data, chunkType: kFullType}}
+	}
 	var chunks []chunk
 	remaining := len(data)
 	offset := 0
 
-	remainingSpace := blockSize - len(s.currentBlock.data) - chunkHeaderSize
+	remainingSpace := s.blockSize - len(s.currentBlock.data) - s.chunkHeaderSize()
 	if remainingSpace > 0 {
 		chunkSize := remainingSpace
 		if chunkSize > remaining {
@@ -227,7 +780,7 @@ func (s *Segment) splitIntoChunks(data []byte) []chunk {
 	}
 
 	for remaining > 0 {
-		chunkSize := blockSize - chunkHeaderSize
+		chunkSize := s.blockSize - s.chunkHeaderSize()
 		if chunkSize > remaining {
 			chunkSize = remaining
 		}
@@ -253,42 +806,164 @@ func (s *Segment) splitIntoChunks(data []byte) []chunk {
 
 // Read reads the WAL record
 func (s *Segment) Read(pos *Position) ([]byte, error) {
-	var entry []byte
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	entry, _, err := s.read(pos)
+	if err == errCheckpoint {
+		err = nil // The state of the checkpoint
+	}
+	return entry, err
+}
+
+// readContext reads the record at pos like Read, giving up reading the
+// file when ctx is done, see WAL.ReadContext
+func (s *Segment) readContext(ctx context.Context, pos *Position) ([]byte, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	s.readCtx = ctx
+	defer func() { s.readCtx = nil }()
+	entry, _, err := s.read(pos)
+	if err == errCheckpoint {
+		err = nil // The state of the checkpoint
+	}
+	return entry, err
+}
+
+// ReadWithNext reads the WAL record at pos like Read and returns the
+// position right after its last chunk, from where the next record is read.
+// A record spanning several blocks advances the position by all of them.
+func (s *Segment) ReadWithNext(pos *Position) ([]byte, *Position, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	entry, next, err := s.read(pos)
+	if err == errCheckpoint {
+		err = nil // The state of the checkpoint
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, &next, nil
+}
+
+// read reads the WAL record at pos and returns it along with the position
+// right after its last chunk. For a tombstoned record it returns
+// ErrTombstoned along with that position, and for a checkpoint record
+// errCheckpoint along with the state and that position. The chain hash of
+// records in hash chained segments and the key of keyed records are
+// stripped.
+func (s *Segment) read(pos *Position) ([]byte, Position, error) {
+	return s.readInto(nil, pos)
+}
+
+// readInto is read reassembling the record in the capacity of dst
+func (s *Segment) readInto(dst []byte, pos *Position) ([]byte, Position, error) {
+	entry, next, keyed, err := s.readStored(dst, pos)
+	if err == ErrTombstoned {
+		return nil, next, err
+	}
+	if err == nil && s.chained() {
+		if len(entry) < chainHashSize {
+			return nil, Position{}, fmt.Errorf("record at %+v is shorter than its chain hash", *pos)
+		}
+		entry = entry[chainHashSize:]
+	}
+	if err == nil && keyed {
+		_, data, ok := splitKeyed(entry)
+		if !ok {
+			return nil, Position{}, fmt.Errorf("record at %+v has an invalid key", *pos)
+		}
+		entry = data
+	}
+	return entry, next, err
+}
+
+// readStored is readInto without stripping the chain hash or the key. It
+// also reports whether the record is a keyed record. The payload of a
+// tombstoned keyed record, which holds its key only, is returned along with
+// ErrTombstoned.
+func (s *Segment) readStored(dst []byte, pos *Position) ([]byte, Position, bool, error) {
+	if s.singleRecord() {
+		return s.readSingle(dst, pos)
+	}
+	entry := dst[:0]
+	tombstoned, checkpoint, keyed := false, false, false
+	var codec ChunkType // Compression flags of the record
 	currPos := &Position{
 		SegmentId: pos.SegmentId,
 		BlockId:   pos.BlockId,
 		Offset:    pos.Offset,
 	}
+	s.skipHeader(currPos)
 
-	for {
+	for chunks := 1; ; chunks++ {
+		if s.opts.maxChunks > 0 && chunks > s.opts.maxChunks {
+			return nil, Position{}, false, ErrRecordTooLong
+		}
 		blockData, err := s.readBlock(currPos.BlockId)
+		if err == io.EOF && len(entry) > 0 {
+			return nil, Position{}, false, io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return nil, err
+			return nil, Position{}, false, err
 		}
 		if currPos.Offset >= len(blockData) {
-			return nil, ErrEndOfBlock
+			return nil, Position{}, false, ErrEndOfBlock
 		}
-		chk, err := s.readChunk(blockData[currPos.Offset:])
+		verify := s.sampleChecksum(currPos.BlockId, currPos.Offset)
+		chk, err := s.readChunk(blockData[currPos.Offset:], verify)
 		if err != nil {
-			return nil, err
+			return nil, Position{}, false, err
 		}
-		// if chunk is empty, return eof.
-		if len(chk.data) == 0 {
-			return nil, io.EOF
+		// if chunk is empty, return eof, or unexpected eof if the record
+		// is incomplete. A checkpoint with an empty state is a record.
+		if len(chk.data) == 0 && chk.chunkType&kCheckpointFlag == 0 {
+			if len(entry) > 0 {
+				return nil, Position{}, false, io.ErrUnexpectedEOF
+			}
+			return nil, Position{}, false, io.EOF
+		}
+		if chk.chunkType&kTombstoneFlag != 0 {
+			tombstoned = true
+			chk.chunkType &^= kTombstoneFlag
 		}
+		if chk.chunkType&kCheckpointFlag != 0 {
+			checkpoint = true
+			chk.chunkType &^= kCheckpointFlag
+		}
+		if chk.chunkType&kKeyedFlag != 0 {
+			keyed = true
+			chk.chunkType &^= kKeyedFlag
+		}
+		codec = chk.chunkType & (kCompressedFlag | kZstdFlag)
+		chk.chunkType &^= kBatchFlag | kCompressedFlag | kZstdFlag
 		if len(entry) == 0 {
 			if chk.chunkType != kFullType && chk.chunkType != kFirstType {
-				return nil, fmt.Errorf("invalid first chk type: %v", chk.chunkType)
+				return nil, Position{}, false, fmt.Errorf("invalid first chk type: %v", chk.chunkType)
 			}
 		} else if chk.chunkType != kMiddleType && chk.chunkType != kLastType {
-			return nil, fmt.Errorf("invalid chk type: %v", chk.chunkType)
+			return nil, Position{}, false, fmt.Errorf("invalid chk type: %v", chk.chunkType)
 		}
 
 		entry = append(entry, chk.data...)
+		currPos.Offset += s.chunkHeaderSize() + len(chk.data)
 		if chk.chunkType == kLastType || chk.chunkType == kFullType {
-			return entry, nil
+			s.checkAdvance("read", *pos, *currPos)
+			if tombstoned {
+				if keyed {
+					return entry, *currPos, keyed, ErrTombstoned
+				}
+				return nil, *currPos, keyed, ErrTombstoned
+			}
+			if codec != 0 {
+				if entry, err = decompress(entry, codec); err != nil {
+					return nil, Position{}, false, fmt.Errorf("record at %+v: %w", *pos, err)
+				}
+			}
+			if checkpoint {
+				return entry, *currPos, keyed, errCheckpoint
+			}
+			return entry, *currPos, keyed, nil
 		}
-		currPos.Offset += chunkHeaderSize + len(chk.data)
 		if currPos.Offset >= len(blockData) {
 			currPos.BlockId++
 			currPos.Offset = 0
@@ -296,6 +971,479 @@ func (s *Segment) Read(pos *Position) ([]byte, error) {
 	}
 }
 
+// readNext reads the first record at or after pos, skipping block padding,
+// tombstoned and checkpoint records, and returns it with its position and
+// the position following it. It returns io.EOF once the end of the flushed
+// data is reached, or io.ErrUnexpectedEOF if the last record is not
+// completely flushed yet.
+func (s *Segment) readNext(pos Position) ([]byte, Position, Position, error) {
+	return s.scanNext(pos, true)
+}
+
+// scanNext is readNext, skipping tombstoned and checkpoint records only if
+// skip is set. Otherwise they are returned along with ErrTombstoned or
+// errCheckpoint.
+func (s *Segment) scanNext(pos Position, skip bool) ([]byte, Position, Position, error) {
+	pos.SegmentId = s.id
+	s.skipHeader(&pos)
+	end := s.flushedSize()
+	for {
+		offset := int64(pos.BlockId)*int64(s.blockSize) + int64(pos.Offset)
+		if offset >= end {
+			return nil, pos, pos, io.EOF
+		}
+		if pos.Offset+s.chunkHeaderSize() > s.blockSize {
+			pos.BlockId++
+			pos.Offset = 0
+			continue
+		}
+		data, next, err := s.read(&pos)
+		if skip && (err == ErrTombstoned || err == errCheckpoint) {
+			pos = next
+			continue
+		}
+		if err == io.EOF && offset+int64(s.chunkHeaderSize()) <= end {
+			padding, err := s.isPadding(pos)
+			if err != nil {
+				return nil, pos, pos, err
+			}
+			if !padding {
+				next = pos
+				next.Offset += s.chunkHeaderSize()
+				return []byte{}, pos, next, nil
+			}
+		}
+		if err == io.EOF || err == ErrEndOfBlock {
+			if int64(pos.BlockId+1)*int64(s.blockSize) <= end {
+				// The rest of the block is padding
+				pos.BlockId++
+				pos.Offset = 0
+				continue
+			}
+			return nil, pos, pos, io.EOF
+		}
+		if err != nil && err != ErrTombstoned && err != errCheckpoint {
+			return nil, pos, pos, err
+		}
+		return data, pos, next, err
+	}
+}
+
+// isPadding reports whether the zero chunk header at pos starts the padding
+// of its block rather than an empty record. Padding runs to the end of a
+// block, so nothing but zeros follows it, and only blocks that were flushed
+// completely are padded.
+func (s *Segment) isPadding(pos Position) (bool, error) {
+	if int64(pos.BlockId+1)*int64(s.blockSize) > s.flushedSize() {
+		return false, nil
+	}
+	blockData, err := s.readBlock(pos.BlockId)
+	if err != nil {
+		return false, err
+	}
+	return isZero(blockData[pos.Offset+s.chunkHeaderSize():]), nil
+}
+
+// isZero reports whether data contains only zero bytes
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// recordIndex returns the positions of the records in the flushed part of
+// the segment. The index is built by a forward scan and extended on later
+// calls as the segment grows.
+func (s *Segment) recordIndex() ([]Position, error) {
+	for {
+		_, at, next, err := s.readNext(s.indexNext)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return s.index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.index = append(s.index, at)
+		s.indexNext = next
+	}
+}
+
+// resetIndex drops the record index, the next use rescans the segment
+func (s *Segment) resetIndex() {
+	s.index, s.indexNext = nil, Position{}
+}
+
+// RebuildIndex discards the record index of the segment and rebuilds it
+// with a full scan of the flushed part of the segment.
+func (s *Segment) RebuildIndex() error {
+	if s.closed {
+		return ErrClosed
+	}
+	s.resetIndex()
+	_, err := s.recordIndex()
+	return err
+}
+
+// chunkRef locates a chunk of a record in the segment file
+type chunkRef struct {
+	offset    int64 // File offset of the chunk header
+	length    int
+	chunkType ChunkType
+}
+
+// recordChunks locates the chunks of the record at pos
+func (s *Segment) recordChunks(pos *Position) ([]chunkRef, error) {
+	var refs []chunkRef
+	blockID, offset := pos.BlockId, pos.Offset
+	for {
+		blockData, err := s.readBlock(blockID)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= len(blockData) {
+			return nil, ErrEndOfBlock
+		}
+		chk, err := s.readChunk(blockData[offset:], true)
+		if err != nil {
+			return nil, err
+		}
+		if len(chk.data) == 0 {
+			return nil, io.EOF
+		}
+		if chk.chunkType&kTombstoneFlag != 0 {
+			return nil, ErrTombstoned
+		}
+		base := chk.chunkType &^ (kCheckpointFlag | kKeyedFlag | kBatchFlag | kCompressedFlag | kZstdFlag)
+		if len(refs) == 0 {
+			if base != kFullType && base != kFirstType {
+				return nil, fmt.Errorf("invalid first chk type: %v", chk.chunkType)
+			}
+		} else if base != kMiddleType && base != kLastType {
+			return nil, fmt.Errorf("invalid chk type: %v", chk.chunkType)
+		}
+		refs = append(refs, chunkRef{
+			offset:    int64(blockID)*int64(s.blockSize) + int64(offset),
+			length:    len(chk.data),
+			chunkType: chk.chunkType,
+		})
+		if base == kLastType || base == kFullType {
+			return refs, nil
+		}
+		offset += s.chunkHeaderSize() + len(chk.data)
+		if offset >= len(blockData) {
+			blockID++
+			offset = 0
+		}
+	}
+}
+
+// rewriteChunks replaces the payload of the given chunks with data in place,
+// rewriting their CRCs, and syncs the file. If tombstone is set, the chunks
+// are also marked as erased.
+func (s *Segment) rewriteChunks(refs []chunkRef, data []byte, tombstone bool) error {
+	// The segment fd is opened with O_APPEND, which rules out WriteAt.
+	flag := os.O_WRONLY
+	if s.opts.syncMethod == SyncDsync {
+		flag |= oDSync
+	}
+	fd, err := s.opts.fs.OpenFile(s.path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	header := make([]byte, s.chunkHeaderSize())
+	for _, ref := range refs {
+		part := data[:ref.length]
+		data = data[ref.length:]
+		chunkType := ref.chunkType
+		if tombstone {
+			chunkType |= kTombstoneFlag
+		}
+		s.chunkFormat().putHeader(header, s.header.checksum.sum(part), ref.length, chunkType)
+		if _, err := fd.WriteAt(header, ref.offset); err != nil {
+			return err
+		}
+		if _, err := fd.WriteAt(part, ref.offset+int64(s.chunkHeaderSize())); err != nil {
+			return err
+		}
+	}
+	s.cachedBlock.id = -1
+	s.opts.blockCache.drop(s)
+	if tombstone {
+		s.resetIndex() // Rebuild the index without erased records
+	}
+	return syncFile(fd, s.opts.syncMethod)
+}
+
+// Overwrite replaces the payload of the record at pos in place, rewriting the
+// CRC of every chunk it touches, and syncs the file. The length of data must
+// match the stored record exactly, so the block layout is left unchanged.
+// The key of a keyed record is kept, data replaces what follows it.
+func (s *Segment) Overwrite(pos *Position, data []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.opts.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.flushBlock(false); err != nil {
+		return err
+	}
+
+	// Locate the chunks of the record before touching anything.
+	refs, err := s.recordChunks(pos)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, ref := range refs {
+		if ref.chunkType&kCompressedFlag != 0 {
+			return fmt.Errorf("record at %+v is compressed and cannot be overwritten", *pos)
+		}
+		total += ref.length
+	}
+	if refs[0].chunkType&kKeyedFlag != 0 {
+		stored, _, _, err := s.readStored(nil, pos)
+		if err != nil {
+			return err
+		}
+		_, value, ok := splitKeyed(stored)
+		if !ok {
+			return fmt.Errorf("record at %+v has an invalid key", *pos)
+		}
+		if len(value) != len(data) {
+			return fmt.Errorf("%w: got %d bytes, record has %d", ErrLengthMismatch, len(data), len(value))
+		}
+		framing := stored[:len(stored)-len(value)]
+		return s.rewriteChunks(refs, append(framing, data...), false)
+	}
+	if total != len(data) {
+		return fmt.Errorf("%w: got %d bytes, record has %d", ErrLengthMismatch, len(data), total)
+	}
+	return s.rewriteChunks(refs, data, false)
+}
+
+// Tombstone erases the record at pos in place: its payload is zeroed and its
+// chunks are marked, so reading it returns ErrTombstoned while the block
+// layout is left unchanged. Only the key of a keyed record is kept. The file
+// is synced before returning. Empty records cannot be tombstoned.
+func (s *Segment) Tombstone(pos *Position) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.opts.readOnly {
+		return ErrReadOnly
+	}
+	if err := s.flushBlock(false); err != nil {
+		return err
+	}
+
+	refs, err := s.recordChunks(pos)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, ref := range refs {
+		total += ref.length
+	}
+	erased := make([]byte, total)
+	if refs[0].chunkType&kKeyedFlag != 0 {
+		// Keep the key, so that the key index is rebuilt with the record
+		// erased rather than with an older record of the key
+		stored, _, _, err := s.readStored(nil, pos)
+		if err != nil {
+			return err
+		}
+		_, value, ok := splitKeyed(stored)
+		if !ok {
+			return fmt.Errorf("record at %+v has an invalid key", *pos)
+		}
+		copy(erased, stored[:len(stored)-len(value)])
+	}
+	return s.rewriteChunks(refs, erased, true)
+}
+
+// RecordsInBlock returns the positions and data of every record that starts
+// in the given block. A record continuing from the previous block is left
+// out, while one continuing into the next block is returned in full.
+// Tombstoned records are left out and a checkpoint record is returned with
+// its state. If a chunk cannot be read, the records found before it are
+// returned along with the error.
+func (s *Segment) RecordsInBlock(blockID int) ([]*Position, [][]byte, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+	if !s.opts.readOnly {
+		if err := s.flushBlock(false); err != nil {
+			return nil, nil, err
+		}
+	}
+	if blockID < 0 || int64(blockID)*int64(s.blockSize) >= s.Size() {
+		return nil, nil, fmt.Errorf("block %d out of range", blockID)
+	}
+	blockData, err := s.readBlock(blockID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Collect the record starts first, reading the records replaces the
+	// cached block.
+	var positions []*Position
+	start := 0
+	if blockID == 0 {
+		start = s.dataStart
+	}
+	var scanErr error
+	for offset := start; offset+s.chunkHeaderSize() <= len(blockData); {
+		chk, err := s.readChunk(blockData[offset:], true)
+		if err != nil {
+			scanErr = fmt.Errorf("chunk at %+v: %w", Position{SegmentId: s.id, BlockId: blockID, Offset: offset}, err)
+			break
+		}
+		if len(chk.data) == 0 && chk.chunkType&kCheckpointFlag == 0 {
+			break // Padding
+		}
+		if chk.chunkType&kTombstoneFlag == 0 {
+			if base := chk.chunkType &^ (kCheckpointFlag | kKeyedFlag | kBatchFlag | kCompressedFlag | kZstdFlag); base == kFullType || base == kFirstType {
+				positions = append(positions, &Position{SegmentId: s.id, BlockId: blockID, Offset: offset})
+			}
+		}
+		offset += s.chunkHeaderSize() + len(chk.data)
+	}
+
+	records := make([][]byte, 0, len(positions))
+	for i, pos := range positions {
+		data, _, err := s.read(pos)
+		if err == errCheckpoint {
+			err = nil // The state of the checkpoint
+		}
+		if err != nil {
+			return positions[:i], records, err
+		}
+		records = append(records, data)
+	}
+	return positions, records, scanErr
+}
+
+// ReadRawBlock returns a copy of the bytes of the given block as stored in
+// the segment file, without parsing its chunks. The block is blockSize bytes
+// long except for the last one, which ends at the end of the segment.
+// Buffered data is flushed first.
+func (s *Segment) ReadRawBlock(blockID int) ([]byte, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if !s.opts.readOnly {
+		if err := s.flushBlock(false); err != nil {
+			return nil, err
+		}
+	}
+	blockData, err := s.readRawBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(blockData), nil
+}
+
+// readRawBlock returns the given block cut at the end of the segment. The
+// returned slice is the cached block.
+func (s *Segment) readRawBlock(blockID int) ([]byte, error) {
+	size := s.Size()
+	if blockID < 0 || int64(blockID)*int64(s.blockSize) >= size {
+		return nil, fmt.Errorf("block %d out of range", blockID)
+	}
+	blockData, err := s.readBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+	if rest := size - int64(blockID)*int64(s.blockSize); rest < int64(s.blockSize) {
+		blockData = blockData[:rest]
+	}
+	return blockData, nil
+}
+
+// Dump writes a human-readable layout of the segment to w: every block with
+// the offset, type, length and CRC state of each chunk in it. Padding and
+// chunks that cannot be parsed are marked as such. Buffered data is flushed
+// first so that it shows up in the dump.
+func (s *Segment) Dump(w io.Writer) error {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if !s.opts.readOnly {
+		if err := s.flushBlock(false); err != nil {
+			return err
+		}
+	}
+	size := s.Size()
+	if _, err := fmt.Fprintf(w, "segment %d size=%d\n", s.id, size); err != nil {
+		return err
+	}
+	for blockID := 0; int64(blockID)*int64(s.blockSize) < size; blockID++ {
+		blockData, err := s.readRawBlock(blockID)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "block %d offset=%d length=%d\n", blockID, int64(blockID)*int64(s.blockSize), len(blockData)); err != nil {
+			return err
+		}
+		start := 0
+		if blockID == 0 && s.dataStart > 0 {
+			start = s.dataStart
+			if _, err := fmt.Fprintf(w, "  header version=%d layout=%d epoch=%d length=%d\n", s.header.version, s.header.layout, s.header.epoch, s.dataStart); err != nil {
+				return err
+			}
+		}
+		if err := dumpBlock(w, blockData, start, s.chunkFormat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpBlock writes the chunks of a single block to w, starting at offset
+func dumpBlock(w io.Writer, blockData []byte, offset int, format chunkFormat) error {
+	chunkHeaderSize := format.headerSize()
+	for offset < len(blockData) {
+		data := blockData[offset:]
+		if len(data) < chunkHeaderSize {
+			_, err := fmt.Fprintf(w, "  padding offset=%d length=%d\n", offset, len(data))
+			return err
+		}
+		expectedCRC, length, chunkType := format.parseHeader(data)
+		if expectedCRC == 0 && length == 0 && chunkType == kFullType && isZero(data) {
+			_, err := fmt.Fprintf(w, "  padding offset=%d length=%d\n", offset, len(data))
+			return err
+		}
+		if chunkHeaderSize+length > len(data) {
+			_, err := fmt.Fprintf(w, "  corrupt offset=%d type=%v length=%d: chunk exceeds block\n", offset, chunkType, length)
+			return err
+		}
+		crcState := "ok"
+		switch {
+		case format.checksum == checksumNone:
+			crcState = "none"
+		case format.checksum.sum(data[chunkHeaderSize:chunkHeaderSize+length]) != expectedCRC:
+			crcState = "INVALID"
+		}
+		if _, err := fmt.Fprintf(w, "  chunk offset=%d type=%v length=%d crc=%s\n", offset, chunkType, length, crcState); err != nil {
+			return err
+		}
+		offset += chunkHeaderSize + length
+	}
+	return nil
+}
+
 // readBlock reads the specified block
 func (s *Segment) readBlock(blockID int) ([]byte, error) {
 	if s.closed {
@@ -303,55 +1451,223 @@ func (s *Segment) readBlock(blockID int) ([]byte, error) {
 	}
 
 	if s.cachedBlock != nil && s.cachedBlock.id == blockID {
+		s.opts.stats.cacheHits.Add(1)
 		return s.cachedBlock.data, nil
 	}
+	cache := s.sharedCache(blockID)
+	if data, ok := cache.get(s, blockID); ok {
+		s.opts.stats.cacheHits.Add(1)
+		return data, nil
+	}
+	s.opts.stats.cacheMisses.Add(1)
 
-	blockOffset := int64(blockID) * blockSize
-	if _, err := s.fd.Seek(blockOffset, io.SeekStart); err != nil {
+	blockOffset := int64(blockID) * int64(s.blockSize)
+	if s.opts.mmap && s.sealed {
+		if s.mapped == nil {
+			if err := s.mapFile(); err != nil {
+				return nil, err
+			}
+		}
+		// The last block of the segment may be partial, it is read below
+		if end := blockOffset + int64(s.blockSize); end <= int64(len(s.mapped)) {
+			s.opts.readLimiter.take(s.blockSize)
+			return s.mapped[blockOffset:end:end], nil
+		}
+	}
+	fd, err := s.file()
+	if err != nil {
 		return nil, err
 	}
 
+	if cache != nil {
+		// The block is kept in the shared cache instead of the cached block
+		data := make([]byte, s.blockSize)
+		n, err := s.readFull(fd, data, blockOffset)
+		s.opts.readLimiter.take(n)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		cache.put(s, blockID, data)
+		return data, nil
+	}
+	if cap(s.cachedBlock.data) < s.blockSize {
+		s.cachedBlock.data = make([]byte, s.blockSize) // Dropped by release
+	}
 	s.cachedBlock.id = blockID
-	s.cachedBlock.data = s.cachedBlock.data[0:blockSize]
-	_, err := io.ReadFull(s.fd, s.cachedBlock.data)
+	s.cachedBlock.data = s.cachedBlock.data[0:s.blockSize]
+	n, err := s.readFull(fd, s.cachedBlock.data, blockOffset)
+	s.opts.readLimiter.take(n)
 	if err != nil && err != io.ErrUnexpectedEOF {
+		s.cachedBlock.id = -1
 		return nil, err
 	}
+	// Do not leave bytes of a previously cached block behind a partial block
+	clear(s.cachedBlock.data[n:])
 	return s.cachedBlock.data, nil
 }
 
+// readFull reads the block at offset off of fd into buf like io.ReadFull
+func (s *Segment) readFull(fd File, buf []byte, off int64) (int, error) {
+	if s.readCtx == nil {
+		if _, err := fd.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.ReadFull(fd, buf)
+	}
+	n, err := s.readAt(fd, buf, off)
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readAt reads from fd at offset off into buf like File.ReadAt. During a
+// read with a context, see WAL.ReadContext, the file is read in the
+// background: once the context is done the read is abandoned with its
+// error and buf is left untouched, the read syscall may still complete.
+func (s *Segment) readAt(fd File, buf []byte, off int64) (int, error) {
+	ctx := s.readCtx
+	if ctx == nil {
+		return fd.ReadAt(buf, off)
+	}
+	type result struct {
+		data []byte
+		n    int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data := make([]byte, len(buf))
+		n, err := fd.ReadAt(data, off)
+		done <- result{data, n, err}
+	}()
+	select {
+	case r := <-done:
+		copy(buf, r.data[:r.n])
+		return r.n, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// sharedCache returns the block cache of the WAL if the block with the given
+// id can be kept there, as it no longer changes, and nil otherwise
+func (s *Segment) sharedCache(blockID int) *blockCache {
+	switch {
+	case s.opts.mmap && s.sealed:
+		return nil // Read from the mapping
+	case s.sealed || blockID < s.currentBlock.id:
+		return s.opts.blockCache
+	default:
+		return nil
+	}
+}
+
 // Sync synchronizes the data to disk
 func (s *Segment) Sync() error {
 	if s.closed {
 		return ErrClosed
 	}
+	if s.opts.readOnly {
+		return ErrReadOnly
+	}
 	if err := s.flushBlock(false); err != nil {
 		return err
 	}
-	if err := s.fd.Sync(); err != nil {
+	fd, err := s.file()
+	if err != nil {
+		return err
+	}
+	if err := syncFile(fd, s.opts.syncMethod); err != nil {
+		return err
+	}
+	s.opts.stats.syncs.Add(1)
+	return nil
+}
+
+// file returns the file of the segment, reopening it if it was released
+func (s *Segment) file() (File, error) {
+	if s.fd == nil {
+		fd, err := s.opts.fs.OpenFile(s.path, s.opts.openFlag(), 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.fd = fd
+	}
+	s.lastUsed = time.Now()
+	return s.fd, nil
+}
+
+// release closes the file of the segment and drops its cached block and
+// mapping. The file is reopened on the next access. Only sealed segments
+// may be released, as the file of the active segment is written to.
+func (s *Segment) release() error {
+	if s.closed || s.fd == nil {
+		return nil
+	}
+	err := s.unmapFile()
+	if cerr := s.fd.Close(); err == nil {
+		err = cerr
+	}
+	s.fd = nil
+	s.cachedBlock = &block{id: -1}
+	return err
+}
+
+// mapFile maps the file of the sealed segment for readBlock. Where the
+// file cannot be mapped the segment keeps reading it instead.
+func (s *Segment) mapFile() error {
+	fd, err := s.file()
+	if err != nil {
 		return err
 	}
+	mapped, err := mmapFile(fd, s.flushedSize())
+	if err != nil {
+		s.opts.mmap = false
+		return nil
+	}
+	s.mapped = mapped
 	return nil
 }
 
-// readChunk parses the chunk
-func (s *Segment) readChunk(data []byte) (chunk, error) {
-	if len(data) < chunkHeaderSize {
+// unmapFile drops the mapping of mapFile, if any
+func (s *Segment) unmapFile() error {
+	if s.mapped == nil {
+		return nil
+	}
+	err := munmap(s.mapped)
+	s.mapped = nil
+	return err
+}
+
+// sampleChecksum reports whether the CRC of the chunk at the given block and
+// offset should be verified. The choice only depends on the chunk position.
+func (s *Segment) sampleChecksum(blockID, offset int) bool {
+	rate := s.opts.checksumSampleRate
+	if rate <= 1 {
+		return true
+	}
+	h := uint32(blockID*s.blockSize+offset) * 2654435761
+	return (h>>16)%uint32(rate) == 0
+}
+
+// readChunk parses the chunk, verifying its checksum if verify is set
+func (s *Segment) readChunk(data []byte, verify bool) (chunk, error) {
+	headerSize := s.chunkHeaderSize()
+	if len(data) < headerSize {
 		return chunk{}, ErrEndOfBlock
 	}
-	expectedCRC := binary.LittleEndian.Uint32(data[:4])
-	length := binary.LittleEndian.Uint16(data[4:6])
-	chunkType := ChunkType(data[6])
-	if int(length)+chunkHeaderSize > len(data) {
+	expectedCRC, length, chunkType := s.chunkFormat().parseHeader(data)
+	if length+headerSize > len(data) {
 		return chunk{}, ErrEndOfBlock
 	}
-	chunkData := data[chunkHeaderSize : chunkHeaderSize+int(length)]
-	actualCRC := crc32.ChecksumIEEE(chunkData)
-	if actualCRC != expectedCRC {
+	chunkData := data[headerSize : headerSize+length]
+	if verify && !s.header.checksum.matches(chunkData, expectedCRC) {
+		s.opts.stats.crcFailures.Add(1)
 		return chunk{}, ErrInvalidCRC
 	}
 	return chunk{
-		data:      data[chunkHeaderSize : chunkHeaderSize+int(length)],
+		data:      chunkData,
 		chunkType: chunkType,
 	}, nil
 }
@@ -361,13 +1677,23 @@ func (s *Segment) Close() error {
 	if s.closed {
 		return nil
 	}
-	if err := s.flushBlock(true); err != nil {
-		return err
+	if !s.opts.readOnly {
+		if err := s.flushBlock(true); err != nil {
+			return err
+		}
+		if err := syncFile(s.fd, s.opts.syncMethod); err != nil {
+			return err
+		}
+	}
+	s.closed = true
+	s.opts.blockCache.drop(s)
+	if s.fd == nil {
+		return nil // Released
 	}
-	if err := s.fd.Sync(); err != nil {
+	if err := s.unmapFile(); err != nil {
+		_ = s.fd.Close()
 		return err
 	}
-	s.closed = true
 	if err := s.fd.Close(); err != nil {
 		return err
 	}
@@ -412,3 +1738,62 @@ func (p *Position) DecodeString(data string) error {
 	}
 	return p.Decode(bytes)
 }
+
+// compactFull is set in the tag byte of a compact Position that carries its
+// segment id, see EncodeCompact
+const compactFull = 0x80
+
+// EncodeCompact encodes the Position relative to the segment base. A
+// Position in segment base takes 3 to 9 bytes instead of 12: a tag byte
+// holding the low 7 bits of base, then the uvarints of its block id, up to
+// 32 bits, and its offset, up to maxBlockSize. A Position in another segment
+// is tagged with compactFull and carries the uvarint of its segment id
+// before them. It fails if a field is out of these ranges.
+func (p *Position) EncodeCompact(base int) ([]byte, error) {
+	if p.SegmentId < 0 || uint64(p.SegmentId) > math.MaxUint32 || p.BlockId < 0 || uint64(p.BlockId) > math.MaxUint32 || p.Offset < 0 || p.Offset > maxBlockSize {
+		return nil, fmt.Errorf("position %+v cannot be encoded compactly", *p)
+	}
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen32)
+	if p.SegmentId == base {
+		buf = append(buf, byte(base)&^compactFull)
+	} else {
+		buf = append(buf, compactFull)
+		buf = binary.AppendUvarint(buf, uint64(p.SegmentId))
+	}
+	buf = binary.AppendUvarint(buf, uint64(p.BlockId))
+	buf = binary.AppendUvarint(buf, uint64(p.Offset))
+	return buf, nil
+}
+
+// DecodeCompact decodes a Position encoded by EncodeCompact. A Position
+// encoded relative to its segment fails to decode unless base is that
+// segment, or one differing from it by a multiple of 128.
+func (p *Position) DecodeCompact(base int, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("invalid format")
+	}
+	tag, data := data[0], data[1:]
+	segmentID := uint64(base)
+	if tag == compactFull {
+		var n int
+		segmentID, n = binary.Uvarint(data)
+		if n <= 0 || segmentID > math.MaxUint32 {
+			return errors.New("invalid format")
+		}
+		data = data[n:]
+	} else if tag != byte(base)&^compactFull {
+		return fmt.Errorf("position is not relative to base segment %d", base)
+	}
+	blockID, n := binary.Uvarint(data)
+	if n <= 0 || blockID > math.MaxUint32 {
+		return errors.New("invalid format")
+	}
+	offset, m := binary.Uvarint(data[n:])
+	if m <= 0 || n+m != len(data) || offset > maxBlockSize {
+		return errors.New("invalid format")
+	}
+	p.SegmentId = int(segmentID)
+	p.BlockId = int(blockID)
+	p.Offset = int(offset)
+	return nil
+}
@@ -2,9 +2,18 @@ package wal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSegment_New(t *testing.T) {
@@ -58,6 +67,51 @@ func TestSegment_WriteRead(t *testing.T) {
 	}
 }
 
+func TestSegment_ConcurrentRead(t *testing.T) {
+	seg, err := NewSegment(1, filepath.Join(t.TempDir(), "1.wal"))
+	if err != nil {
+		t.Fatalf("Failed to create seg: %v", err)
+	}
+	defer seg.Close()
+
+	var positions []*Position
+	var records [][]byte
+	for i := 0; i < 50; i++ {
+		record := bytes.Repeat([]byte{byte(i)}, 100+i*1499)
+		pos, err := seg.Write(record)
+		if err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	if err := seg.Sync(); err != nil {
+		t.Fatalf("Failed to sync seg: %v", err)
+	}
+
+	// Readers of different blocks share the cached block of the segment
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				i := (g*17 + n*7) % len(positions)
+				data, err := seg.Read(positions[i])
+				if err != nil {
+					t.Errorf("Failed to read record %d: %v", i, err)
+					return
+				}
+				if !bytes.Equal(records[i], data) {
+					t.Errorf("Record %d read back wrong", i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
 func TestSegment_Sync(t *testing.T) {
 	tempDir := os.TempDir()
 	path := filepath.Join(tempDir, "test_segment_sync.wal")
@@ -105,36 +159,73 @@ func TestSegment_Close(t *testing.T) {
 	}
 }
 
-func TestSegment_CRCValidation(t *testing.T) {
-	path := "test_segment.log"
-	defer os.Remove(path)
-
-	seg, err := NewSegment(1, path)
+func TestSegment_Sealed(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  128,
+		SyncInterval: 1 * time.Hour,
+	})
 	if err != nil {
-		t.Fatalf("Failed to create segment: %v", err)
+		t.Fatalf("Failed to open wal: %v", err)
 	}
-	defer seg.Close()
+	defer wal.Close()
 
-	data := []byte("Hello, WAL!")
-	pos, err := seg.Write(data)
-	if err != nil {
+	sealed := wal.segment
+	if _, err := sealed.Write([]byte("before rotation")); err != nil {
 		t.Fatalf("Failed to write data: %v", err)
 	}
-
-	fd, err := os.OpenFile(path, os.O_WRONLY, 0644)
-	if err != nil {
-		t.Fatalf("Failed to open file for tampering: %v", err)
+	if err := wal.rotate(); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
 	}
-	defer fd.Close()
-
-	tamperOffset := pos.BlockId*blockSize + pos.Offset + 4 // 跳过 CRC 字段
-	if _, err := fd.WriteAt([]byte{0xFF}, int64(tamperOffset)); err != nil {
-		t.Fatalf("Failed to tamper with file: %v", err)
+	size := sealed.Size()
+	if _, err := sealed.Write([]byte("after rotation")); !errors.Is(err, ErrSegmentSealed) {
+		t.Errorf("Expected ErrSegmentSealed, got %v", err)
 	}
+	if sealed.Size() != size {
+		t.Errorf("Sealed segment grew from %d to %d bytes", size, sealed.Size())
+	}
+	if _, err := wal.Write([]byte("active")); err != nil {
+		t.Errorf("Failed to write to the active segment: %v", err)
+	}
+}
 
-	_, err = seg.Read(pos)
-	if err == nil {
-		t.Error("Expected CRC validation error, got nil")
+func TestSegment_CRCValidation(t *testing.T) {
+	for _, checksum := range []ChecksumType{ChecksumCRC32, ChecksumCRC64} {
+		path := filepath.Join(t.TempDir(), "test_segment.log")
+		seg, err := newSegment(1, path, segmentOptions{fs: osFS{}, stats: &ioStats{}, checksum: checksum})
+		if err != nil {
+			t.Fatalf("Failed to create segment: %v", err)
+		}
+		defer seg.Close()
+
+		data := []byte("Hello, WAL!")
+		pos, err := seg.Write(data)
+		if err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+		if err := seg.Sync(); err != nil {
+			t.Fatalf("Failed to sync segment: %v", err)
+		}
+		if _, err := seg.Read(pos); err != nil {
+			t.Fatalf("Failed to read data with checksum %d: %v", checksum, err)
+		}
+
+		fd, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open file for tampering: %v", err)
+		}
+		defer fd.Close()
+
+		// The first payload byte follows the checksum, length and type
+		tamperOffset := pos.BlockId*blockSize + pos.Offset + checksum.chunkHeaderSize()
+		if _, err := fd.WriteAt([]byte{0xFF}, int64(tamperOffset)); err != nil {
+			t.Fatalf("Failed to tamper with file: %v", err)
+		}
+
+		seg.cachedBlock.id = -1
+		if _, err = seg.Read(pos); !errors.Is(err, ErrInvalidCRC) {
+			t.Errorf("Expected a checksum error with checksum %d, got %v", checksum, err)
+		}
 	}
 }
 
@@ -181,3 +272,411 @@ func TestSegment_WriteLargeData(t *testing.T) {
 	}
 
 }
+
+func TestSegment_Dump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seg_0.log")
+	seg, err := NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to create segment: %v", err)
+	}
+	defer seg.Close()
+
+	if _, err := seg.Write([]byte("Hello, WAL!")); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	pos, err := seg.Write(bytes.Repeat([]byte("x"), blockSize))
+	if err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := seg.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := seg.Dump(&out); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	firstLen := blockSize - segmentHeaderSize - 2*ChecksumCRC32.chunkHeaderSize() - 11
+	for _, want := range []string{
+		"block 0 offset=0 length=32768",
+		"  header version=1 layout=0 epoch=0 length=32",
+		"  chunk offset=32 type=full length=11 crc=ok",
+		fmt.Sprintf("  chunk offset=50 type=first length=%d crc=ok", firstLen),
+		"block 1 offset=32768",
+		fmt.Sprintf("  chunk offset=0 type=last length=%d crc=ok", blockSize-firstLen),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Dump does not contain %q:\n%s", want, out.String())
+		}
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open file for tampering: %v", err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteAt([]byte{0xFF}, int64(pos.Offset+ChecksumCRC32.chunkHeaderSize())); err != nil {
+		t.Fatalf("Failed to tamper with file: %v", err)
+	}
+
+	out.Reset()
+	if err := seg.Dump(&out); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	want := fmt.Sprintf("  chunk offset=50 type=first length=%d crc=INVALID", firstLen)
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("Dump does not contain %q:\n%s", want, out.String())
+	}
+}
+
+func TestSegment_ReadRawBlock(t *testing.T) {
+	seg, err := NewSegment(0, filepath.Join(t.TempDir(), "seg_0.log"))
+	if err != nil {
+		t.Fatalf("Failed to create segment: %v", err)
+	}
+	defer seg.Close()
+
+	records := [][]byte{[]byte("first"), bytes.Repeat([]byte("x"), blockSize), []byte("last")}
+	for _, data := range records {
+		if _, err := seg.Write(data); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+
+	block, err := seg.ReadRawBlock(0)
+	if err != nil {
+		t.Fatalf("ReadRawBlock failed: %v", err)
+	}
+	if len(block) != blockSize {
+		t.Fatalf("Expected a block of %d bytes, got %d", blockSize, len(block))
+	}
+	var types []ChunkType
+	for offset := seg.dataStart; offset+ChecksumCRC32.chunkHeaderSize() <= len(block); {
+		chk, err := seg.readChunk(block[offset:], true)
+		if err != nil {
+			t.Fatalf("Failed to parse the chunk at %d: %v", offset, err)
+		}
+		types = append(types, chk.chunkType)
+		offset += ChecksumCRC32.chunkHeaderSize() + len(chk.data)
+	}
+	if fmt.Sprint(types) != "[full first]" {
+		t.Errorf("Expected a full and a first chunk, got %v", types)
+	}
+
+	// The last block ends with the segment
+	block, err = seg.ReadRawBlock(1)
+	if err != nil {
+		t.Fatalf("ReadRawBlock failed: %v", err)
+	}
+	if want := seg.Size() - blockSize; int64(len(block)) != want {
+		t.Fatalf("Expected the last block to hold %d bytes, got %d", want, len(block))
+	}
+	chk, err := seg.readChunk(block, true)
+	if err != nil || chk.chunkType != kLastType {
+		t.Fatalf("Expected a last chunk, got %v: %v", chk.chunkType, err)
+	}
+	offset := ChecksumCRC32.chunkHeaderSize() + len(chk.data)
+	chk, err = seg.readChunk(block[offset:], true)
+	if err != nil || chk.chunkType != kFullType || string(chk.data) != "last" {
+		t.Fatalf("Expected the last record, got %q: %v", chk.data, err)
+	}
+
+	for _, id := range []int{-1, 2} {
+		if _, err := seg.ReadRawBlock(id); err == nil {
+			t.Errorf("Expected an error for block %d", id)
+		}
+	}
+}
+
+func TestSegment_ReopenDropsPadding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seg_0.log")
+	seg, err := NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to create segment: %v", err)
+	}
+	first, err := seg.Write([]byte("before close"))
+	if err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := seg.Close(); err != nil {
+		t.Fatalf("Failed to close segment: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != blockSize {
+		t.Fatalf("Expected Close to pad the block, got %v: %v", info.Size(), err)
+	}
+
+	seg, err = NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to reopen segment: %v", err)
+	}
+	defer seg.Close()
+	end := first.Offset + ChecksumCRC32.chunkHeaderSize() + len("before close")
+	if seg.Size() != int64(end) {
+		t.Fatalf("Expected the reopened segment to end at %d, got %d", end, seg.Size())
+	}
+	second, err := seg.Write([]byte("after reopen"))
+	if err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if second.BlockId != 0 || second.Offset != end {
+		t.Errorf("Expected the record to follow the previous one at 0/%d, got %d/%d", end, second.BlockId, second.Offset)
+	}
+	if err := seg.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	_, next, err := seg.ReadWithNext(first)
+	if err != nil || *next != *second {
+		t.Errorf("Expected the next record at %+v, got %+v: %v", *second, next, err)
+	}
+	for pos, want := range map[*Position]string{first: "before close", second: "after reopen"} {
+		data, err := seg.Read(pos)
+		if err != nil || string(data) != want {
+			t.Errorf("Expected %q, got %q: %v", want, data, err)
+		}
+	}
+}
+
+func TestSegment_LegacyWithoutHeader(t *testing.T) {
+	// Segments written before segment headers existed start with a chunk.
+	path := filepath.Join(t.TempDir(), "seg_0.log")
+	data := []byte("legacy record")
+	chunk := make([]byte, ChecksumCRC32.chunkHeaderSize(), ChecksumCRC32.chunkHeaderSize()+len(data))
+	binary.LittleEndian.PutUint32(chunk[:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint16(chunk[4:6], uint16(len(data)))
+	chunk[6] = byte(kFullType)
+	if err := os.WriteFile(path, append(chunk, data...), 0644); err != nil {
+		t.Fatalf("Failed to write legacy segment: %v", err)
+	}
+
+	seg, err := NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	defer seg.Close()
+	if seg.dataStart != 0 || seg.header.version != 0 {
+		t.Fatalf("Expected a legacy segment, got header %+v", seg.header)
+	}
+
+	readData, err := seg.Read(&Position{})
+	if err != nil {
+		t.Fatalf("Failed to read legacy record: %v", err)
+	}
+	if !bytes.Equal(data, readData) {
+		t.Errorf("Expected %q but got %q", data, readData)
+	}
+
+	pos, err := seg.Write([]byte("appended"))
+	if err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := seg.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	readData, err = seg.Read(pos)
+	if err != nil {
+		t.Fatalf("Failed to read appended record: %v", err)
+	}
+	if string(readData) != "appended" {
+		t.Errorf("Expected %q but got %q", "appended", readData)
+	}
+}
+
+func TestSegment_BlockBufferCapacity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seg_0.log")
+	seg, err := NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to create segment: %v", err)
+	}
+	defer seg.Close()
+
+	if _, err := seg.Write(make([]byte, 4*MB)); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := seg.Write([]byte("small record")); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+	if c := cap(seg.currentBlock.data); c > blockSize {
+		t.Errorf("Expected a block buffer of at most %d bytes, got %d", blockSize, c)
+	}
+
+	// A buffer that grew beyond a block is released once the block is done
+	grown := make([]byte, len(seg.currentBlock.data), 4*blockSize)
+	copy(grown, seg.currentBlock.data)
+	seg.currentBlock.data = grown
+	if err := seg.flushBlock(true); err != nil {
+		t.Fatalf("Failed to flush block: %v", err)
+	}
+	if c := cap(seg.currentBlock.data); c > blockSize {
+		t.Errorf("Expected the grown buffer to be released, got capacity %d", c)
+	}
+}
+
+func TestSegment_ChunkLayout(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		Directory:    dir,
+		SegmentSize:  4 * blockSize,
+		SyncInterval: 1 * time.Hour,
+		ChunkLayout:  LayoutLengthFirst,
+	}
+	wal, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	records := [][]byte{[]byte("hello"), bytes.Repeat([]byte("y"), 2*blockSize), []byte("world")}
+	var positions []*Position
+	for _, record := range records {
+		pos, err := wal.Write(record)
+		if err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// The length comes first on disk
+	path := wal.opts.segmentPath(dir, 0)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	if got := binary.LittleEndian.Uint16(raw[segmentHeaderSize:]); got != 5 {
+		t.Fatalf("Expected the length 5 at the start of the chunk, got %d", got)
+	}
+
+	// Reopened with the default layout, the segment keeps its own
+	opts.ChunkLayout = LayoutCRCFirst
+	wal, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		if err != nil {
+			t.Fatalf("Failed to read record %d: %v", i, err)
+		}
+		if !bytes.Equal(records[i], data) {
+			t.Errorf("Record %d differs", i)
+		}
+	}
+	if err := wal.segments[0].QuickVerify(); err != nil {
+		t.Errorf("QuickVerify failed: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Decoding the chunks with the other layout fails
+	seg, err := NewSegment(0, path)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	seg.header.layout = LayoutCRCFirst
+	if _, err := seg.Read(positions[0]); !errors.Is(err, ErrInvalidCRC) && err != ErrEndOfBlock {
+		t.Errorf("Expected a chunk decoding error reading with the wrong layout, got %v", err)
+	}
+	if err := seg.QuickVerify(); err == nil {
+		t.Errorf("Expected QuickVerify to fail with the wrong layout")
+	}
+	seg.Close()
+
+	// An unknown layout is rejected when the segment is opened
+	header := segmentHeader{version: segmentHeaderVersion, layout: 9}
+	copy(raw, header.encode())
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	if _, err := NewSegment(0, path); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	// So is a format version newer than this package knows
+	header = segmentHeader{version: segmentHeaderVersion + 1}
+	copy(raw, header.encode())
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	if _, err := NewSegment(0, path); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat for version %d, got %v", header.version, err)
+	}
+}
+
+func TestPosition_EncodeCompact(t *testing.T) {
+	positions := []Position{
+		{SegmentId: 7, BlockId: 0, Offset: 0},
+		{SegmentId: 7, BlockId: 3, Offset: 1234},
+		{SegmentId: 7, BlockId: 1 << 20, Offset: blockSize},
+	}
+	invalid := []Position{
+		{SegmentId: 7, Offset: maxBlockSize + 1},
+		{SegmentId: 7, Offset: -1},
+		{SegmentId: -1},
+	}
+	if strconv.IntSize == 64 {
+		maxBlockId := uint64(math.MaxUint32)
+		positions = append(positions, Position{SegmentId: 7, BlockId: int(maxBlockId), Offset: maxBlockSize}) // The longest, 9 bytes
+		invalid = append(invalid, Position{SegmentId: 7, BlockId: int(maxBlockId + 1)})
+	}
+	for _, pos := range positions {
+		data, err := pos.EncodeCompact(7)
+		if err != nil {
+			t.Fatalf("EncodeCompact(%+v) failed: %v", pos, err)
+		}
+		if len(data) >= len(pos.Encode()) {
+			t.Errorf("Compact encoding of %+v takes %d bytes", pos, len(data))
+		}
+		var decoded Position
+		if err := decoded.DecodeCompact(7, data); err != nil {
+			t.Fatalf("DecodeCompact failed: %v", err)
+		}
+		if decoded != pos {
+			t.Errorf("Expected %+v but got %+v", pos, decoded)
+		}
+	}
+
+	// A position in another segment carries its segment id
+	data, err := positions[1].EncodeCompact(8)
+	if err != nil {
+		t.Fatalf("EncodeCompact against another base failed: %v", err)
+	}
+	var other Position
+	if err := other.DecodeCompact(8, data); err != nil || other != positions[1] {
+		t.Errorf("Expected %+v but got %+v, %v", positions[1], other, err)
+	}
+
+	// Decoding against another base than the encoding fails
+	data, err = positions[1].EncodeCompact(7)
+	if err != nil {
+		t.Fatalf("EncodeCompact failed: %v", err)
+	}
+	for _, base := range []int{6, 8, 0} {
+		if err := other.DecodeCompact(base, data); err == nil {
+			t.Errorf("Expected an error decoding against base %d, got %+v", base, other)
+		}
+	}
+	for _, pos := range invalid {
+		if _, err := pos.EncodeCompact(7); err == nil {
+			t.Errorf("Expected an error encoding %+v", pos)
+		}
+	}
+	var decoded Position
+	for _, data := range [][]byte{
+		nil,
+		{7},
+		{7, 0x80},
+		{7, 1},
+		{7, 1, 2, 3},
+		{7, 1, 0x81, 0x80, 0x04},
+		{compactFull},
+		{compactFull, 7, 1},
+		{compactFull, 0xff, 0xff, 0xff, 0xff, 0x1f, 1, 2},
+	} {
+		if err := decoded.DecodeCompact(7, data); err == nil {
+			t.Errorf("Expected an error decoding %x", data)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// seqIndexFile is the name of the file in Options.Directory holding the
+// sequence index
+const seqIndexFile = "index.wal"
+
+// seqIndexEntrySize is the size of an entry of the sequence index file:
+// the sequence number, the encoded Position and a crc32 of both
+const seqIndexEntrySize = 8 + 12 + 4
+
+var (
+	ErrNoSequenceIndex = errors.New("the sequence index is disabled, see Options.SequenceIndex")
+	ErrSeqNotFound     = errors.New("no record with the sequence number")
+)
+
+// seqIndex maps the sequence numbers of the records to their positions. The
+// entries are appended to the index file when the active segment is synced.
+type seqIndex struct {
+	fd        File // Nil for a read-only WAL without index file
+	readOnly  bool
+	first     uint64     // Sequence number of positions[0]
+	positions []Position // Positions of the records in order
+	written   int        // Number of positions written to the file
+}
+
+// loadSeqIndex opens the sequence index file and validates it against the
+// segments. Records missing from the index, e.g. written after the last
+// sync before a crash, are added. An index that is corrupt or does not match
+// the segments is rebuilt with a full scan, numbering the records from 0.
+// A read-only WAL leaves the file unchanged and keeps the result in memory.
+func (w *WAL) loadSeqIndex() error {
+	path := filepath.Join(w.opts.Directory, seqIndexFile)
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if w.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fd, err := w.opts.FS.OpenFile(path, flag, 0644)
+	if err != nil && !(w.opts.ReadOnly && errors.Is(err, os.ErrNotExist)) {
+		return err
+	}
+	idx := &seqIndex{fd: fd, readOnly: w.opts.ReadOnly}
+	w.seqIndex = idx
+
+	valid, err := idx.load()
+	if err != nil {
+		return err
+	}
+	from := Position{SegmentId: w.firstSegmentId()}
+	if valid && len(idx.positions) > 0 {
+		last := idx.positions[len(idx.positions)-1]
+		seg, ok := w.segments[last.SegmentId]
+		if !ok && last.SegmentId < w.firstSegmentId() {
+			// Its segment was purged, see trimSeqIndex
+			from = Position{SegmentId: w.firstSegmentId()}
+		} else if !ok {
+			valid = false
+		} else if _, next, err := seg.read(&last); err == nil || err == ErrTombstoned {
+			from = next
+		} else {
+			valid = false
+		}
+	}
+	if !valid {
+		if err := idx.truncate(0); err != nil {
+			return err
+		}
+		idx.first = 0
+		from = Position{SegmentId: w.firstSegmentId()}
+	}
+	if err := w.scanSeqIndex(from); err != nil {
+		return err
+	}
+	return w.syncSeqIndex()
+}
+
+// firstSegmentId returns the id of the oldest segment
+func (w *WAL) firstSegmentId() int {
+	infos := w.segmentInfos()
+	if len(infos) == 0 {
+		return 0
+	}
+	return infos[0].Id
+}
+
+// scanSeqIndex adds the records from pos to the end of the WAL to the index
+func (w *WAL) scanSeqIndex(pos Position) error {
+	for _, info := range w.segmentInfos() {
+		if info.Id < pos.SegmentId {
+			continue
+		}
+		if info.Id > pos.SegmentId {
+			pos = Position{SegmentId: info.Id}
+		}
+		seg := w.segments[info.Id]
+		for {
+			_, at, next, err := seg.readNext(pos)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("segment %d: %w", info.Id, err)
+			}
+			w.seqIndex.positions = append(w.seqIndex.positions, at)
+			pos = next
+		}
+	}
+	return nil
+}
+
+// load reads the entries of the index file, reporting false if they are
+// corrupt. A torn entry at the end is dropped.
+func (idx *seqIndex) load() (bool, error) {
+	if idx.fd == nil {
+		return true, nil
+	}
+	size, err := idx.fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	data := make([]byte, size-size%seqIndexEntrySize)
+	if _, err := idx.fd.ReadAt(data, 0); err != nil && err != io.EOF {
+		return false, err
+	}
+	for off := 0; off < len(data); off += seqIndexEntrySize {
+		entry := data[off : off+seqIndexEntrySize]
+		if crc32.ChecksumIEEE(entry[:20]) != binary.LittleEndian.Uint32(entry[20:]) {
+			return false, nil
+		}
+		seq := binary.LittleEndian.Uint64(entry[:8])
+		if off == 0 {
+			idx.first = seq
+		} else if seq != idx.first+uint64(len(idx.positions)) {
+			return false, nil
+		}
+		var pos Position
+		if err := pos.Decode(entry[8:20]); err != nil {
+			return false, nil
+		}
+		idx.positions = append(idx.positions, pos)
+	}
+	idx.written = len(idx.positions)
+	if size%seqIndexEntrySize != 0 && !idx.readOnly {
+		// Torn write of the last entry
+		if err := idx.fd.Truncate(int64(len(data))); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// flush appends the entries not written yet to the index file
+func (idx *seqIndex) flush() error {
+	if idx.readOnly || idx.written == len(idx.positions) {
+		return nil
+	}
+	if _, err := idx.fd.Write(idx.encode(idx.written, len(idx.positions))); err != nil {
+		return err
+	}
+	idx.written = len(idx.positions)
+	return nil
+}
+
+// encode returns the file entries of the positions from i to j
+func (idx *seqIndex) encode(i, j int) []byte {
+	buf := make([]byte, 0, (j-i)*seqIndexEntrySize)
+	for ; i < j; i++ {
+		var entry [seqIndexEntrySize]byte
+		binary.LittleEndian.PutUint64(entry[:8], idx.first+uint64(i))
+		copy(entry[8:20], idx.positions[i].Encode())
+		binary.LittleEndian.PutUint32(entry[20:], crc32.ChecksumIEEE(entry[:20]))
+		buf = append(buf, entry[:]...)
+	}
+	return buf
+}
+
+// truncate drops all but the first n entries
+func (idx *seqIndex) truncate(n int) error {
+	idx.positions = idx.positions[:n]
+	if idx.written > n && !idx.readOnly {
+		if err := idx.fd.Truncate(int64(n) * seqIndexEntrySize); err != nil {
+			return err
+		}
+		idx.written = n
+	}
+	return nil
+}
+
+// trimSeqIndex drops the entries of the records before the oldest segment,
+// whose segments were purged, from the sequence index and rewrites the
+// index file without them, w.mu held
+func (w *WAL) trimSeqIndex() error {
+	idx := w.seqIndex
+	if idx == nil {
+		return nil
+	}
+	n := idx.search(Position{SegmentId: w.firstSegmentId()})
+	if !idx.readOnly {
+		// The last entry written is kept to carry the numbering over to
+		// the records of the segments left
+		n = min(n, idx.written-1)
+	}
+	if n <= 0 {
+		return nil
+	}
+	if idx.readOnly {
+		idx.drop(n)
+		return nil
+	}
+	// The file is replaced closed, which renaming requires on some platforms
+	path := filepath.Join(w.opts.Directory, seqIndexFile)
+	buf := idx.encode(n, idx.written)
+	if err := idx.fd.Close(); err != nil {
+		return err
+	}
+	err := writeFileAtomic(w.opts.FS, path, buf)
+	if err == nil {
+		idx.drop(n)
+	}
+	fd, ferr := w.opts.FS.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if ferr != nil {
+		return errors.Join(err, ferr)
+	}
+	idx.fd = fd
+	return err
+}
+
+// drop drops the first n entries, which are written to the file
+func (idx *seqIndex) drop(n int) {
+	idx.positions = append([]Position(nil), idx.positions[n:]...)
+	idx.first += uint64(n)
+	idx.written = max(idx.written-n, 0)
+}
+
+// search returns the index of the first record at or after pos
+func (idx *seqIndex) search(pos Position) int {
+	return sort.Search(len(idx.positions), func(i int) bool {
+		return comparePositions(idx.positions[i], pos) >= 0
+	})
+}
+
+// lookup returns the position of the record with sequence number seq
+func (idx *seqIndex) lookup(seq uint64) (Position, error) {
+	if seq < idx.first || seq-idx.first >= uint64(len(idx.positions)) {
+		return Position{}, fmt.Errorf("%w: %d", ErrSeqNotFound, seq)
+	}
+	return idx.positions[seq-idx.first], nil
+}
+
+// syncSeqIndex writes the pending entries of the sequence index and syncs
+// the index file. It is called after the active segment was synced, so the
+// index never refers to records that are not durable.
+func (w *WAL) syncSeqIndex() error {
+	if w.seqIndex == nil || w.seqIndex.readOnly {
+		return nil
+	}
+	if err := w.seqIndex.flush(); err != nil {
+		return err
+	}
+	return w.seqIndex.fd.Sync()
+}
+
+// closeSeqIndex syncs and closes the index file
+func (w *WAL) closeSeqIndex() error {
+	if w.seqIndex == nil || w.seqIndex.fd == nil {
+		return nil
+	}
+	if err := w.syncSeqIndex(); err != nil {
+		return err
+	}
+	return w.seqIndex.fd.Close()
+}
+
+// NextSeq returns the sequence number the next record written gets, see
+// Options.SequenceIndex.
+func (w *WAL) NextSeq() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seqIndex == nil {
+		return 0, ErrNoSequenceIndex
+	}
+	return w.seqIndex.first + uint64(len(w.seqIndex.positions)), nil
+}
+
+// ReadBySeq returns the record with sequence number seq, see
+// Options.SequenceIndex. The buffered block of the active segment is flushed
+// if it holds the record.
+func (w *WAL) ReadBySeq(seq uint64) ([]byte, error) {
+	records, err := w.ReadN(seq, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrSeqNotFound, seq)
+	}
+	return records[0], nil
+}
+
+// ReadN returns up to n records starting with sequence number seq, fewer at
+// the end of the WAL, see Options.SequenceIndex.
+func (w *WAL) ReadN(seq uint64, n int) ([][]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seqIndex == nil {
+		return nil, ErrNoSequenceIndex
+	}
+	if _, err := w.seqIndex.lookup(seq); err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	for i := 0; i < n; i++ {
+		pos, err := w.seqIndex.lookup(seq + uint64(i))
+		if err != nil {
+			break // The end of the WAL
+		}
+		seg, ok := w.lookupSegment(pos.SegmentId)
+		if !ok {
+			return records, fmt.Errorf("%w: %d, segment %d not found", ErrSeqNotFound, seq+uint64(i), pos.SegmentId)
+		}
+		if seg == w.segment && !w.opts.ReadOnly {
+			if err := seg.flushBlock(false); err != nil {
+				return records, err
+			}
+		}
+		data, err := seg.Read(&pos)
+		if err != nil {
+			return records, fmt.Errorf("sequence number %d: %w", seq+uint64(i), err)
+		}
+		records = append(records, data)
+	}
+	return records, nil
+}
+
+// Skip skips the next n records of the reader. With Options.SequenceIndex
+// the reader jumps to the record directly instead of reading the records in
+// between.
+func (r *Reader) Skip(n int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.pos == nil {
+		return io.EOF
+	}
+	w := r.wal
+	w.mu.Lock()
+	if idx := w.seqIndex; idx != nil {
+		if i := idx.search(*r.pos); i+n < len(idx.positions) {
+			pos := idx.positions[i+n]
+			if seg, ok := w.lookupSegment(pos.SegmentId); ok {
+				r.current, *r.pos = seg, pos
+				w.mu.Unlock()
+				return nil
+			}
+		}
+	}
+	w.mu.Unlock()
+	for i := 0; i < n; i++ {
+		if _, _, err := r.nextLocked(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_ReadBySeq(t *testing.T) {
+	opts := Options{
+		Directory:     t.TempDir(),
+		SegmentSize:   4096,
+		SyncInterval:  1 * time.Hour,
+		SequenceIndex: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		if i == 500 {
+			_, err = wal.WriteCheckpoint([]byte("state"))
+			assert.NoError(t, err)
+		}
+	}
+	assert.Greater(t, len(wal.Segments()), 3)
+	for _, seq := range []uint64{0, 1, 499, 500, 501, 777, 999} {
+		data, err := wal.ReadBySeq(seq)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", seq), string(data))
+	}
+	_, err = wal.ReadBySeq(1000)
+	assert.ErrorIs(t, err, ErrSeqNotFound)
+	records, err := wal.ReadN(995, 10)
+	assert.NoError(t, err)
+	assert.Len(t, records, 5)
+	assert.Equal(t, "record 995", string(records[0]))
+	assert.NoError(t, wal.Close())
+
+	// The index file lets the reopened WAL jump to any sequence number
+	info, err := os.Stat(filepath.Join(opts.Directory, seqIndexFile))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000*seqIndexEntrySize), info.Size())
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	next, err := wal.NextSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), next)
+	data, err := wal.ReadBySeq(642)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 642", string(data))
+
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.NoError(t, r.Skip(300))
+	data, err = r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "record 300", string(data))
+	assert.NoError(t, r.Skip(400))
+	data, err = r.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "record 701", string(data))
+}
+
+func TestWAL_SequenceIndexRebuild(t *testing.T) {
+	opts := Options{
+		Directory:     t.TempDir(),
+		SegmentSize:   4096,
+		SyncInterval:  1 * time.Hour,
+		SequenceIndex: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	path := filepath.Join(opts.Directory, seqIndexFile)
+	assert.NoError(t, os.Remove(path))
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	data, err := wal.ReadBySeq(123)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 123", string(data))
+	_, err = wal.Write([]byte("record 300"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	// A corrupt entry is detected and the index rebuilt
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, raw, 301*seqIndexEntrySize)
+	raw[100*seqIndexEntrySize+10] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	for _, seq := range []uint64{0, 100, 300} {
+		data, err := wal.ReadBySeq(seq)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", seq), string(data))
+	}
+}
+
+func TestWAL_SequenceIndexTruncate(t *testing.T) {
+	opts := Options{
+		Directory:     t.TempDir(),
+		SegmentSize:   4096,
+		SyncInterval:  1 * time.Hour,
+		SequenceIndex: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 1000; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+
+	// The entries of the purged records are dropped from the index
+	assert.NoError(t, wal.Truncate(positions[900]))
+	first := wal.seqIndex.first
+	assert.Greater(t, first, uint64(0))
+	assert.Equal(t, positions[900].SegmentId, wal.seqIndex.positions[0].SegmentId)
+	_, err = wal.ReadBySeq(0)
+	assert.ErrorIs(t, err, ErrSeqNotFound)
+	data, err := wal.ReadBySeq(950)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 950", string(data))
+	info, err := os.Stat(filepath.Join(opts.Directory, seqIndexFile))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000-first)*seqIndexEntrySize, info.Size())
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	assert.Equal(t, first, wal.seqIndex.first)
+	_, err = wal.ReadBySeq(first - 1)
+	assert.ErrorIs(t, err, ErrSeqNotFound)
+	data, err = wal.ReadBySeq(999)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 999", string(data))
+
+	// Purging every record keeps the numbering
+	wal.mu.Lock()
+	assert.NoError(t, wal.rotate())
+	wal.mu.Unlock()
+	active := wal.segment.Id()
+	assert.NoError(t, wal.Truncate(&Position{SegmentId: active}))
+	_, err = wal.ReadBySeq(999)
+	assert.ErrorIs(t, err, ErrSeqNotFound)
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	next, err := wal.NextSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1000), next)
+	_, err = wal.Write([]byte("record 1000"))
+	assert.NoError(t, err)
+	data, err = wal.ReadBySeq(1000)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 1000", string(data))
+}
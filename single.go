@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// singleRecordHeaderSize is the size of the header of the record of a single
+// record segment, see Options.SingleRecordSegments:
+//
+//	length(8) crc(4)
+//
+// The record follows as is, without chunk framing or block padding.
+const singleRecordHeaderSize = 12
+
+// singleRecord reports whether the segment holds a single unframed record
+func (s *Segment) singleRecord() bool {
+	return s.header.flags&segmentFlagSingleRecord != 0
+}
+
+// writeSingle writes data as the record of a single record segment
+func (s *Segment) writeSingle(data []byte, flags ChunkType) (*Position, error) {
+	if flags != 0 {
+		return nil, fmt.Errorf("single record segment %d cannot hold checkpoint or keyed records", s.id)
+	}
+	if !s.empty() {
+		return nil, fmt.Errorf("%w: single record segment %d holds its record", ErrSegmentSealed, s.id)
+	}
+	// Write the segment header if it is still buffered
+	if err := s.flushBlock(false); err != nil {
+		return nil, err
+	}
+	fd, err := s.file()
+	if err != nil {
+		return nil, err
+	}
+	var header [singleRecordHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[0:8], uint64(len(data)))
+	binary.LittleEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(data))
+	n, err := fd.Write(header[:])
+	s.opts.stats.physicalBytes.Add(int64(n))
+	if err != nil {
+		return nil, err
+	}
+	n, err = fd.Write(data)
+	s.opts.stats.physicalBytes.Add(int64(n))
+	if err != nil {
+		return nil, err
+	}
+	s.rawSize = int64(s.dataStart) + singleRecordHeaderSize + int64(len(data))
+	return &Position{SegmentId: s.id, Offset: s.dataStart}, nil
+}
+
+// readSingle reads the record of a single record segment into the capacity
+// of dst. Any other position than that of the record is at the end of the
+// segment.
+func (s *Segment) readSingle(dst []byte, pos *Position) ([]byte, Position, bool, error) {
+	if s.closed {
+		return nil, Position{}, false, ErrClosed
+	}
+	at := *pos
+	s.skipHeader(&at)
+	if s.rawSize == 0 || at.BlockId != 0 || at.Offset != s.dataStart {
+		return nil, Position{}, false, io.EOF
+	}
+	fd, err := s.file()
+	if err != nil {
+		return nil, Position{}, false, err
+	}
+	var header [singleRecordHeaderSize]byte
+	if _, err := s.readAt(fd, header[:], int64(s.dataStart)); err != nil {
+		return nil, Position{}, false, err
+	}
+	length := binary.LittleEndian.Uint64(header[0:8])
+	end := int64(s.dataStart) + singleRecordHeaderSize
+	if length > uint64(s.rawSize-end) {
+		return nil, Position{}, false, io.ErrUnexpectedEOF
+	}
+	end += int64(length)
+
+	entry := dst[:0]
+	if entry == nil || uint64(cap(entry)) < length {
+		entry = make([]byte, length)
+	}
+	entry = entry[:length]
+	n, err := s.readAt(fd, entry, int64(s.dataStart)+singleRecordHeaderSize)
+	s.opts.readLimiter.take(n)
+	if err != nil {
+		return nil, Position{}, false, err
+	}
+	if s.sampleChecksum(0, s.dataStart) && crc32.ChecksumIEEE(entry) != binary.LittleEndian.Uint32(header[8:12]) {
+		s.opts.stats.crcFailures.Add(1)
+		return nil, Position{}, false, ErrInvalidCRC
+	}
+	return entry, s.positionAt(end), false, nil
+}
+
+// verifySingleRecord checks the record in the first size bytes of a single
+// record segment file whose record starts at dataStart
+func verifySingleRecord(r io.ReaderAt, size int64, dataStart int) error {
+	if size <= int64(dataStart) {
+		return nil // No record yet
+	}
+	var header [singleRecordHeaderSize]byte
+	if _, err := r.ReadAt(header[:], int64(dataStart)); err != nil {
+		return fmt.Errorf("record header: %w", err)
+	}
+	length := binary.LittleEndian.Uint64(header[0:8])
+	if length > uint64(size-int64(dataStart)-singleRecordHeaderSize) {
+		return fmt.Errorf("record of %d bytes exceeds the segment", length)
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, int64(dataStart)+singleRecordHeaderSize, int64(length))); err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[8:12]) {
+		return fmt.Errorf("record: %w", ErrInvalidCRC)
+	}
+	return nil
+}
+
+// verifySegmentData checks the first size bytes of a segment file with the
+// given header, whose data starts at dataStart
+func verifySegmentData(r io.ReaderAt, size int64, dataStart int, header segmentHeader, pace func() error) error {
+	if header.flags&segmentFlagSingleRecord != 0 {
+		return verifySingleRecord(r, size, dataStart)
+	}
+	blockSize := blockSize
+	if header.blockSize != 0 {
+		blockSize = header.blockSize
+	}
+	return verifyChunks(r, size, blockSize, dataStart, chunkFormat{layout: header.layout, checksum: header.checksum}, pace)
+}
@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_SingleRecordSegments(t *testing.T) {
+	opts := Options{
+		Directory:            t.TempDir(),
+		SegmentSize:          1 * GB,
+		SyncInterval:         1 * time.Hour,
+		SingleRecordSegments: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var objects [][]byte
+	var positions []*Position
+	for i, size := range []int{3 * blockSize / 2, 0, 1 * MB, 100} {
+		object := bytes.Repeat([]byte{byte('a' + i)}, size)
+		pos, err := wal.Write(object)
+		assert.NoError(t, err)
+		objects = append(objects, object)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+
+	// Every object has a segment of its own, without framing or padding
+	for i, pos := range positions {
+		assert.Equal(t, i, pos.SegmentId)
+		info, err := os.Stat(wal.opts.segmentPath(opts.Directory, pos.SegmentId))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(segmentHeaderSize+singleRecordHeaderSize+len(objects[i])), info.Size())
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, objects[i], data)
+	}
+	_, err = wal.WriteCheckpoint([]byte("state"))
+	assert.Error(t, err)
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	for i := range objects {
+		data, at, err := r.next()
+		assert.NoError(t, err)
+		assert.Equal(t, *positions[i], at)
+		assert.Equal(t, objects[i], data)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+
+	// A corrupt object is detected on read and by Verify
+	path := wal.opts.segmentPath(opts.Directory, positions[2].SegmentId)
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	raw[len(raw)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, raw, 0644))
+	wal.segments[positions[2].SegmentId].release()
+	_, err = wal.Read(positions[2])
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+	report, err = wal.Verify()
+	assert.NoError(t, err)
+	assert.Len(t, report.Errors, 1)
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package wal
+
+import "syscall"
+
+// diskFree returns the number of bytes available to unprivileged users on the
+// filesystem containing dir.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// ioStats holds the counters shared by a WAL and its segments
+type ioStats struct {
+	payloadBytes  atomic.Int64 // Bytes of record payload written
+	physicalBytes atomic.Int64 // Bytes written to segment files, including headers and padding
+	paddingBytes  atomic.Int64 // Bytes of block padding written
+	records       atomic.Int64 // Records written
+	syncs         atomic.Int64 // fsyncs of segment files
+	rotations     atomic.Int64 // Rotations of the active segment
+	cacheHits     atomic.Int64 // Block reads served by the cached block
+	cacheMisses   atomic.Int64 // Block reads served by the file
+	crcFailures   atomic.Int64 // Chunks read with a CRC mismatch
+}
+
+// WriteAmplification returns the ratio of bytes written to the segment files,
+// chunk headers and block padding included, to the bytes of record payload
+// written since the WAL was opened. Data still buffered in the active block
+// is not counted until it is flushed. It returns 0 before anything was
+// written.
+func (w *WAL) WriteAmplification() float64 {
+	payload := w.stats.payloadBytes.Load()
+	if payload == 0 {
+		return 0
+	}
+	return float64(w.stats.physicalBytes.Load()) / float64(payload)
+}
+
+// CommitWindow returns how long the latest group commit waited for more
+// records, see Options.MaxCommitDelay. It is 0 without group commit or
+// while the load is low.
+func (w *WAL) CommitWindow() time.Duration {
+	if w.committer == nil {
+		return 0
+	}
+	return time.Duration(w.committer.window.Load())
+}
+
+// Metrics is a snapshot of the counters of a WAL, see Stats and MetricsJSON.
+// The counters start at zero when the WAL is opened.
+type Metrics struct {
+	PayloadBytes  int64 `json:"payload_bytes"`
+	PhysicalBytes int64 `json:"physical_bytes"`
+	PaddingBytes  int64 `json:"padding_bytes"`
+	Records       int64 `json:"records"`
+	Syncs         int64 `json:"syncs"`
+	Rotations     int64 `json:"rotations"`
+	CacheHits     int64 `json:"cache_hits"`
+	CacheMisses   int64 `json:"cache_misses"`
+	CRCFailures   int64 `json:"crc_failures"`
+
+	Segments        int   `json:"segments"`
+	ActiveSegmentId int   `json:"active_segment_id"`
+	ActiveSize      int64 `json:"active_size"`
+	TotalSize       int64 `json:"total_size"`
+}
+
+// Stats returns a snapshot of the counters and current sizes of the WAL:
+// the open segments, the active one and the bytes they hold on disk along
+// with the records, payload bytes, syncs and rotations since it was opened.
+func (w *WAL) Stats() Metrics {
+	m := Metrics{
+		PayloadBytes:  w.stats.payloadBytes.Load(),
+		PhysicalBytes: w.stats.physicalBytes.Load(),
+		PaddingBytes:  w.stats.paddingBytes.Load(),
+		Records:       w.stats.records.Load(),
+		Syncs:         w.stats.syncs.Load(),
+		Rotations:     w.stats.rotations.Load(),
+		CacheHits:     w.stats.cacheHits.Load(),
+		CacheMisses:   w.stats.cacheMisses.Load(),
+		CRCFailures:   w.stats.crcFailures.Load(),
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m.Segments = len(w.segments)
+	for _, seg := range w.segments {
+		m.TotalSize += seg.Size()
+	}
+	if w.segment != nil {
+		m.ActiveSegmentId = w.segment.Id()
+		m.ActiveSize = w.segment.Size()
+	}
+	return m
+}
+
+// MetricsJSON returns a snapshot of the counters and current sizes of the
+// WAL as JSON, for quick debugging e.g. through an HTTP handler, see Stats.
+func (w *WAL) MetricsJSON() ([]byte, error) {
+	return json.Marshal(w.Stats())
+}
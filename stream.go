@@ -0,0 +1,225 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// positionAt returns the position of the given byte offset of the segment
+func (s *Segment) positionAt(offset int64) Position {
+	size := int64(s.blockSize)
+	return Position{SegmentId: s.id, BlockId: int(offset / size), Offset: int(offset % size)}
+}
+
+// fileOffset returns the byte offset of a position within the segment
+func (s *Segment) fileOffset(p Position) int64 {
+	return int64(p.BlockId)*int64(s.blockSize) + int64(p.Offset)
+}
+
+// comparePositions returns -1, 0 or 1 as a is before, at or after b
+func comparePositions(a, b Position) int {
+	switch {
+	case a.SegmentId != b.SegmentId:
+		return cmpInt(a.SegmentId, b.SegmentId)
+	case a.BlockId != b.BlockId:
+		return cmpInt(a.BlockId, b.BlockId)
+	default:
+		return cmpInt(a.Offset, b.Offset)
+	}
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// StreamRange copies the records from from up to, but excluding, to into
+// dst, or up to the end of the WAL if to is nil. If the active segment of
+// dst has the id of the segment of from and ends where the range starts or
+// is empty, e.g. dst is a new WAL opened with Options.StartSegmentId, and
+// both use the same segment format, the bytes of the segments are copied as
+// is, so that the records keep their positions, block padding, checkpoints
+// and tombstones included. Into an empty segment the records before from
+// in its segment are copied along. Otherwise the records are written to dst
+// one by one at new positions, leaving out checkpoint and tombstoned
+// records. dst is flushed but not synced.
+func (w *WAL) StreamRange(from, to *Position, dst *WAL) error {
+	if dst == w {
+		return errors.New("cannot stream a range of the WAL into itself")
+	}
+	if dst.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if w.isClosed() || dst.isClosed() {
+		return ErrClosed
+	}
+	if !w.opts.ReadOnly {
+		if err := w.segment.flushBlock(false); err != nil {
+			return err
+		}
+	}
+
+	end := w.segment.positionAt(w.segment.flushedSize())
+	if to != nil {
+		if comparePositions(*to, end) > 0 {
+			return fmt.Errorf("range end %+v is beyond the end of the WAL", *to)
+		}
+		end = *to
+	}
+	if comparePositions(*from, end) > 0 {
+		return fmt.Errorf("range start %+v is after its end %+v", *from, end)
+	}
+	var segments []*Segment
+	for id := from.SegmentId; id <= end.SegmentId; id++ {
+		seg, ok := w.lookupSegment(id)
+		if !ok {
+			return fmt.Errorf("segment %d not found", id)
+		}
+		segments = append(segments, seg)
+	}
+
+	dstEnd := dst.segment.positionAt(dst.segment.Size())
+	var err error
+	if dst.canCopyRaw(*from, segments) {
+		err = dst.copyRaw(end, segments)
+	} else {
+		err = dst.copyRecords(*from, end, segments)
+	}
+	if ferr := dst.segment.flushBlock(false); err == nil {
+		err = ferr
+	}
+	dst.notifyFlushed()
+	if err != nil {
+		return err
+	}
+
+	// Update what dst derives from its records
+	if err := dst.rebuildKeys(); err != nil {
+		return err
+	}
+	if dst.opts.HashChain {
+		dst.chainHash = [chainHashSize]byte{}
+		if err := dst.loadChainHash(); err != nil {
+			return err
+		}
+	}
+	if dst.seqIndex != nil {
+		dst.seqIndex.positions = dst.seqIndex.positions[:dst.seqIndex.search(dstEnd)]
+		return dst.scanSeqIndex(dstEnd)
+	}
+	return nil
+}
+
+// canCopyRaw reports whether the bytes of segments, starting at from, can be
+// appended to w as is
+func (w *WAL) canCopyRaw(from Position, segments []*Segment) bool {
+	active := w.segment
+	start := max(segments[0].fileOffset(from), int64(segments[0].dataStart))
+	if active.Id() != from.SegmentId || !active.empty() && active.Size() != start {
+		return false
+	}
+	for i, seg := range segments {
+		if seg.legacy() || seg.singleRecord() || seg.header.layout != w.opts.ChunkLayout ||
+			seg.header.checksum != w.opts.checksum() || seg.chained() != w.opts.HashChain || seg.blockSize != w.opts.BlockSize {
+			return false
+		}
+		if i == 0 && (active.chunkFormat() != seg.chunkFormat() || active.header.flags != seg.header.flags ||
+			active.dataStart != seg.dataStart || active.blockSize != seg.blockSize) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyRaw appends the bytes of segments up to end to the segments of w with
+// the same ids
+func (w *WAL) copyRaw(end Position, segments []*Segment) error {
+	buf := make([]byte, w.opts.BlockSize)
+	for i, seg := range segments {
+		if i > 0 {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+		lo := int64(seg.dataStart)
+		if i == 0 {
+			lo = w.segment.Size() // The start of the range or of the segment
+		}
+		hi := seg.flushedSize()
+		if seg.Id() == end.SegmentId {
+			hi = seg.fileOffset(end)
+		}
+		fd, err := seg.file()
+		if err != nil {
+			return err
+		}
+		for lo < hi {
+			n, err := fd.ReadAt(buf[:min(int64(len(buf)), hi-lo)], lo)
+			if n > 0 {
+				if werr := w.segment.appendRaw(buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err != nil && !(err == io.EOF && lo+int64(n) == hi) {
+				return fmt.Errorf("segment %d: %w", seg.Id(), err)
+			}
+			lo += int64(n)
+		}
+	}
+	return nil
+}
+
+// copyRecords writes the records of segments between from and end to w
+func (w *WAL) copyRecords(from, end Position, segments []*Segment) error {
+	for i, seg := range segments {
+		pos := Position{SegmentId: seg.Id()}
+		if i == 0 {
+			pos = from
+		}
+		for {
+			data, at, next, err := seg.readNext(pos)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("segment %d: %w", seg.Id(), err)
+			}
+			if comparePositions(at, end) >= 0 {
+				return nil
+			}
+			if _, err := w.write(data, 0); err != nil {
+				return err
+			}
+			pos = next
+		}
+	}
+	return nil
+}
+
+// appendRaw appends bytes copied from another segment at the same offset
+func (s *Segment) appendRaw(data []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	for len(data) > 0 {
+		n := min(len(data), s.blockSize-len(s.currentBlock.data))
+		s.currentBlock.data = append(s.currentBlock.data, data[:n]...)
+		data = data[n:]
+		if len(s.currentBlock.data) == s.blockSize {
+			if err := s.flushBlock(false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
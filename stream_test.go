@@ -0,0 +1,68 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_StreamRange(t *testing.T) {
+	src, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64 * KB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer src.Close()
+	var positions []*Position
+	for i := 0; i < 2000; i++ {
+		pos, err := src.Write([]byte(fmt.Sprintf("record %d %0100d", i, i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	from, to := positions[700], positions[1800]
+	assert.Less(t, from.SegmentId, to.SegmentId)
+
+	// A backup continuing at the segment of the range keeps the positions
+	backup, err := Open(Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    64 * KB,
+		SyncInterval:   1 * time.Hour,
+		StartSegmentId: from.SegmentId,
+	})
+	assert.NoError(t, err)
+	defer backup.Close()
+	assert.NoError(t, src.StreamRange(from, to, backup))
+	for i := 700; i < 1800; i++ {
+		data, err := backup.Read(positions[i])
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d %0100d", i, i), string(data))
+	}
+
+	// The next increment continues where the previous one ended
+	assert.NoError(t, src.StreamRange(to, nil, backup))
+	data, err := backup.Read(positions[1999])
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("record %d %0100d", 1999, 1999), string(data))
+	report, err := backup.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+
+	// Any other WAL gets the records at new positions
+	other, err := Open(Options{Directory: t.TempDir(), SegmentSize: 1 * GB, SyncInterval: 1 * time.Hour})
+	assert.NoError(t, err)
+	defer other.Close()
+	assert.NoError(t, src.StreamRange(from, to, other))
+	r, err := other.NewReader(&Position{})
+	assert.NoError(t, err)
+	for i := 700; i < 1800; i++ {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d %0100d", i, i), string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
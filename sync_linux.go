@@ -0,0 +1,36 @@
+package wal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// oDSync is the open flag that makes every write durable, see SyncDsync
+const oDSync = syscall.O_DSYNC
+
+// fdatasync flushes the data of f to disk along with the metadata needed to
+// read it back, like its size, but not e.g. its modification time. Files of
+// a custom FS, which do not expose their descriptor, are fsynced.
+func fdatasync(f File) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return f.Sync()
+	}
+	return syscall.Fdatasync(int(fd.Fd()))
+}
+
+// preallocate reserves the disk space for the first size bytes of f without
+// changing its size. It does nothing for files of a custom FS or on file
+// systems that cannot reserve space.
+func preallocate(f File, size int64) error {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	const keepSize = 0x01 // FALLOC_FL_KEEP_SIZE
+	err := syscall.Fallocate(int(fd.Fd()), keepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_PreallocateSegments(t *testing.T) {
+	opts := Options{
+		Directory:           t.TempDir(),
+		SegmentSize:         1 * MB,
+		SyncInterval:        1 * time.Hour,
+		PreallocateSegments: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos, err := wal.WriteSync([]byte("record"))
+	assert.NoError(t, err)
+
+	// The space is reserved, the size of the file is that of its data
+	info, err := os.Stat(filepath.Join(opts.Directory, defaultPathFor(wal.segment.Id())))
+	assert.NoError(t, err)
+	assert.Equal(t, wal.segment.Size(), info.Size())
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks > 0 {
+		assert.GreaterOrEqual(t, blocks*512, opts.SegmentSize, "the segment size is reserved")
+	}
+
+	// Recovery only sees the records written
+	assert.NoError(t, wal.Close())
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	start := *pos
+	reader, err := wal.NewReader(&start)
+	assert.NoError(t, err)
+	defer reader.Close()
+	data, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "record", string(data))
+	_, err = reader.Next()
+	assert.Error(t, err)
+	data, err = wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, "record", string(data))
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package wal
+
+// oDSync is not supported on this platform, SyncDsync fsyncs instead.
+const oDSync = 0
+
+// fdatasync is not supported on this platform, f is fsynced instead.
+func fdatasync(f File) error {
+	return f.Sync()
+}
+
+// preallocate is not supported on this platform.
+func preallocate(f File, size int64) error {
+	return nil
+}
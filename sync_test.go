@@ -0,0 +1,51 @@
+package wal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL_SyncMethod(t *testing.T) {
+	for name, method := range map[string]SyncMethod{"fsync": SyncFsync, "fdatasync": SyncFdatasync, "dsync": SyncDsync} {
+		t.Run(name, func(t *testing.T) {
+			opts := Options{
+				Directory:      t.TempDir(),
+				SegmentSize:    4 * KB,
+				SyncInterval:   1 * time.Hour,
+				BlockSize:      1 * KB,
+				SyncMethod:     method,
+				AllowOverwrite: true,
+			}
+			wal, err := Open(opts)
+			assert.NoError(t, err)
+
+			var positions []*Position
+			var records []string
+			for i := 0; i < 50; i++ {
+				record := fmt.Sprintf("record %d %s", i, make([]byte, i*10))
+				pos, err := wal.WriteSync([]byte(record))
+				assert.NoError(t, err)
+				positions = append(positions, pos)
+				records = append(records, record)
+			}
+			assert.Greater(t, wal.segment.Id(), 1)
+			replaced := []byte(records[1])
+			copy(replaced, "REPLACED")
+			records[1] = string(replaced)
+			assert.NoError(t, wal.Overwrite(positions[1], replaced))
+			assert.NoError(t, wal.Close())
+
+			wal, err = Open(opts)
+			assert.NoError(t, err)
+			defer wal.Close()
+			for i, pos := range positions {
+				data, err := wal.Read(pos)
+				assert.NoError(t, err)
+				assert.Equal(t, records[i], string(data))
+			}
+		})
+	}
+}
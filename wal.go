@@ -1,130 +1,1643 @@
 package wal
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	sp "github.com/ongniud/slice-pool"
+)
+
+// Error constants
+var (
+	ErrLowSpace          = errors.New("free disk space is below the configured minimum")
+	ErrOverwriteDisabled = errors.New("overwrite is not allowed, see Options.AllowOverwrite")
+	ErrCRCMismatch       = errors.New("the record does not match the expected crc")
+	ErrWriteShed         = errors.New("write shed, the WAL is busy beyond Options.MaxWriteLatency")
+	ErrBlockSizeMismatch = errors.New("the segment block size differs from Options.BlockSize")
+	ErrDuplicateSegment  = errors.New("segment files with the same id in several directories")
+)
+
+// spaceCheckInterval bounds how often the free space of the log directory is
+// queried when Options.MinFreeBytes is set.
+const spaceCheckInterval = time.Second
+
+type WAL struct {
+	opts     Options
+	segment  *Segment
+	segments map[int]*Segment
+	closeC   chan struct{}
+	ticker   *time.Ticker
+	paused   bool          // Whether the background sync is paused
+	flushedC chan struct{} // Closed and replaced whenever buffered data is flushed
+	mu       sync.RWMutex
+
+	stats       ioStats
+	epoch       uint64              // Epoch stamped into new segments
+	readLimiter *rateLimiter        // Limits reads to Options.ReadRateLimit
+	blockCache  *blockCache         // Blocks read by all segments, nil without Options.BlockCacheSize
+	chainHash   [chainHashSize]byte // Chain hash of the last chained record
+	keys        map[string]Position // Latest keyed record per key, nil without Options.KeyIndex
+	seqIndex    *seqIndex           // Positions by sequence number, nil without Options.SequenceIndex
+	pool        *sp.SlicePool[byte] // Buffers of records and chunk headers, see Options.PoolMax
+	committer   *committer          // Group commit of synced writes, nil if disabled
+	appended    []*Future           // Futures of the records appended since the last sync of syncAppends
+	appendC     chan struct{}       // Wakes up syncAppends
+	closeErr    error               // Result of Close, for the futures it resolves
+	fenced      bool                // Whether a writer with a higher fencing token opened the WAL
+	frozenAt    *Position           // End of the WAL when it was frozen, nil unless frozen
+	repair      *RepairReport       // What Options.RepairOnOpen discarded, nil if nothing
+	syncErr     error               // Result of the latest sync of the active segment, see LastSyncError
+	batching    bool                // Whether WriteAtomicBatch is writing, keeping the batch in one segment
+	tasks       []*schedTask        // Tasks registered with Options.BackgroundScheduler
+	syncTask    *schedTask          // The background sync among tasks
+	appendTask  *schedTask          // The sync of appended records among tasks
+
+	hooks    []func(pos *Position, data []byte) // See RegisterHook
+	hookC    chan struct{}                      // Wakes up runHooks, nil until a hook is registered
+	unsynced []hookRecord                       // Records for the hooks waiting for a sync
+	synced   []hookRecord                       // Synced records the hooks were not called with yet
+
+	freeSpace      func(dir string) (uint64, error)
+	spaceCheckedAt time.Time
+	spaceLow       bool
+
+	archivedTo  int           // Id of the first segment not archived, see Options.Archiver
+	archiveC    chan struct{} // Wakes up archiveSegments
+	archiveTask *schedTask    // The archival among tasks
+}
+
+type Options struct {
+	// Directory holds the segment files. Required unless Directories is set.
+	Directory string
+	// Directories spreads the segment files across several directories,
+	// e.g. on different mount points. New segments are placed round-robin
+	// by id and Directory, which also holds the consumer offsets, defaults
+	// to the first entry.
+	Directories []string
+	// SegmentSize is the size at which the active segment is rotated. Required.
+	SegmentSize int64
+	// SyncInterval is the period of the background sync. Zero disables the
+	// background sync, leaving it to the caller to call Sync.
+	SyncInterval time.Duration
+	// SyncPolicy is when written records are fsynced, see SyncPolicy.
+	// Defaults to SyncInterval, the background sync.
+	SyncPolicy SyncPolicy
+	// SyncMethod is how the segment files are synced, see SyncMethod.
+	// Defaults to SyncFsync.
+	SyncMethod SyncMethod
+	// PreallocateSegments reserves the disk space of SegmentSize bytes when
+	// a segment file is created, so that appends do not allocate blocks and
+	// syncs have less metadata to flush, which steadies the write latency.
+	// The reserved space does not count towards the size of the file. It is
+	// only supported on linux and ignored where the file system cannot
+	// reserve space.
+	PreallocateSegments bool
+
+	// ChecksumSampleRate verifies the CRC of only one in every
+	// ChecksumSampleRate chunks on read. Which chunks are checked depends on
+	// their position only, so the same chunks are always verified. Values
+	// above 1 weaken corruption detection: a damaged chunk that is not
+	// sampled is returned to the caller as is. Zero or 1 verifies every chunk.
+	ChecksumSampleRate int
+
+	// MaxChunksPerRecord makes reads fail with ErrRecordTooLong once a
+	// record turns out to span more chunks than this, which bounds the
+	// blocks visited for a corrupted or pathologically large record. Zero
+	// means no limit.
+	MaxChunksPerRecord int
+
+	// AllowOverwrite enables Overwrite and Tombstone, which deliberately
+	// break the append-only model by rewriting records in place.
+	AllowOverwrite bool
+
+	// FlushOnRead makes Read flush the buffered block of the active segment
+	// to the file (without fsync) before reading from it, so that records
+	// can be read back right after Write without calling Sync.
+	FlushOnRead bool
+
+	// ReadOnly opens an existing WAL for reading only. The directory is not
+	// created, segment files are opened O_RDONLY and no background sync is
+	// started, so a WAL can be read from an immutable mount. Writes return
+	// ErrReadOnly.
+	ReadOnly bool
+
+	// FS is the file system the segments are stored in. Defaults to the
+	// operating system's file system.
+	FS FS
+
+	// PathFor returns the path of the segment file with the given id,
+	// relative to its directory, e.g. "00/seg_0000000042.wal". Intermediate
+	// directories are created as needed. Defaults to "seg_<id>.log".
+	PathFor func(id int) string
+	// ParsePath is the inverse of PathFor, used to discover the segment files
+	// under the directories. It reports false for paths that are no segment.
+	// Required along with PathFor; the default matches the default PathFor.
+	ParsePath func(path string) (id int, ok bool)
+
+	// ArchiveDirectory, when set, receives purged segments instead of them
+	// being deleted. Segments missing from Directory are looked up there, so
+	// archived records stay readable.
+	ArchiveDirectory string
+	// Archiver, when set, uploads every sealed segment in the background,
+	// in order of their ids, and records the segments archived in a file of
+	// Directory. Purge deletes a segment once it is archived, uploading it
+	// and the segments before it first if need be. Reads of purged segments
+	// fetch them from the Archiver into ArchiveDirectory, which is required
+	// and serves as a local cache that retention and Purge clear again.
+	// Failed uploads are reported to ErrorHandler and retried with the next
+	// rotation.
+	Archiver Archiver
+
+	// RetentionFunc is called after every rotation with the segments of the
+	// WAL ordered by id. The segments whose ids it returns are purged, see
+	// Purge. The active segment must not be returned.
+	RetentionFunc func(segments []SegmentInfo) (purgeIds []int)
+
+	// MaxSegments, MaxTotalSize and MaxAge limit the segments kept by the
+	// WAL. After every rotation the oldest sealed segments are purged, see
+	// Purge, while there are more than MaxSegments segments or they take
+	// more than MaxTotalSize bytes in total, the active segment included.
+	// With MaxAge a background janitor also purges the oldest segments
+	// sealed at least MaxAge ago. Zero disables a limit, the active segment
+	// is never purged.
+	MaxSegments  int
+	MaxTotalSize int64
+	MaxAge       time.Duration
+
+	// Epoch is an application defined epoch, e.g. a Raft term, stamped into
+	// the header of every segment created. It can be changed with SetEpoch
+	// and is reported by SegmentInfo.Epoch.
+	Epoch uint64
+
+	// RotateOnEpochChange makes SetEpoch rotate the active segment when the
+	// epoch changes, so that every segment holds records of a single epoch.
+	RotateOnEpochChange bool
+
+	// MinFreeBytes rejects writes with ErrLowSpace once the free space of
+	// the directory of the active segment drops below this many bytes. Zero
+	// disables the check.
+	MinFreeBytes uint64
+
+	// ScrubInterval enables a background scrubber that verifies one sealed
+	// segment per interval with QuickVerify, going round-robin over them, to
+	// detect bit rot early. Zero disables the scrubber.
+	ScrubInterval time.Duration
+	// ScrubBytesPerSecond limits the rate the scrubber reads at. Defaults to
+	// DefaultScrubBytesPerSecond.
+	ScrubBytesPerSecond int64
+	// OnScrubError is called by the scrubber with the id of a segment that
+	// failed verification. By default the error is passed to ErrorHandler.
+	OnScrubError func(segmentId int, err error)
+	// ErrorHandler is called with the errors of the background work, like
+	// a failing background sync, which no caller would see otherwise. It is
+	// not called with the lock held, so it may use the WAL. By default the
+	// errors are dropped, LastSyncError still reports a failing sync.
+	ErrorHandler func(err error)
+
+	// ReadRateLimit limits the rate, in bytes per second, blocks are read
+	// from the segment files at, so that scans like replays don't starve the
+	// foreground workload. The limit applies to Readers and iterators, and
+	// to Read unless ExemptReadFromRateLimit is set. Zero means no limit.
+	ReadRateLimit int64
+	// ExemptReadFromRateLimit lets Read proceed without waiting for the
+	// read rate limit. The blocks it reads still count towards the limit.
+	ExemptReadFromRateLimit bool
+
+	// ChunkLayout is the order of the chunk header fields in new segments.
+	// Existing segments keep the layout recorded in their header. Defaults
+	// to LayoutCRCFirst.
+	ChunkLayout ChunkLayout
+
+	// ChecksumType is the checksum of the chunks in new segments. Stronger
+	// checksums make the chunk headers larger. Existing segments keep the
+	// checksum type recorded in their header. Defaults to ChecksumCRC32.
+	ChecksumType ChecksumType
+
+	// Compression compresses the records written, before they are split
+	// into chunks. Records that do not get smaller are stored as they are,
+	// and readers decompress records by the mark in their chunk headers.
+	// It cannot be combined with AllowOverwrite or SingleRecordSegments.
+	// Defaults to CompressionNone.
+	Compression Compression
+
+	// NoChecksum stores new chunks without a checksum and reads them back
+	// unverified, saving the CRC computation for scratch WALs whose
+	// corruption does not matter. Such segments are marked in their header
+	// and read unverified by every WAL, Verify and the scrubber included.
+	// It cannot be combined with a ChecksumType.
+	NoChecksum bool
+
+	// HashChain stores every record with a chain hash, the SHA-256 of the
+	// chain hash of the record before it and its own payload, so that a
+	// modified, removed or reordered record is detected by VerifyChain.
+	// Checkpoint records are not chained. It cannot be combined with
+	// AllowOverwrite.
+	HashChain bool
+
+	// SegmentIdleTimeout closes the file of a sealed segment once it was not
+	// read for this long and drops its cached block. The file is reopened
+	// transparently when the segment is read again. Zero keeps the files of
+	// all segments open.
+	SegmentIdleTimeout time.Duration
+
+	// MaxOpenSegments limits the number of sealed segments whose file is
+	// kept open, so that a WAL with many segments does not exhaust the file
+	// descriptors. Their files are closed once the segments were loaded by
+	// Open and reopened when they are read; beyond the limit the least
+	// recently used ones are closed again. Zero keeps the files of all
+	// segments open.
+	MaxOpenSegments int
+
+	// MmapSealedSegments memory-maps the files of sealed segments and reads
+	// their blocks from the mapping rather than seeking and reading the
+	// shared file, saving the syscalls and the copy of every block read.
+	// The mapping is dropped along with the file, see SegmentIdleTimeout and
+	// MaxOpenSegments. Files that cannot be mapped, e.g. those of a custom
+	// FS or on platforms other than linux and darwin, are read as usual.
+	MmapSealedSegments bool
+
+	// BlockCacheSize enables a cache of this many bytes of blocks shared by
+	// all segments, which keeps the blocks read last in memory and evicts
+	// the least recently used ones. It serves rereads of blocks that no
+	// longer change: those of sealed segments and the complete blocks of
+	// the active one. Zero leaves each segment caching only the block it
+	// read last.
+	BlockCacheSize int64
+
+	// MaxCommitDelay enables group commit: records written with Synced
+	// durability share an fsync with the records arriving up to this much
+	// later. The delay adapts to the load, records arriving further apart
+	// than MaxCommitDelay are synced right away. Zero syncs every such
+	// record on its own.
+	MaxCommitDelay time.Duration
+
+	// NoSplit stores every record as a single chunk, so that it can be read
+	// with a single ReadAt. A record that does not fit in the rest of the
+	// block starts a new block, and records larger than a block are
+	// rejected with ErrRecordTooLarge.
+	NoSplit bool
+
+	// MaxWriteLatency bounds how long Write and WriteLevel wait for the WAL
+	// while it is busy, e.g. behind a slow sync. Writes that cannot start
+	// within it fail with ErrWriteShed and leave the WAL unchanged. A write
+	// that started is not interrupted. Zero waits indefinitely.
+	MaxWriteLatency time.Duration
+
+	// SequenceIndex numbers the records from 0 in write order, checkpoint
+	// records excluded, and keeps the position of each in the index file
+	// index.wal in Directory, synced along with the active segment. It
+	// enables ReadBySeq, ReadN and a fast Reader.Skip. On Open the index is
+	// checked against the segments and rebuilt if it does not match. The
+	// entries of purged records are dropped, unless their segments are
+	// archived, see ArchiveDirectory. It cannot be combined with
+	// AllowOverwrite.
+	SequenceIndex bool
+
+	// KeyIndex keeps the position of the latest record of every key written
+	// with WriteKeyed in memory, which enables Get. It is built on Open by
+	// replaying the records of all segments.
+	KeyIndex bool
+
+	// PoolMin, PoolMax and PoolFactor size the pool of the buffers the WAL
+	// builds records and chunk headers in: it holds buffers of PoolMin
+	// bytes, growing by PoolFactor up to PoolMax bytes. Larger buffers are
+	// not reused. All zero uses the shared default pool of 16 to 1024
+	// bytes. Only records the WAL assembles take their buffer from the
+	// pool: batches written as one record, keyed, hash chained and
+	// compressed records. Write copies other records into the block
+	// directly, so raising PoolMax only helps large records of those kinds.
+	PoolMin    int
+	PoolMax    int
+	PoolFactor int
+
+	// SingleRecordSegments stores every record in a segment of its own, as
+	// is behind a small header of its length and CRC, without chunk framing
+	// or block padding. It suits large objects, e.g. a blob store: Write
+	// always starts a new segment and Read reads the record with a single
+	// read. Checkpoint and keyed records are not supported. It cannot be
+	// combined with HashChain or AllowOverwrite.
+	SingleRecordSegments bool
+
+	// StartSegmentId is the id of the first segment of a new WAL, e.g. of a
+	// backup continuing the segments of another WAL, see StreamRange.
+	StartSegmentId int
+
+	// BlockSize is the size of the blocks records are framed in, a power of
+	// two from 64 bytes to 64KB. Small blocks waste less padding on small
+	// records, large ones split fewer records. Every segment records its
+	// block size, and Open rejects a directory holding segments with
+	// another block size. Defaults to 32KB.
+	BlockSize int
+
+	// FencingToken guards against a writer that lost the ownership of the
+	// WAL, e.g. after a failover, and keeps writing. Open fails with
+	// ErrFenced if the WAL was opened with a higher token before, and
+	// otherwise stores the token in the file fence in Directory and stamps
+	// it into new segments. A WAL whose token was superseded fails its
+	// writes, syncs and rotations with ErrFenced and is closed without
+	// flushing. Buffered data may still reach the segment files when a
+	// block fills up. Zero disables the checks while the WAL is open.
+	FencingToken uint64
+
+	// RepairOnOpen scans the active segment when the WAL is opened and cuts
+	// it after its last intact record if a crash left a torn or corrupt
+	// tail behind, so that reads and replays do not fail on it and new
+	// records are appended cleanly. See WAL.RepairReport for what was
+	// discarded.
+	RepairOnOpen bool
+
+	// BackgroundScheduler runs the background sync, scrubbing, the release
+	// of idle segments and the syncs of Append on the goroutines of a
+	// Scheduler, which can be shared by many WALs to bound the number of
+	// goroutines, instead of on goroutines of the WAL's own. The group
+	// commit of MaxCommitDelay keeps its own goroutine.
+	BackgroundScheduler *Scheduler
+
+	// FormatID identifies the application or schema of the records, so that
+	// a process pointed at the directory of another WAL does not open it.
+	// It is recorded in the file format in Directory when the WAL is first
+	// opened with a non-zero FormatID, and Open fails with
+	// ErrFormatMismatch once it differs from the recorded one.
+	FormatID [4]byte
+}
+
+// SegmentInfo describes a segment of the WAL
+type SegmentInfo struct {
+	Id     int
+	Path   string
+	Size   int64
+	Active bool   // Whether the segment is the one being written to
+	Epoch  uint64 // Epoch the segment was created in, see Options.Epoch
+}
+
+// Validate checks the options for invalid values and combinations. Zero
+// values are valid where a default is documented.
+func (o Options) Validate() error {
+	switch {
+	case o.Directory == "" && len(o.Directories) == 0:
+		return errors.New("invalid options: Directory is required")
+	case o.StartSegmentId < 0:
+		return fmt.Errorf("invalid options: StartSegmentId must not be negative, got %d", o.StartSegmentId)
+	case o.BlockSize != 0 && (o.BlockSize < minBlockSize || o.BlockSize > maxBlockSize || o.BlockSize&(o.BlockSize-1) != 0):
+		return fmt.Errorf("invalid options: BlockSize must be a power of two from %d to %d, got %d", minBlockSize, maxBlockSize, o.BlockSize)
+	case o.SegmentSize <= 0:
+		return fmt.Errorf("invalid options: SegmentSize must be positive, got %d", o.SegmentSize)
+	case o.SyncInterval < 0:
+		return fmt.Errorf("invalid options: SyncInterval must not be negative, got %v", o.SyncInterval)
+	case o.SyncPolicy < SyncInterval || o.SyncPolicy > SyncAlways:
+		return fmt.Errorf("invalid options: unknown SyncPolicy %d", o.SyncPolicy)
+	case o.SyncMethod < SyncFsync || o.SyncMethod > SyncDsync:
+		return fmt.Errorf("invalid options: unknown SyncMethod %d", o.SyncMethod)
+	case o.ChecksumSampleRate < 0:
+		return fmt.Errorf("invalid options: ChecksumSampleRate must not be negative, got %d", o.ChecksumSampleRate)
+	case o.MaxChunksPerRecord < 0:
+		return fmt.Errorf("invalid options: MaxChunksPerRecord must not be negative, got %d", o.MaxChunksPerRecord)
+	case o.ReadOnly && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with ReadOnly")
+	case o.ReadOnly && o.RepairOnOpen:
+		return errors.New("invalid options: RepairOnOpen cannot be combined with ReadOnly")
+	case o.HashChain && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with HashChain")
+	case o.SingleRecordSegments && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with SingleRecordSegments")
+	case o.SingleRecordSegments && o.HashChain:
+		return errors.New("invalid options: HashChain cannot be combined with SingleRecordSegments")
+	case o.SingleRecordSegments && o.ChecksumType != ChecksumCRC32:
+		return errors.New("invalid options: SingleRecordSegments only support ChecksumCRC32")
+	case o.SequenceIndex && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with SequenceIndex")
+	case o.ArchiveDirectory != "" && filepath.Clean(o.ArchiveDirectory) == filepath.Clean(o.Directory):
+		return errors.New("invalid options: ArchiveDirectory must differ from Directory")
+	case o.Archiver != nil && o.ArchiveDirectory == "":
+		return errors.New("invalid options: Archiver requires ArchiveDirectory to cache fetched segments")
+	case o.Archiver != nil && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with Archiver")
+	case o.ChunkLayout > LayoutLengthFirst:
+		return fmt.Errorf("invalid options: unknown ChunkLayout %d", o.ChunkLayout)
+	case o.ChecksumType > ChecksumCRC64:
+		return fmt.Errorf("invalid options: unknown ChecksumType %d", o.ChecksumType)
+	case o.Compression > CompressionZstd:
+		return fmt.Errorf("invalid options: unknown Compression %d", o.Compression)
+	case o.Compression != CompressionNone && o.AllowOverwrite:
+		return errors.New("invalid options: AllowOverwrite cannot be combined with Compression")
+	case o.Compression != CompressionNone && o.SingleRecordSegments:
+		return errors.New("invalid options: Compression cannot be combined with SingleRecordSegments")
+	case o.NoChecksum && o.ChecksumType != ChecksumCRC32:
+		return errors.New("invalid options: NoChecksum cannot be combined with a ChecksumType")
+	case o.NoChecksum && o.SingleRecordSegments:
+		return errors.New("invalid options: NoChecksum cannot be combined with SingleRecordSegments")
+	case o.ReadRateLimit < 0:
+		return fmt.Errorf("invalid options: ReadRateLimit must not be negative, got %d", o.ReadRateLimit)
+	case o.MaxWriteLatency < 0:
+		return fmt.Errorf("invalid options: MaxWriteLatency must not be negative, got %v", o.MaxWriteLatency)
+	case o.MaxCommitDelay < 0:
+		return fmt.Errorf("invalid options: MaxCommitDelay must not be negative, got %v", o.MaxCommitDelay)
+	case o.SegmentIdleTimeout < 0:
+		return fmt.Errorf("invalid options: SegmentIdleTimeout must not be negative, got %v", o.SegmentIdleTimeout)
+	case o.BlockCacheSize < 0:
+		return fmt.Errorf("invalid options: BlockCacheSize must not be negative, got %d", o.BlockCacheSize)
+	case o.MaxOpenSegments < 0:
+		return fmt.Errorf("invalid options: MaxOpenSegments must not be negative, got %d", o.MaxOpenSegments)
+	case o.MaxSegments < 0 || o.MaxTotalSize < 0 || o.MaxAge < 0:
+		return fmt.Errorf("invalid options: MaxSegments, MaxTotalSize and MaxAge must not be negative, got %d, %d and %v", o.MaxSegments, o.MaxTotalSize, o.MaxAge)
+	case o.ScrubInterval < 0:
+		return fmt.Errorf("invalid options: ScrubInterval must not be negative, got %v", o.ScrubInterval)
+	case o.ScrubBytesPerSecond < 0:
+		return fmt.Errorf("invalid options: ScrubBytesPerSecond must not be negative, got %d", o.ScrubBytesPerSecond)
+	case o.PoolMin < 0 || o.PoolMax < 0 || o.PoolFactor < 0:
+		return fmt.Errorf("invalid options: PoolMin, PoolMax and PoolFactor must not be negative, got %d, %d and %d", o.PoolMin, o.PoolMax, o.PoolFactor)
+	case o.PoolMax != 0 && o.PoolMin > o.PoolMax:
+		return fmt.Errorf("invalid options: PoolMin must not exceed PoolMax, got %d and %d", o.PoolMin, o.PoolMax)
+	case o.PoolFactor == 1:
+		return errors.New("invalid options: PoolFactor must be at least 2")
+	case (o.PathFor == nil) != (o.ParsePath == nil):
+		return errors.New("invalid options: PathFor and ParsePath must be set together")
+	}
+	for _, dir := range o.Directories {
+		switch {
+		case dir == "":
+			return errors.New("invalid options: Directories must not contain an empty path")
+		case o.ArchiveDirectory != "" && filepath.Clean(o.ArchiveDirectory) == filepath.Clean(dir):
+			return errors.New("invalid options: ArchiveDirectory must differ from Directories")
+		}
+	}
+	return nil
+}
+
+// validate checks the options like Validate and returns them with the
+// zero values replaced by their defaults, the options Open works with
+func (o Options) validate() (Options, error) {
+	if err := o.Validate(); err != nil {
+		return Options{}, err
+	}
+	return o.withDefaults(), nil
+}
+
+// withDefaults returns a copy of the options with zero values replaced by
+// their defaults.
+func (o Options) withDefaults() Options {
+	if o.FS == nil {
+		o.FS = osFS{}
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = blockSize
+	}
+	if o.Directory == "" {
+		o.Directory = o.Directories[0]
+	}
+	if o.ScrubBytesPerSecond == 0 {
+		o.ScrubBytesPerSecond = DefaultScrubBytesPerSecond
+	}
+	if o.PoolMin != 0 || o.PoolMax != 0 || o.PoolFactor != 0 {
+		if o.PoolMin == 0 {
+			o.PoolMin = defaultPoolMin
+		}
+		if o.PoolMax == 0 {
+			o.PoolMax = max(defaultPoolMax, o.PoolMin)
+		}
+		if o.PoolFactor == 0 {
+			o.PoolFactor = defaultPoolFactor
+		}
+	}
+	if o.PathFor == nil {
+		o.PathFor = defaultPathFor
+		o.ParsePath = defaultParsePath
+	}
+	return o
+}
+
+// checksum returns the checksum type of new segments
+func (o Options) checksum() ChecksumType {
+	if o.NoChecksum {
+		return checksumNone
+	}
+	return o.ChecksumType
+}
+
+// preallocateSize returns the bytes reserved for new segment files, zero
+// for none. Single record segments are not filled up to SegmentSize.
+func (o Options) preallocateSize() int64 {
+	if !o.PreallocateSegments || o.ReadOnly || o.SingleRecordSegments {
+		return 0
+	}
+	return o.SegmentSize
+}
+
+// defaultPathFor names segment files seg_<id>.log
+func defaultPathFor(id int) string {
+	return fmt.Sprintf("seg_%d.log", id)
+}
+
+// defaultParsePath parses the segment file names of defaultPathFor
+func defaultParsePath(path string) (int, bool) {
+	var id int
+	if _, err := fmt.Sscanf(path, "seg_%d.log", &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// segmentDirs returns the directories holding the segment files
+func (o Options) segmentDirs() []string {
+	if len(o.Directories) > 0 {
+		return o.Directories
+	}
+	return []string{o.Directory}
+}
+
+func Open(opts Options) (_ *WAL, err error) {
+	opts, err = opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		opts:     opts,
+		segments: make(map[int]*Segment),
+		closeC:   make(chan struct{}),
+		flushedC: make(chan struct{}),
+		epoch:    opts.Epoch,
+
+		readLimiter: newRateLimiter(opts.ReadRateLimit, opts.BlockSize),
+		blockCache:  newBlockCache(opts.BlockCacheSize),
+		freeSpace:   diskFree,
+		pool:        bp,
+	}
+	if opts.PoolMax > 0 {
+		w.pool = sp.NewSlicePool[byte](opts.PoolMin, opts.PoolMax, opts.PoolFactor)
+	}
+	// Check the format id before initialize touches the segments
+	missingFormat, err := w.checkFormatID()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			w.releaseFiles()
+		}
+	}()
+	if err := w.initialize(); err != nil {
+		return nil, err
+	}
+	if missingFormat && opts.FormatID != [4]byte{} && !opts.ReadOnly {
+		if err := w.writeFormatID(); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.ReadOnly {
+		if err := w.acquireFence(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RepairOnOpen {
+		if err := w.repairActive(); err != nil {
+			return nil, fmt.Errorf("failed to repair segment %d: %w", w.segment.Id(), err)
+		}
+	}
+	if !opts.ReadOnly {
+		if err := w.dropUncommittedBatch(); err != nil {
+			return nil, fmt.Errorf("failed to recover segment %d: %w", w.segment.Id(), err)
+		}
+	}
+	if opts.HashChain && !opts.ReadOnly {
+		if err := w.loadChainHash(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SequenceIndex {
+		if err := w.loadSeqIndex(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.KeyIndex {
+		if err := w.buildKeys(); err != nil {
+			return nil, fmt.Errorf("failed to build the key index: %w", err)
+		}
+	}
+	if opts.Archiver != nil {
+		if err := w.loadArchived(); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.ReadOnly && opts.MaxCommitDelay > 0 {
+		w.committer = newCommitter(opts.MaxCommitDelay)
+		go w.groupCommit()
+	}
+	if s := opts.BackgroundScheduler; s != nil {
+		w.scheduleTasks(s)
+		return w, nil
+	}
+	if !opts.ReadOnly && opts.SyncInterval > 0 && opts.SyncPolicy == SyncInterval {
+		w.ticker = time.NewTicker(opts.SyncInterval)
+		go w.periodicSync()
+	}
+	if opts.ScrubInterval > 0 {
+		go w.scrub()
+	}
+	if opts.SegmentIdleTimeout > 0 {
+		go w.releaseIdleSegments()
+	}
+	if !opts.ReadOnly && opts.MaxAge > 0 {
+		go w.retainSegments()
+	}
+	if !opts.ReadOnly {
+		w.appendC = make(chan struct{}, 1)
+		go w.syncAppends()
+	}
+	if !opts.ReadOnly && opts.Archiver != nil {
+		w.archiveC = make(chan struct{}, 1)
+		go w.archiveSegments()
+		w.triggerArchive() // Segments sealed before the WAL was opened
+	}
+	return w, nil
+}
+
+// scheduleTasks registers the background tasks of the WAL with s, in place
+// of the goroutines started without Options.BackgroundScheduler
+func (w *WAL) scheduleTasks(s *Scheduler) {
+	opts := w.opts
+	if !opts.ReadOnly && opts.SyncInterval > 0 && opts.SyncPolicy == SyncInterval {
+		w.syncTask = s.every(opts.SyncInterval, w.backgroundSync)
+		w.tasks = append(w.tasks, w.syncTask)
+	}
+	if opts.ScrubInterval > 0 {
+		next := 0
+		w.tasks = append(w.tasks, s.every(opts.ScrubInterval, func() { next = w.scrubNext(next) }))
+	}
+	if opts.SegmentIdleTimeout > 0 {
+		interval := max(opts.SegmentIdleTimeout/2, time.Millisecond)
+		w.tasks = append(w.tasks, s.every(interval, func() { w.releaseIdle(time.Now()) }))
+	}
+	if !opts.ReadOnly && opts.MaxAge > 0 {
+		w.tasks = append(w.tasks, s.every(opts.retentionInterval(), func() { w.retain(time.Now()) }))
+	}
+	if !opts.ReadOnly {
+		w.appendTask = s.onTrigger(w.syncAppended)
+		w.tasks = append(w.tasks, w.appendTask)
+	}
+	if !opts.ReadOnly && opts.Archiver != nil {
+		w.archiveTask = s.onTrigger(w.archiveSealed)
+		w.tasks = append(w.tasks, w.archiveTask)
+		w.triggerArchive()
+	}
+}
+
+func (w *WAL) initialize() error {
+	dirs := w.opts.segmentDirs()
+	if !w.opts.ReadOnly {
+		for _, dir := range append([]string{w.opts.Directory}, dirs...) {
+			if err := w.opts.FS.MkdirAll(dir, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create log directory: %w", err)
+			}
+		}
+		if w.opts.ArchiveDirectory != "" {
+			if err := w.opts.FS.MkdirAll(w.opts.ArchiveDirectory, os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create archive directory: %w", err)
+			}
+		}
+	}
+
+	segIds, segDirs, err := w.opts.findSegments()
+	if err != nil {
+		return err
+	}
+	if len(segIds) == 0 && w.opts.ReadOnly {
+		return fmt.Errorf("no segment found in %s", strings.Join(dirs, ", "))
+	}
+	if len(segIds) == 0 {
+		segId := w.opts.StartSegmentId
+		seg, err := w.openSegment(w.segmentDir(segId), segId)
+		if err != nil {
+			return err
+		}
+		w.segment = seg
+		w.segments[segId] = seg
+	} else {
+		for _, segId := range segIds {
+			seg, err := w.openSegment(segDirs[segId], segId)
+			if err != nil {
+				return err
+			}
+			if seg.blockSize != w.opts.BlockSize {
+				_ = seg.Close()
+				return fmt.Errorf("%w: segment %d uses %d bytes, configured %d", ErrBlockSizeMismatch, segId, seg.blockSize, w.opts.BlockSize)
+			}
+			seg.sealed = segId != segIds[len(segIds)-1]
+			w.segments[segId] = seg
+			if seg.sealed && w.opts.MaxOpenSegments > 0 {
+				if err := seg.release(); err != nil {
+					return err
+				}
+			}
+			if seg.sealed && w.opts.MaxAge > 0 {
+				// Sealed when it was written to last
+				if seg.sealedAt, err = modTime(w.opts.FS, seg.path); err != nil {
+					return err
+				}
+			}
+		}
+		w.segment = w.segments[segIds[len(segIds)-1]]
+	}
+
+	return nil
+}
+
+// findSegments returns the ids of the segment files in the segment
+// directories in ascending order, along with the directory of each
+func (o Options) findSegments() ([]int, map[int]string, error) {
+	var ids []int
+	dirs := make(map[int]string)
+	for _, dir := range o.segmentDirs() {
+		err := walkFiles(o.FS, dir, func(path string) error {
+			id, ok := o.ParsePath(path)
+			if !ok || filepath.Clean(o.PathFor(id)) != path {
+				return nil
+			}
+			if other, ok := dirs[id]; ok {
+				return fmt.Errorf("%w: segment %d is both %s and %s", ErrDuplicateSegment, id,
+					o.segmentPath(other, id), o.segmentPath(dir, id))
+			}
+			dirs[id] = dir
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Ints(ids)
+	return ids, dirs, nil
+}
+
+// segmentPath returns the path of the segment file with the given id in dir
+func (o Options) segmentPath(dir string, id int) string {
+	return filepath.Join(dir, o.PathFor(id))
+}
+
+// segmentDir returns the directory a new segment with the given id is
+// created in, going round-robin over the segment directories.
+func (w *WAL) segmentDir(id int) string {
+	dirs := w.opts.segmentDirs()
+	return dirs[id%len(dirs)]
+}
+
+// openSegment opens the segment file with the given id in dir and applies the
+// segment related options.
+func (w *WAL) openSegment(dir string, id int) (*Segment, error) {
+	path := w.opts.segmentPath(dir, id)
+	if !w.opts.ReadOnly {
+		if err := w.opts.FS.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	return newSegment(id, path, w.segmentOptions())
+}
+
+// segmentOptions returns the settings segments are opened with
+func (w *WAL) segmentOptions() segmentOptions {
+	return segmentOptions{
+		fs:                 w.opts.FS,
+		readOnly:           w.opts.ReadOnly,
+		checksumSampleRate: w.opts.ChecksumSampleRate,
+		maxChunks:          w.opts.MaxChunksPerRecord,
+		epoch:              w.epoch,
+		fence:              w.opts.FencingToken,
+		layout:             w.opts.ChunkLayout,
+		checksum:           w.opts.checksum(),
+		hashChain:          w.opts.HashChain,
+		compression:        w.opts.Compression,
+		noSplit:            w.opts.NoSplit,
+		blockSize:          w.opts.BlockSize,
+		singleRecord:       w.opts.SingleRecordSegments,
+		mmap:               w.opts.MmapSealedSegments,
+		syncMethod:         w.opts.SyncMethod,
+		preallocate:        w.opts.preallocateSize(),
+		stats:              &w.stats,
+		readLimiter:        w.readLimiter,
+		blockCache:         w.blockCache,
+		pool:               w.pool,
+	}
+}
+
+// lookupSegment returns the segment with the given id. Segments that are not
+// open are looked up in the archive directory and opened read-only, fetching
+// them from Options.Archiver if they are not there.
+func (w *WAL) lookupSegment(id int) (*Segment, bool) {
+	if seg, ok := w.segments[id]; ok {
+		if seg != w.segment {
+			// Make room for its file, a segment is released even if closing fails
+			_ = w.limitOpenSegments(seg)
+		}
+		return seg, true
+	}
+	if w.opts.ArchiveDirectory == "" {
+		return nil, false
+	}
+	opts := w.segmentOptions()
+	opts.readOnly = true
+	path := w.opts.segmentPath(w.opts.ArchiveDirectory, id)
+	seg, err := newSegment(id, path, opts)
+	if errors.Is(err, os.ErrNotExist) && w.opts.Archiver != nil && id < w.archivedTo {
+		if err = w.fetch(id, path); err == nil {
+			seg, err = newSegment(id, path, opts)
+		}
+	}
+	if err != nil {
+		return nil, false
+	}
+	w.segments[id] = seg
+	_ = w.limitOpenSegments(seg)
+	return seg, true
+}
+
+// Read reads the record at pos. The segment is resolved under the lock that
+// rotation and Purge hold as well, so a position in the active segment stays
+// readable while it is rotated concurrently: the segment is sealed but kept
+// in the WAL. Records still buffered in the active segment are only visible
+// with Options.FlushOnRead. Reads run concurrently with each other, see
+// lockRead, but not with writes.
+func (w *WAL) Read(pos *Position) ([]byte, error) {
+	if !w.opts.ExemptReadFromRateLimit {
+		w.readLimiter.wait(w.closeC)
+	}
+	seg, unlock, err := w.lockRead(pos)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return seg.Read(pos)
+}
+
+// ReadBuffer reads the record at pos like Read into a pooled buffer, see
+// Buffer.
+func (w *WAL) ReadBuffer(pos *Position) (*Buffer, error) {
+	if !w.opts.ExemptReadFromRateLimit {
+		w.readLimiter.wait(w.closeC)
+	}
+	seg, unlock, err := w.lockRead(pos)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return seg.ReadBuffer(pos)
+}
+
+// ReadContext reads the record at pos like Read, but gives up when ctx is
+// done and returns ctx.Err(). Only reading the segment file is abandoned,
+// the lock is released then, so a read stalled on a slow disk neither holds
+// up other callers nor outlives ctx. The abandoned read syscall may still
+// complete in the background.
+func (w *WAL) ReadContext(ctx context.Context, pos *Position) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !w.opts.ExemptReadFromRateLimit {
+		w.readLimiter.waitContext(ctx, w.closeC)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	seg, unlock, err := w.lockRead(pos)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return seg.readContext(ctx, pos)
+}
+
+// lockRead resolves the segment holding pos for a read and returns it with
+// the lock held, along with the function releasing the lock. Reads hold the
+// lock shared and run concurrently, serialized per segment by its own lock
+// only. They take the lock exclusively where resolving the segment changes
+// the WAL: to flush the active segment with Options.FlushOnRead, to open an
+// archived segment or to close other files with Options.MaxOpenSegments.
+func (w *WAL) lockRead(pos *Position) (*Segment, func(), error) {
+	w.mu.RLock()
+	seg, ok := w.segments[pos.SegmentId]
+	if ok && !w.readChanges(seg) {
+		return seg, w.mu.RUnlock, nil
+	}
+	w.mu.RUnlock()
+
+	w.mu.Lock()
+	seg, err := w.readSegment(pos)
+	if err != nil {
+		w.mu.Unlock()
+		return nil, nil, err
+	}
+	return seg, w.mu.Unlock, nil
+}
+
+// readChanges reports whether a read of seg changes the WAL, so that it
+// must hold the lock exclusively, see lockRead
+func (w *WAL) readChanges(seg *Segment) bool {
+	if seg == w.segment {
+		return w.opts.FlushOnRead
+	}
+	return w.opts.MaxOpenSegments > 0
+}
+
+// readSegment returns the segment holding pos for a read, flushing it first
+// with Options.FlushOnRead
+func (w *WAL) readSegment(pos *Position) (*Segment, error) {
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return nil, fmt.Errorf("segment %d not found", pos.SegmentId)
+	}
+	if w.opts.FlushOnRead && seg == w.segment {
+		if err := seg.flushBlock(false); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// ReadVerify reads the record at pos like Read and checks that the CRC-32
+// (IEEE) of its payload is expectedCRC. It returns ErrCRCMismatch if not,
+// meaning that pos holds another, intact record than the caller expected,
+// e.g. one of a later generation of the WAL. Corrupted chunks are reported
+// with ErrInvalidCRC as usual.
+func (w *WAL) ReadVerify(pos *Position, expectedCRC uint32) ([]byte, error) {
+	data, err := w.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	if crc := crc32.ChecksumIEEE(data); crc != expectedCRC {
+		return nil, fmt.Errorf("%w at %+v: got %08x, expected %08x", ErrCRCMismatch, *pos, crc, expectedCRC)
+	}
+	return data, nil
+}
+
+// Overwrite replaces the record at pos with data of exactly the same length.
+// It requires Options.AllowOverwrite and syncs the segment before returning.
+func (w *WAL) Overwrite(pos *Position, data []byte) error {
+	if !w.opts.AllowOverwrite {
+		return ErrOverwriteDisabled
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return errors.New("segment not found")
+	}
+	return seg.Overwrite(pos, data)
+}
+
+// Tombstone erases the record at pos in place, so reading it returns
+// ErrTombstoned and readers skip it. Like Overwrite it mutates the segment
+// file and requires Options.AllowOverwrite.
+func (w *WAL) Tombstone(pos *Position) error {
+	if !w.opts.AllowOverwrite {
+		return ErrOverwriteDisabled
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return errors.New("segment not found")
+	}
+	return seg.Tombstone(pos)
+}
+
+// RecordsInBlock returns every record that starts in the given block of a
+// segment along with its position, see Segment.RecordsInBlock.
+func (w *WAL) RecordsInBlock(segmentId, blockId int) ([]*Position, [][]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(segmentId)
+	if !ok {
+		return nil, nil, fmt.Errorf("segment %d not found", segmentId)
+	}
+	return seg.RecordsInBlock(blockId)
+}
+
+// ReverseIterator returns an iterator over the records of the segment with
+// the given id, from the last to the first, see Segment.ReverseIterator.
+func (w *WAL) ReverseIterator(segmentId int) (*SegmentReverseIterator, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(segmentId)
+	if !ok {
+		return nil, fmt.Errorf("segment %d not found", segmentId)
+	}
+	if seg == w.segment {
+		if err := seg.flushBlock(false); err != nil {
+			return nil, err
+		}
+	}
+	it, err := seg.ReverseIterator()
+	if err != nil {
+		return nil, err
+	}
+	it.mu = &w.mu
+	return it, nil
+}
+
+// Neighbors returns the record at pos along with the positions of the
+// records right before and after it, crossing segment boundaries. prev is
+// nil for the first record of the WAL and next for the last one. Tombstoned
+// and checkpoint records are skipped, and pos must be the start of a record.
+func (w *WAL) Neighbors(pos *Position) (prev *Position, data []byte, next *Position, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.opts.ReadOnly {
+		if err := w.segment.flushBlock(false); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	seg, ok := w.lookupSegment(pos.SegmentId)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("segment %d not found", pos.SegmentId)
+	}
+	index, err := seg.recordIndex()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].BlockId > pos.BlockId || index[i].BlockId == pos.BlockId && index[i].Offset >= pos.Offset
+	})
+	if i == len(index) || index[i].BlockId != pos.BlockId || index[i].Offset != pos.Offset {
+		return nil, nil, nil, fmt.Errorf("no record starts at %+v", *pos)
+	}
+	if data, err = seg.Read(&index[i]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if i > 0 {
+		p := index[i-1]
+		prev = &p
+	}
+	if i+1 < len(index) {
+		n := index[i+1]
+		next = &n
+	}
+	infos := w.segmentInfos()
+	for k := len(infos) - 1; prev == nil && k >= 0; k-- {
+		if infos[k].Id < pos.SegmentId {
+			if prev, err = w.edgeRecord(infos[k].Id, true); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	for k := 0; next == nil && k < len(infos); k++ {
+		if infos[k].Id > pos.SegmentId {
+			if next, err = w.edgeRecord(infos[k].Id, false); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	return prev, data, next, nil
+}
+
+// edgeRecord returns the position of the last or the first record of the
+// segment with the given id, or nil if it holds none
+func (w *WAL) edgeRecord(segmentId int, last bool) (*Position, error) {
+	seg, ok := w.lookupSegment(segmentId)
+	if !ok {
+		return nil, fmt.Errorf("segment %d not found", segmentId)
+	}
+	index, err := seg.recordIndex()
+	if err != nil || len(index) == 0 {
+		return nil, err
+	}
+	p := index[0]
+	if last {
+		p = index[len(index)-1]
+	}
+	return &p, nil
+}
+
+// RebuildIndex rebuilds the record index of a segment, used by
+// ReverseIterator, with a full scan. The index is kept in memory only, so
+// nothing is written. The buffered block of the active segment is flushed
+// first so that the index covers all of its records.
+func (w *WAL) RebuildIndex(segmentId int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rebuildIndex(segmentId)
+}
+
+// RebuildIndexes rebuilds the record index of every segment, see
+// RebuildIndex.
+func (w *WAL) RebuildIndexes() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, info := range w.segmentInfos() {
+		if err := w.rebuildIndex(info.Id); err != nil {
+			return fmt.Errorf("segment %d: %w", info.Id, err)
+		}
+	}
+	return nil
+}
+
+func (w *WAL) rebuildIndex(segmentId int) error {
+	seg, ok := w.lookupSegment(segmentId)
+	if !ok {
+		return fmt.Errorf("segment %d not found", segmentId)
+	}
+	if seg == w.segment && !w.opts.ReadOnly {
+		if err := seg.flushBlock(false); err != nil {
+			return err
+		}
+	}
+	return seg.RebuildIndex()
+}
+
+// DumpSegment writes the chunk layout of the segment with the given id to out,
+// see Segment.Dump.
+func (w *WAL) DumpSegment(id int, out io.Writer) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seg, ok := w.lookupSegment(id)
+	if !ok {
+		return fmt.Errorf("segment %d not found", id)
+	}
+	return seg.Dump(out)
+}
+
+// Write appends data as a record and returns its position. How durable the
+// record is when Write returns depends on Options.SyncPolicy: with
+// SyncAlways it was fsynced like with WriteSync, otherwise it may still be
+// buffered in the current block and lost in a crash until the next sync.
+func (w *WAL) Write(data []byte) (*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if w.opts.SyncPolicy == SyncAlways {
+		return w.WriteLevel(data, Synced)
+	}
+	if err := w.lockWrite(); err != nil {
+		return nil, err
+	}
+	defer w.mu.Unlock()
+	return w.write(data, 0)
+}
+
+// WriteContext writes data like Write, but gives up when ctx is done and
+// returns ctx.Err(). Waiting for the lock, behind a rotation or a sync
+// stalled on a slow disk, is abandoned without writing the record. With
+// SyncAlways the wait for the sync of the written record is abandoned as
+// well: its position is returned along with ctx.Err() and it is synced in
+// the background, see LastSyncError.
+func (w *WAL) WriteContext(ctx context.Context, data []byte) (*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.lockContext(ctx, w.opts.MaxWriteLatency); err != nil {
+		return nil, err
+	}
+	pos, err := w.write(data, 0)
+	if err != nil || w.opts.SyncPolicy != SyncAlways {
+		w.mu.Unlock()
+		return pos, err
+	}
+	if w.committer != nil {
+		w.mu.Unlock()
+		err = w.committer.commitContext(ctx, w.closeC)
+	} else {
+		err = w.syncUnlockContext(ctx)
+	}
+	switch {
+	case err == nil:
+		return pos, nil
+	case err == ctx.Err():
+		return pos, err // Written, but not known to be synced
+	default:
+		return nil, err
+	}
+}
+
+// lockWrite acquires the lock for a write, giving up with ErrWriteShed after
+// Options.MaxWriteLatency
+func (w *WAL) lockWrite() error {
+	return w.lockContext(context.Background(), w.opts.MaxWriteLatency)
+}
+
+// lockContext acquires the lock, giving up with ErrWriteShed after maxWait
+// unless it is zero, and with ctx.Err() when ctx is done
+func (w *WAL) lockContext(ctx context.Context, maxWait time.Duration) error {
+	if maxWait == 0 {
+		return w.lockCancelable(ctx)
+	}
+	deadline := time.Now().Add(maxWait)
+	backoff := 10 * time.Microsecond
+	for !w.mu.TryLock() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrWriteShed
+		}
+		time.Sleep(min(backoff, remaining))
+		backoff = min(2*backoff, time.Millisecond)
+	}
+	return nil
+}
+
+// lockCancelable acquires the lock like w.mu.Lock, queueing behind the other
+// writers, or gives up with ctx.Err() when ctx is done first. A waiter
+// goroutine blocks on the lock and releases it again if it was given up.
+func (w *WAL) lockCancelable(ctx context.Context) error {
+	if ctx.Done() == nil {
+		w.mu.Lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w.mu.TryLock() {
+		return nil
+	}
+	locked, abandoned := make(chan struct{}), make(chan struct{})
+	go func() {
+		w.mu.Lock()
+		select {
+		case locked <- struct{}{}:
+		case <-abandoned:
+			w.mu.Unlock()
+		}
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+// SyncPolicy is when the records written are fsynced, see Options.SyncPolicy
+type SyncPolicy int
+
+const (
+	// SyncInterval syncs in the background every Options.SyncInterval, so
+	// a crash loses the records written since the last sync.
+	SyncInterval SyncPolicy = iota
+	// SyncNever leaves syncing to the caller, through Sync, WriteSync or
+	// WriteLevel, and to Close. There is no background sync.
+	SyncNever
+	// SyncAlways syncs every record before the write returns, as if it was
+	// written with WriteSync. WriteBatch syncs once per batch.
+	SyncAlways
 )
 
-type WAL struct {
-	opts     Options
-	segment  *Segment
-	segments map[int]*Segment
-	closeC   chan struct{}
-	ticker   *time.Ticker
-	mu       sync.Mutex
+// SyncMethod is how the segment files are synced, see Options.SyncMethod
+type SyncMethod int
+
+const (
+	// SyncFsync syncs with fsync, which flushes the data and all metadata
+	// of the file.
+	SyncFsync SyncMethod = iota
+	// SyncFdatasync syncs with fdatasync, which skips the metadata not
+	// needed to read the data back, like the modification time, and so
+	// the journal commits it causes on most file systems. Platforms other
+	// than linux fsync instead.
+	SyncFdatasync
+	// SyncDsync opens the segment files with O_DSYNC, so every write of a
+	// block is durable once it returns and syncs have nothing left to do.
+	// It suits WALs that sync most records, like with SyncAlways, as
+	// buffered writes pay for the sync as well. Platforms other than linux
+	// fsync instead.
+	SyncDsync
+)
+
+// syncFile syncs f, a segment file, with the given method
+func syncFile(f File, method SyncMethod) error {
+	switch {
+	case method == SyncFdatasync:
+		return fdatasync(f)
+	case method == SyncDsync && oDSync != 0:
+		return nil // Written through
+	default:
+		return f.Sync()
+	}
 }
 
-type Options struct {
-	Directory    string
-	SegmentSize  int64
-	SyncInterval time.Duration
+// WriteSync writes data like Write and fsyncs the segment before returning,
+// so the record survives a crash of the machine once WriteSync returns. It
+// is WriteLevel with Synced.
+func (w *WAL) WriteSync(data []byte) (*Position, error) {
+	return w.WriteLevel(data, Synced)
 }
 
-func Open(opts Options) (*WAL, error) {
-	w := &WAL{
-		opts:     opts,
-		segments: make(map[int]*Segment),
-		closeC:   make(chan struct{}),
-		ticker:   time.NewTicker(opts.SyncInterval),
+// syncWritten syncs the records written under the lock with SyncAlways
+func (w *WAL) syncWritten() error {
+	if w.opts.SyncPolicy != SyncAlways {
+		return nil
 	}
-	if err := w.initialize(); err != nil {
-		return nil, err
+	if err := w.syncActive(); err != nil {
+		return err
 	}
-	go w.periodicSync()
-	return w, nil
+	w.notifyFlushed()
+	return nil
 }
 
-func (w *WAL) initialize() error {
-	if err := os.MkdirAll(w.opts.Directory, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create log directory: %w", err)
-	}
+// Durability is how far a record written with WriteLevel is persisted
+// before the call returns
+type Durability int
 
-	entries, err := os.ReadDir(w.opts.Directory)
-	if err != nil {
-		return err
-	}
+const (
+	// Buffered leaves the record in the buffer of the current block, like
+	// Write, until the block is full or the segment is synced.
+	Buffered Durability = iota
+	// Flushed writes the record to the segment file, i.e. the page cache,
+	// so it survives a crash of the process but not of the machine.
+	Flushed
+	// Synced writes the record to the segment file and fsyncs it. With
+	// Options.MaxCommitDelay the fsync is shared with concurrent writers.
+	Synced
+)
 
-	var segIds []int
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		var id int
-		if _, err := fmt.Sscanf(entry.Name(), "seg_%d.log", &id); err == nil {
-			segIds = append(segIds, id)
-		}
+// WriteLevel writes data like Write and persists it to the given level
+// before returning. Records buffered before it are persisted along with it.
+func (w *WAL) WriteLevel(data []byte, level Durability) (*Position, error) {
+	if w.opts.ReadOnly {
+		return nil, ErrReadOnly
 	}
-
-	sort.Ints(segIds)
-	if len(segIds) == 0 {
-		segId := 0
-		file := filepath.Join(w.opts.Directory, fmt.Sprintf("seg_%d.log", segId))
-		seg, err := NewSegment(segId, file)
+	if level < Buffered || level > Synced {
+		return nil, fmt.Errorf("unknown durability level %d", level)
+	}
+	if level == Synced && w.committer != nil {
+		if err := w.lockWrite(); err != nil {
+			return nil, err
+		}
+		pos, err := w.write(data, 0)
+		w.mu.Unlock()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		w.segment = seg
-		w.segments[segId] = seg
-	} else {
-		for _, segId := range segIds {
-			file := filepath.Join(w.opts.Directory, fmt.Sprintf("seg_%d.log", segId))
-			seg, err := NewSegment(segId, file)
-			if err != nil {
-				return err
-			}
-			w.segments[segId] = seg
+		if err := w.committer.commit(w.closeC); err != nil {
+			return nil, err
 		}
-		w.segment = w.segments[segIds[len(segIds)-1]]
+		return pos, nil
+	}
+	if err := w.lockWrite(); err != nil {
+		return nil, err
 	}
-
-	return nil
-}
-
-func (w *WAL) Read(pos *Position) ([]byte, error) {
-	w.mu.Lock()
 	defer w.mu.Unlock()
-	seg, ok := w.segments[pos.SegmentId]
-	if !ok {
-		return nil, errors.New("segment not found")
+	pos, err := w.write(data, 0)
+	if err != nil {
+		return nil, err
 	}
-	return seg.Read(pos)
+	switch level {
+	case Buffered:
+		return pos, nil
+	case Flushed:
+		err = w.segment.flushBlock(false)
+	case Synced:
+		err = w.syncActive()
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.notifyFlushed()
+	return pos, nil
 }
 
-func (w *WAL) Write(data []byte) (*Position, error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if w.segment.Size() >= w.opts.SegmentSize {
+// write appends data to the active segment, rotating it first if needed,
+// with flags set on its chunk types
+func (w *WAL) write(data []byte, flags ChunkType) (*Position, error) {
+	if w.fenced {
+		return nil, ErrFenced
+	}
+	if w.frozenAt != nil {
+		return nil, ErrFrozen
+	}
+	if w.opts.SingleRecordSegments && flags != 0 {
+		return nil, errors.New("checkpoint and keyed records are not supported with SingleRecordSegments")
+	}
+	if err := w.checkSpace(); err != nil {
+		return nil, err
+	}
+	payload := data
+	chained := w.opts.HashChain && flags&kCheckpointFlag == 0
+	if chained {
+		hash := nextChainHash(w.chainHash, data)
+		payload = w.pool.Alloc(chainHashSize + len(data))
+		payload = append(append(payload, hash[:]...), data...)
+		defer w.pool.Free(payload) // The segment copies the record
+	}
+	full := !w.batching && !w.segment.empty() &&
+		(w.segment.singleRecord() || w.segment.Size()+int64(w.segment.chunkHeaderSize()+len(payload)) > w.opts.SegmentSize)
+	if full || w.segment.legacy() || w.segment.chained() != w.opts.HashChain ||
+		w.segment.singleRecord() != w.opts.SingleRecordSegments ||
+		w.segment.header.fence < w.opts.FencingToken {
+		// New records use the current format. A segment holds chained
+		// records only or none at all, and a single record segment nothing
+		// else. A writer with a new fencing token does not share a segment
+		// with the writer it fenced off.
 		if err := w.rotate(); err != nil {
 			return nil, fmt.Errorf("write succeeded but segment rotation failed: %w", err)
 		}
 	}
-	pos, err := w.segment.Write(data)
+	pos, err := w.segment.write(payload, flags)
 	if err != nil {
 		return nil, err
 	}
+	if chained {
+		copy(w.chainHash[:], payload)
+	}
+	if w.seqIndex != nil && flags&kCheckpointFlag == 0 {
+		w.seqIndex.positions = append(w.seqIndex.positions, *pos)
+	}
+	w.keepForHooks(pos, data, flags)
+	w.stats.payloadBytes.Add(int64(len(data)))
+	w.stats.records.Add(1)
 	return pos, nil
 }
 
+// checkSpace returns ErrLowSpace if the free space of the directory of the
+// active segment is below Options.MinFreeBytes. The free space is sampled at
+// most once per spaceCheckInterval to keep the syscall off the hot write path.
+func (w *WAL) checkSpace() error {
+	if w.opts.MinFreeBytes == 0 {
+		return nil
+	}
+	if now := time.Now(); now.Sub(w.spaceCheckedAt) >= spaceCheckInterval {
+		free, err := w.freeSpace(filepath.Dir(w.segment.path))
+		if err != nil {
+			return fmt.Errorf("failed to check free space: %w", err)
+		}
+		w.spaceCheckedAt = now
+		w.spaceLow = free < w.opts.MinFreeBytes
+	}
+	if w.spaceLow {
+		return ErrLowSpace
+	}
+	return nil
+}
+
 func (w *WAL) rotate() error {
-	if err := w.segment.Sync(); err != nil {
+	if err := w.syncActive(); err != nil {
 		return err
 	}
 	segId := w.segment.Id() + 1
-	file := filepath.Join(w.opts.Directory, fmt.Sprintf("seg_%d.log", segId))
-	seg, err := NewSegment(segId, file)
+	seg, err := w.openSegment(w.segmentDir(segId), segId)
 	if err != nil {
 		return err
 	}
+	w.segment.sealed = true
+	w.segment.sealedAt = time.Now()
+	w.stats.rotations.Add(1)
+	w.triggerArchive()
 	w.segments[segId] = seg // Add the new segment to the map
 	w.segment = seg         // Set the new segment as the active segment
+	w.notifyFlushed()
+	if err := w.limitOpenSegments(nil); err != nil {
+		return err
+	}
+
+	if err := w.applyRetention(time.Now()); err != nil {
+		return err
+	}
+	if w.opts.RetentionFunc != nil {
+		for _, id := range w.opts.RetentionFunc(w.segmentInfos()) {
+			if err := w.purge(id); err != nil {
+				return fmt.Errorf("failed to purge segment %d: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetEpoch sets the epoch stamped into segments created from now on. With
+// Options.RotateOnEpochChange the active segment is rotated if it was
+// created in a different epoch.
+func (w *WAL) SetEpoch(epoch uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.epoch = epoch
+	if w.opts.RotateOnEpochChange && !w.opts.ReadOnly && w.segment.Epoch() != epoch {
+		return w.rotate()
+	}
+	return nil
+}
+
+// Segments returns information about the open segments ordered by id
+func (w *WAL) Segments() []SegmentInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segmentInfos()
+}
+
+func (w *WAL) segmentInfos() []SegmentInfo {
+	infos := make([]SegmentInfo, 0, len(w.segments))
+	for id, seg := range w.segments {
+		infos = append(infos, SegmentInfo{
+			Id:     id,
+			Path:   seg.path,
+			Size:   seg.Size(),
+			Active: seg == w.segment,
+			Epoch:  seg.Epoch(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// Purge removes the sealed segment with the given id from the WAL. Its file
+// is moved to Options.ArchiveDirectory when set and deleted otherwise.
+func (w *WAL) Purge(id int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.purge(id)
+}
+
+// Truncate purges every segment before the one holding pos, e.g. once a
+// consumer checkpointed up to pos, see Purge. It fails without purging
+// anything if the segment of pos does not exist. The active segment is never
+// purged.
+func (w *WAL) Truncate(pos *Position) error {
+	if w.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.segments[pos.SegmentId]; !ok {
+		return fmt.Errorf("segment %d not found", pos.SegmentId)
+	}
+	for _, info := range w.segmentInfos() {
+		if info.Id >= pos.SegmentId || info.Active {
+			break
+		}
+		if err := w.purge(info.Id); err != nil {
+			return fmt.Errorf("failed to purge segment %d: %w", info.Id, err)
+		}
+	}
 	return nil
 }
 
+func (w *WAL) purge(id int) error {
+	seg, ok := w.segments[id]
+	if !ok {
+		return fmt.Errorf("segment %d not found", id)
+	}
+	if seg == w.segment {
+		return fmt.Errorf("segment %d is the active segment", id)
+	}
+	if w.opts.Archiver != nil {
+		if err := w.archiveUpTo(id); err != nil {
+			return err
+		}
+	}
+	if err := seg.Close(); err != nil {
+		return err
+	}
+	delete(w.segments, id)
+
+	archivePath := w.opts.segmentPath(w.opts.ArchiveDirectory, id)
+	switch {
+	case w.opts.ArchiveDirectory == "":
+		if err := w.opts.FS.Remove(seg.path); err != nil {
+			return err
+		}
+		// Its records are gone, unlike those of archived segments
+		return w.trimSeqIndex()
+	case w.opts.Archiver != nil:
+		return w.opts.FS.Remove(seg.path)
+	case seg.path == archivePath:
+		return nil // Already archived, only release it
+	default:
+		if err := w.opts.FS.MkdirAll(filepath.Dir(archivePath), os.ModePerm); err != nil {
+			return err
+		}
+		return moveFile(w.opts.FS, seg.path, archivePath)
+	}
+}
+
+// releaseFiles closes the files Open opened before it failed
+func (w *WAL) releaseFiles() {
+	for _, seg := range w.segments {
+		_ = seg.release()
+		seg.closed = true
+	}
+	if w.seqIndex != nil && w.seqIndex.fd != nil {
+		_ = w.seqIndex.fd.Close()
+	}
+}
+
+// isClosed reports whether Close was called
+func (w *WAL) isClosed() bool {
+	select {
+	case <-w.closeC:
+		return true
+	default:
+		return false
+	}
+}
+
 func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -136,48 +1649,270 @@ func (w *WAL) Close() error {
 		close(w.closeC)
 	}
 
-	w.ticker.Stop()
+	if w.ticker != nil {
+		w.ticker.Stop()
+	}
+	for _, t := range w.tasks {
+		w.opts.BackgroundScheduler.cancel(t)
+	}
 
-	var errs []error
-	for _, segment := range w.segments {
-		if err := segment.Close(); err != nil {
+	if err := w.checkFence(); errors.Is(err, ErrFenced) {
+		// Drop the buffered data rather than overwrite the new writer's
+		for _, segment := range w.segments {
+			_ = segment.release()
+			segment.closed = true
+		}
+		if w.seqIndex != nil && w.seqIndex.fd != nil {
+			_ = w.seqIndex.fd.Close()
+		}
+		w.unsynced = nil
+		w.closeErr = ErrFenced
+	} else {
+		var errs []error
+		for _, segment := range w.segments {
+			if err := segment.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		if err := w.closeSeqIndex(); err != nil {
 			errs = append(errs, err)
 		}
+
+		if len(errs) > 0 {
+			w.closeErr = fmt.Errorf("errors while closing segments: %v", errs)
+		} else if len(w.unsynced) > 0 {
+			w.hookSynced(w.segment.positionAt(w.segment.Size()))
+		}
 	}
+	// Closing synced the records still waiting for syncAppends
+	for _, f := range w.appended {
+		f.resolve(w.closeErr)
+	}
+	w.appended = nil
+	return w.closeErr
+}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("errors while closing segments: %v", errs)
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.syncActive(); err != nil {
+		return err
 	}
+	w.notifyFlushed()
 	return nil
 }
 
-func (w *WAL) Sync() error {
+// SyncContext syncs like Sync, but gives up when ctx is done and returns
+// ctx.Err(). A sync already started is not undone: it completes in the
+// background and its result is reported by LastSyncError.
+func (w *WAL) SyncContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.lockContext(ctx, 0); err != nil {
+		return err
+	}
+	return w.syncUnlockContext(ctx)
+}
+
+// syncUnlockContext syncs the active segment like Sync with w.mu held, in
+// the background so that the caller can give up when ctx is done, and
+// releases the lock once the sync completes
+func (w *WAL) syncUnlockContext(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		defer w.mu.Unlock()
+		err := w.syncActive()
+		if err == nil {
+			w.notifyFlushed()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// syncActive syncs the active segment and then the sequence index, so that
+// the index only refers to durable records
+func (w *WAL) syncActive() error {
+	if err := w.checkFence(); err != nil {
+		return err
+	}
+	err := w.segment.Sync()
+	if err == nil {
+		err = w.syncSeqIndex()
+	}
+	w.syncErr = err
+	if err == nil && !w.batching {
+		// An atomic batch is not passed on before it is committed
+		w.hookSynced(w.segment.positionAt(w.segment.Size()))
+	}
+	return err
+}
+
+// LastSyncError returns the error of the latest sync of the active segment,
+// by the background sync or a caller, and nil if it succeeded. A health
+// check may poll it to notice a failing disk.
+func (w *WAL) LastSyncError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncErr
+}
+
+// handleError passes an error of the background work to
+// Options.ErrorHandler, if set
+func (w *WAL) handleError(err error) {
+	if w.opts.ErrorHandler != nil {
+		w.opts.ErrorHandler(err)
+	}
+}
+
+// notifyFlushed wakes up the followers waiting for new data
+func (w *WAL) notifyFlushed() {
+	close(w.flushedC)
+	w.flushedC = make(chan struct{})
+}
+
+// PauseSync stops the background sync until ResumeSync is called, e.g.
+// for a bulk load that syncs once at the end. If flush is set the active
+// segment is synced before returning. It does nothing for the background
+// sync itself when Options.SyncInterval is zero.
+func (w *WAL) PauseSync(flush bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ticker != nil && !w.paused {
+		w.ticker.Stop()
+		w.paused = true
+	}
+	if w.syncTask != nil {
+		w.paused = true
+	}
+	if !flush {
+		return nil
+	}
+	if err := w.syncActive(); err != nil {
+		return err
+	}
+	w.notifyFlushed()
+	return nil
+}
+
+// ResumeSync restarts the background sync stopped by PauseSync
+func (w *WAL) ResumeSync() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.segment.Sync()
+	if w.ticker != nil && w.paused {
+		w.ticker.Reset(w.opts.SyncInterval)
+		w.paused = false
+	}
+	if w.syncTask != nil {
+		w.paused = false
+	}
 }
 
 func (w *WAL) periodicSync() {
 	for {
 		select {
 		case <-w.ticker.C:
-			w.mu.Lock()
-			if err := w.segment.Sync(); err != nil {
-				fmt.Println("sync error:", err)
-			}
-			w.mu.Unlock()
+			w.backgroundSync()
 		case <-w.closeC:
 			return
 		}
 	}
 }
 
+// backgroundSync syncs the active segment unless the background sync is
+// paused
+func (w *WAL) backgroundSync() {
+	w.mu.Lock()
+	if w.paused || w.isClosed() {
+		w.mu.Unlock()
+		return // A tick from before PauseSync or Close
+	}
+	err := w.syncActive()
+	if err == nil {
+		w.notifyFlushed()
+	}
+	w.mu.Unlock()
+	if err != nil {
+		w.handleError(fmt.Errorf("background sync: %w", err))
+	}
+}
+
+// releaseIdleSegments releases the sealed segments that were not accessed
+// for Options.SegmentIdleTimeout until the WAL is closed
+func (w *WAL) releaseIdleSegments() {
+	ticker := time.NewTicker(max(w.opts.SegmentIdleTimeout/2, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.releaseIdle(now)
+		case <-w.closeC:
+			return
+		}
+	}
+}
+
+// releaseIdle releases the sealed segments that were not accessed for
+// Options.SegmentIdleTimeout at now
+func (w *WAL) releaseIdle(now time.Time) {
+	var errs []error
+	w.mu.Lock()
+	for _, seg := range w.segments {
+		if seg != w.segment && now.Sub(seg.lastUsed) >= w.opts.SegmentIdleTimeout {
+			if err := seg.release(); err != nil {
+				errs = append(errs, fmt.Errorf("release of segment %d: %w", seg.id, err))
+			}
+		}
+	}
+	w.mu.Unlock()
+	for _, err := range errs {
+		w.handleError(err)
+	}
+}
+
+// limitOpenSegments releases the least recently used sealed segments until
+// at most Options.MaxOpenSegments of them have their file open, counting
+// keep, which is about to be read, as open and never releasing it
+func (w *WAL) limitOpenSegments(keep *Segment) error {
+	limit := w.opts.MaxOpenSegments
+	if limit == 0 {
+		return nil
+	}
+	var open []*Segment
+	for _, seg := range w.segments {
+		if seg != w.segment && seg != keep && !seg.closed && seg.fd != nil {
+			open = append(open, seg)
+		}
+	}
+	if keep != nil {
+		limit--
+	}
+	if len(open) <= limit {
+		return nil
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].lastUsed.Before(open[j].lastUsed) })
+	var errs []error
+	for _, seg := range open[:len(open)-limit] {
+		if err := seg.release(); err != nil {
+			errs = append(errs, fmt.Errorf("release of segment %d: %w", seg.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // NewReader creates a new Reader starting at the given position
 func (w *WAL) NewReader(pos *Position) (*Reader, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	seg, ok := w.segments[pos.SegmentId]
+	seg, ok := w.lookupSegment(pos.SegmentId)
 	if !ok {
 		return nil, fmt.Errorf("segment %d not found", pos.SegmentId)
 	}
@@ -187,5 +1922,47 @@ func (w *WAL) NewReader(pos *Position) (*Reader, error) {
 		pos:     pos,
 		current: seg,
 		closed:  false,
+		closeC:  make(chan struct{}),
 	}, nil
 }
+
+// NewReaderFromStart creates a new Reader starting at the first record of
+// the oldest segment of the WAL, e.g. to replay everything after a crash
+// without a saved position
+func (w *WAL) NewReaderFromStart() (*Reader, error) {
+	w.mu.Lock()
+	start := Position{SegmentId: w.firstSegmentId()}
+	w.mu.Unlock()
+	return w.NewReader(&start)
+}
+
+// NewRangeReader creates a Reader returning the records from start up to,
+// but excluding, end, like StreamRange does. Next returns io.EOF once the
+// reader reaches end, or the end of the WAL if end was not written yet.
+func (w *WAL) NewRangeReader(start, end *Position) (*Reader, error) {
+	if comparePositions(*start, *end) > 0 {
+		return nil, fmt.Errorf("range start %+v is after its end %+v", *start, *end)
+	}
+	from, to := *start, *end
+	r, err := w.NewReader(&from)
+	if err != nil {
+		return nil, err
+	}
+	r.end = &to
+	return r, nil
+}
+
+// NewReaderFollow creates a Reader starting at the given position that
+// follows the WAL as it grows. Once it has caught up, Next blocks until more
+// data is flushed to the segment files, at the latest by the next Sync, rather
+// than returning io.EOF while the writer still buffers records. Next returns
+// io.EOF once the reader or the WAL is closed.
+func (w *WAL) NewReaderFollow(pos *Position) (*Reader, error) {
+	start := *pos
+	r, err := w.NewReader(&start)
+	if err != nil {
+		return nil, err
+	}
+	r.follow = true
+	return r, nil
+}
@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"fmt"
 	"math/rand"
 	"os"
 	"strings"
@@ -61,3 +62,274 @@ func BenchmarkWAL_Read(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+func BenchmarkWAL_ReadChecksumSampling(b *testing.B) {
+	for _, rate := range []int{1, 8} {
+		b.Run(fmt.Sprintf("rate=%d", rate), func(b *testing.B) {
+			w, err := Open(Options{
+				Directory:          b.TempDir(),
+				SegmentSize:        1 * GB,
+				SyncInterval:       1 * time.Hour,
+				ChecksumSampleRate: rate,
+			})
+			assert.Nil(b, err)
+			defer w.Close()
+
+			// Records span blocks so every read walks several chunks.
+			content := []byte(strings.Repeat("X", 256*KB))
+			var positions []*Position
+			for i := 0; i < 100; i++ {
+				pos, err := w.Write(content)
+				assert.Nil(b, err)
+				positions = append(positions, pos)
+			}
+			assert.Nil(b, w.Sync())
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Read(positions[i%len(positions)])
+				assert.Nil(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkWAL_ReadMmap(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			w, err := Open(Options{
+				Directory:          b.TempDir(),
+				SegmentSize:        16 * MB,
+				SyncInterval:       1 * time.Hour,
+				MmapSealedSegments: mmap,
+			})
+			assert.Nil(b, err)
+			defer w.Close()
+
+			// Random reads of sealed segments, missing the cached block
+			var positions []*Position
+			for i := 0; i < 200000; i++ {
+				pos, err := w.Write([]byte("Hello World, this is a record of a sealed segment"))
+				assert.Nil(b, err)
+				positions = append(positions, pos)
+			}
+			assert.Nil(b, w.rotate())
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := w.Read(positions[rand.Intn(len(positions))])
+				assert.Nil(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkWAL_NoChecksum(b *testing.B) {
+	for _, noChecksum := range []bool{false, true} {
+		b.Run(fmt.Sprintf("nochecksum=%v", noChecksum), func(b *testing.B) {
+			w, err := Open(Options{
+				Directory:    b.TempDir(),
+				SegmentSize:  1 * GB,
+				SyncInterval: 1 * time.Hour,
+				NoChecksum:   noChecksum,
+			})
+			assert.Nil(b, err)
+			defer w.Close()
+
+			content := []byte(strings.Repeat("X", 16*KB))
+			var positions []*Position
+			b.Run("write", func(b *testing.B) {
+				b.SetBytes(int64(len(content)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					pos, err := w.Write(content)
+					assert.Nil(b, err)
+					if len(positions) < 1000 {
+						positions = append(positions, pos)
+					}
+				}
+			})
+			assert.Nil(b, w.Sync())
+			b.Run("read", func(b *testing.B) {
+				b.SetBytes(int64(len(content)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := w.Read(positions[i%len(positions)])
+					assert.Nil(b, err)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkWAL_WriteBatchAsOne(b *testing.B) {
+	entries := make([][]byte, 100)
+	for i := range entries {
+		entries[i] = []byte("Hello World")
+	}
+	b.Run("individual", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, entry := range entries {
+				_, err := wal.Write(entry)
+				assert.Nil(b, err)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := wal.WriteBatchAsOne(entries)
+			assert.Nil(b, err)
+		}
+	})
+}
+
+// BenchmarkWAL_GroupCommit compares the adaptive commit window to a fixed
+// one. A single writer measures the latency at low load, parallel writers
+// the throughput at high load.
+func BenchmarkWAL_GroupCommit(b *testing.B) {
+	for _, adaptive := range []bool{false, true} {
+		open := func(b *testing.B) *WAL {
+			w, err := Open(Options{
+				Directory:      b.TempDir(),
+				SegmentSize:    1 * GB,
+				SyncInterval:   1 * time.Hour,
+				MaxCommitDelay: 2 * time.Millisecond,
+			})
+			assert.Nil(b, err)
+			w.committer.adaptive = adaptive
+			return w
+		}
+		b.Run(fmt.Sprintf("low/adaptive=%v", adaptive), func(b *testing.B) {
+			w := open(b)
+			defer w.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.WriteLevel([]byte("Hello World"), Synced)
+				assert.Nil(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("high/adaptive=%v", adaptive), func(b *testing.B) {
+			w := open(b)
+			defer w.Close()
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := w.WriteLevel([]byte("Hello World"), Synced)
+					assert.Nil(b, err)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkWAL_ReadConcurrent(b *testing.B) {
+	w, err := Open(Options{
+		Directory:    b.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.Nil(b, err)
+	defer w.Close()
+	var positions []*Position
+	for i := 0; i < 1000; i++ {
+		pos, err := w.Write([]byte(strings.Repeat("X", 100+i)))
+		assert.Nil(b, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(b, w.Sync())
+
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				_, err := w.Read(positions[i%len(positions)])
+				assert.Nil(b, err)
+				i++
+			}
+		})
+	})
+	b.Run("ReadBuffer", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				buf, err := w.ReadBuffer(positions[i%len(positions)])
+				assert.Nil(b, err)
+				buf.Release()
+				i++
+			}
+		})
+	})
+}
+
+// BenchmarkWAL_PoolMax writes 4KB batches as one record with the default
+// buffer pool, which does not reuse their buffers, and with one raised to
+// 8KB. Plain writes of 4KB records are not affected, see Options.PoolMax.
+func BenchmarkWAL_PoolMax(b *testing.B) {
+	entries := make([][]byte, 4)
+	for i := range entries {
+		entries[i] = []byte(strings.Repeat("X", 1*KB))
+	}
+	for _, poolMax := range []int{0, 8 * KB} {
+		b.Run(fmt.Sprintf("max=%d", poolMax), func(b *testing.B) {
+			w, err := Open(Options{
+				Directory:    b.TempDir(),
+				SegmentSize:  1 * GB,
+				SyncInterval: 1 * time.Hour,
+				PoolMax:      poolMax,
+			})
+			assert.Nil(b, err)
+			defer w.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := w.WriteBatchAsOne(entries)
+				assert.Nil(b, err)
+			}
+		})
+	}
+}
+
+// BenchmarkWAL_WriteBatch compares durably writing 100 records with Write and
+// Sync per record to a single WriteBatch, reporting the syscalls per batch.
+func BenchmarkWAL_WriteBatch(b *testing.B) {
+	records := make([][]byte, 100)
+	for i := range records {
+		records[i] = []byte("Hello World")
+	}
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+			fs := newCountingFS()
+			w, err := Open(Options{
+				Directory:    b.TempDir(),
+				SegmentSize:  1 * GB,
+				SyncInterval: 1 * time.Hour,
+				FS:           fs,
+			})
+			assert.Nil(b, err)
+			defer w.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if batch {
+					_, err := w.WriteBatch(records)
+					assert.Nil(b, err)
+					continue
+				}
+				for _, record := range records {
+					_, err := w.Write(record)
+					assert.Nil(b, err)
+					assert.Nil(b, w.Sync())
+				}
+			}
+			b.ReportMetric(float64(fs.writes.Load())/float64(b.N), "writes/op")
+			b.ReportMetric(float64(fs.syncs.Load())/float64(b.N), "syncs/op")
+		})
+	}
+}
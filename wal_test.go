@@ -1,9 +1,17 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -205,3 +213,1850 @@ func TestWAL_Close(t *testing.T) {
 	assert.NoError(t, wal.Close())
 	assert.Error(t, wal.Sync())
 }
+
+func TestWAL_MinFreeBytes(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1024,
+		SyncInterval: 10 * time.Millisecond,
+		MinFreeBytes: 1 * MB,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	free := uint64(512 * KB)
+	wal.freeSpace = func(string) (uint64, error) { return free, nil }
+
+	_, err = wal.Write([]byte("rejected"))
+	assert.ErrorIs(t, err, ErrLowSpace)
+
+	// The result is cached, so a recovery is only seen after the next check.
+	free = 2 * MB
+	_, err = wal.Write([]byte("still rejected"))
+	assert.ErrorIs(t, err, ErrLowSpace)
+
+	wal.spaceCheckedAt = time.Time{}
+	pos, err := wal.Write([]byte("accepted"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	data, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("accepted"), data)
+}
+
+func TestWAL_Overwrite(t *testing.T) {
+	opts := Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * MB,
+		SyncInterval:   10 * time.Millisecond,
+		AllowOverwrite: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos1, err := wal.Write([]byte("record-1"))
+	assert.NoError(t, err)
+	pos2, err := wal.Write([]byte("record-2"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Overwrite(pos1, []byte("RECORD-X")))
+
+	data, err := wal.Read(pos1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("RECORD-X"), data)
+	data, err = wal.Read(pos2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record-2"), data)
+
+	// Records spanning several blocks are rewritten chunk by chunk.
+	large := make([]byte, blockSize*2)
+	pos3, err := wal.Write(large)
+	assert.NoError(t, err)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	assert.NoError(t, wal.Overwrite(pos3, large))
+	data, err = wal.Read(pos3)
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+}
+
+func TestWAL_OverwriteRejected(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 10 * time.Millisecond,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos, err := wal.Write([]byte("record"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, wal.Overwrite(pos, []byte("RECORD")), ErrOverwriteDisabled)
+
+	wal.opts.AllowOverwrite = true
+	assert.ErrorIs(t, wal.Overwrite(pos, []byte("longer record")), ErrLengthMismatch)
+
+	data, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record"), data)
+}
+
+func TestWAL_Tombstone(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos1, err := wal.Write([]byte("record-1"))
+	assert.NoError(t, err)
+	pos2, err := wal.Write(bytes.Repeat([]byte("personal data "), blockSize/7))
+	assert.NoError(t, err)
+	pos3, err := wal.Write([]byte("record-3"))
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, wal.Tombstone(pos2), ErrOverwriteDisabled)
+	wal.opts.AllowOverwrite = true
+	assert.NoError(t, wal.Tombstone(pos2))
+
+	_, err = wal.Read(pos2)
+	assert.ErrorIs(t, err, ErrTombstoned)
+	assert.ErrorIs(t, wal.Tombstone(pos2), ErrTombstoned)
+	assert.ErrorIs(t, wal.Overwrite(pos2, []byte("x")), ErrTombstoned)
+	data, err := wal.Read(pos1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record-1"), data)
+	data, err = wal.Read(pos3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record-3"), data)
+
+	// The payload is gone from the file
+	raw, err := os.ReadFile(wal.opts.segmentPath(opts.Directory, 0))
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("personal data")))
+
+	// Readers skip the erased record
+	assert.NoError(t, wal.Sync())
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	var records []string
+	for {
+		data, err := reader.Next()
+		if err != nil {
+			break
+		}
+		records = append(records, string(data))
+	}
+	assert.Equal(t, []string{"record-1", "record-3"}, records)
+}
+
+func TestWAL_Directories(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	opts := Options{
+		Directories:  dirs,
+		SegmentSize:  64,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var positions []*Position
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	infos := wal.Segments()
+	assert.Greater(t, len(infos), 2)
+	for _, info := range infos {
+		assert.Equal(t, wal.opts.segmentPath(dirs[info.Id%2], info.Id), info.Path)
+		_, err := os.Stat(info.Path)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// Reopen and read everything back across both directories
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, infos[len(infos)-1].Id, wal.segment.Id())
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer reader.Close()
+	count := 0
+	for {
+		if _, err := reader.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, len(positions), count)
+
+	// A segment id may only exist in one of the directories
+	assert.NoError(t, os.WriteFile(wal.opts.segmentPath(dirs[1], 0), nil, 0644))
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, ErrDuplicateSegment)
+}
+
+func TestWAL_DuplicateSegments(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	opts := Options{
+		Directories:  dirs,
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	}
+	// A botched move left segment 5 behind in its old directory
+	paths := []string{
+		filepath.Join(dirs[0], defaultPathFor(5)),
+		filepath.Join(dirs[2], defaultPathFor(5)),
+	}
+	for _, path := range paths {
+		assert.NoError(t, os.WriteFile(path, nil, 0644))
+	}
+	_, err := Open(opts)
+	assert.ErrorIs(t, err, ErrDuplicateSegment)
+	for _, path := range paths {
+		assert.ErrorContains(t, err, path)
+	}
+
+	assert.NoError(t, os.Remove(paths[0]))
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, 5, wal.segment.Id())
+}
+
+func TestWAL_PathFor(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64,
+		SyncInterval: 1 * time.Hour,
+		PathFor: func(id int) string {
+			return filepath.Join(fmt.Sprintf("%02d", id/4), fmt.Sprintf("seg_%010d.wal", id))
+		},
+		ParsePath: func(path string) (int, bool) {
+			var id int
+			if _, err := fmt.Sscanf(filepath.Base(path), "seg_%010d.wal", &id); err != nil {
+				return 0, false
+			}
+			return id, true
+		},
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var positions []*Position
+	for i := 0; i < 20; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	lastId := wal.segment.Id()
+	assert.Greater(t, lastId, 4)
+	assert.NoError(t, wal.Close())
+
+	_, err = os.Stat(filepath.Join(opts.Directory, "01", "seg_0000000004.wal"))
+	assert.NoError(t, err)
+
+	// A file in a directory PathFor would not use is no segment
+	assert.NoError(t, os.WriteFile(filepath.Join(opts.Directory, "seg_0000000099.wal"), nil, 0644))
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, lastId, wal.segment.Id())
+	assert.Len(t, wal.Segments(), lastId+1)
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+	}
+
+	opts.ParsePath = nil
+	_, err = Open(opts)
+	assert.Error(t, err)
+}
+
+func TestWAL_WriteLevel(t *testing.T) {
+	fs := newCountingFS()
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+		FS:           fs,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	tests := []struct {
+		level          Durability
+		writes, syncs  int64
+		flushedRecords bool
+	}{
+		{Buffered, 0, 0, false},
+		{Flushed, 1, 0, true},
+		{Synced, 1, 1, true},
+	}
+	for _, tt := range tests {
+		writes, syncs := fs.writes.Load(), fs.syncs.Load()
+		pos, err := wal.WriteLevel([]byte("record"), tt.level)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.writes, fs.writes.Load()-writes, "writes at level %d", tt.level)
+		assert.Equal(t, tt.syncs, fs.syncs.Load()-syncs, "syncs at level %d", tt.level)
+		flushed := int64(pos.BlockId)*blockSize+int64(pos.Offset) < wal.segment.flushedSize()
+		assert.Equal(t, tt.flushedRecords, flushed, "record flushed at level %d", tt.level)
+	}
+
+	_, err = wal.WriteLevel([]byte("record"), Durability(42))
+	assert.Error(t, err)
+}
+
+func TestWAL_ErrorHandler(t *testing.T) {
+	fs := newCountingFS()
+	errC := make(chan error, 100)
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 5 * time.Millisecond,
+		FS:           fs,
+		ErrorHandler: func(err error) { errC <- err },
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	_, err = wal.Write([]byte("record"))
+	assert.NoError(t, err)
+	fs.failSync.Store(true)
+	select {
+	case err := <-errC:
+		assert.ErrorIs(t, err, syscall.EIO)
+		assert.ErrorContains(t, err, "background sync")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failing background sync was not reported")
+	}
+	assert.ErrorIs(t, wal.LastSyncError(), syscall.EIO)
+
+	fs.failSync.Store(false)
+	assert.NoError(t, wal.Sync())
+	assert.NoError(t, wal.LastSyncError())
+}
+
+func TestWAL_SyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy     SyncPolicy
+		writeSyncs int64 // Syncs of 10 writes and a keyed write
+		background bool
+	}{
+		{SyncInterval, 0, true},
+		{SyncNever, 0, false},
+		{SyncAlways, 11, false},
+	}
+	for _, tt := range tests {
+		fs := newCountingFS()
+		opts := Options{
+			Directory:    t.TempDir(),
+			SegmentSize:  1 * MB,
+			SyncInterval: 5 * time.Millisecond,
+			SyncPolicy:   tt.policy,
+			FS:           fs,
+		}
+		wal, err := Open(opts)
+		assert.NoError(t, err)
+
+		// Every record is durable when WriteSync returns
+		syncs := fs.syncs.Load()
+		pos, err := wal.WriteSync([]byte("synced"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), fs.syncs.Load()-syncs, "WriteSync with policy %d", tt.policy)
+		assert.Less(t, wal.segment.fileOffset(*pos), wal.segment.flushedSize())
+
+		syncs = fs.syncs.Load()
+		for i := 0; i < 10; i++ {
+			_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+			assert.NoError(t, err)
+		}
+		_, err = wal.WriteKeyed([]byte("key"), []byte("value"))
+		assert.NoError(t, err)
+		if !tt.background {
+			assert.Equal(t, tt.writeSyncs, fs.syncs.Load()-syncs, "writes with policy %d", tt.policy)
+		}
+
+		// Only SyncInterval syncs in the background
+		time.Sleep(50 * time.Millisecond)
+		syncs = fs.syncs.Load()
+		_, err = wal.Write([]byte("buffered"))
+		assert.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		if tt.background {
+			assert.Greater(t, fs.syncs.Load(), syncs, "policy %d", tt.policy)
+		} else {
+			want := syncs
+			if tt.policy == SyncAlways {
+				want++ // The write itself
+			}
+			assert.Equal(t, want, fs.syncs.Load(), "policy %d", tt.policy)
+		}
+		assert.NoError(t, wal.Close())
+	}
+}
+
+func TestWAL_PauseSync(t *testing.T) {
+	fs := newCountingFS()
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 5 * time.Millisecond,
+		FS:           fs,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	assert.NoError(t, wal.PauseSync(false))
+	syncs := fs.syncs.Load()
+	for i := 0; i < 1000; i++ {
+		_, err := wal.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, syncs, fs.syncs.Load(), "no background syncs while paused")
+
+	// A final flush on request
+	assert.NoError(t, wal.PauseSync(true))
+	assert.Equal(t, syncs+1, fs.syncs.Load())
+	assert.Equal(t, wal.segment.Size(), wal.segment.flushedSize())
+
+	wal.ResumeSync()
+	assert.Eventually(t, func() bool {
+		return fs.syncs.Load() > syncs+2
+	}, time.Second, 5*time.Millisecond, "background syncs continue after ResumeSync")
+}
+
+func TestWAL_ReadDuringRotation(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  128,
+		SyncInterval: 1 * time.Millisecond,
+		FlushOnRead:  true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	type written struct {
+		pos  *Position
+		data string
+	}
+	positions := make(chan written, 16)
+	go func() {
+		defer close(positions)
+		for i := 0; i < 2000; i++ {
+			data := fmt.Sprintf("record %d", i)
+			pos, err := wal.Write([]byte(data))
+			if err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+			positions <- written{pos, data}
+		}
+	}()
+
+	// Read every record right after it was written, racing the rotation
+	// of its segment
+	for w := range positions {
+		data, err := wal.Read(w.pos)
+		if !assert.NoError(t, err, "reading %+v", *w.pos) {
+			break
+		}
+		assert.Equal(t, w.data, string(data))
+	}
+	assert.Greater(t, wal.segment.Id(), 100)
+}
+
+func TestWAL_ReadOnly(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64,
+		SyncInterval: 10 * time.Millisecond,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 5; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Close())
+
+	opts.ReadOnly = true
+	opts.FS = readOnlyFS{}
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Nil(t, wal.ticker)
+
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d", i)), data)
+	}
+	_, err = wal.Write([]byte("rejected"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.NoError(t, wal.Close())
+}
+
+func TestWAL_Truncate(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	var positions []*Position
+	for i := 0; i < 60; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	checkpoint := positions[40]
+	assert.Greater(t, checkpoint.SegmentId, 1)
+
+	segments := len(wal.Segments())
+	assert.Error(t, wal.Truncate(&Position{SegmentId: wal.segment.Id() + 1}))
+	assert.Len(t, wal.Segments(), segments, "nothing is purged")
+
+	assert.NoError(t, wal.Truncate(checkpoint))
+	infos := wal.Segments()
+	assert.Equal(t, checkpoint.SegmentId, infos[0].Id)
+	for id := 0; id < checkpoint.SegmentId; id++ {
+		_, err := os.Stat(wal.opts.segmentPath(opts.Directory, id))
+		assert.True(t, os.IsNotExist(err))
+	}
+	_, err = wal.Read(positions[0])
+	assert.ErrorContains(t, err, "segment 0 not found")
+	data, err := wal.Read(checkpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 40", string(data))
+
+	// The active segment is kept
+	assert.NoError(t, wal.Truncate(positions[59]))
+	assert.Len(t, wal.Segments(), 1)
+	_, err = wal.Write([]byte("record 60"))
+	assert.NoError(t, err)
+}
+
+func TestWAL_ArchiveDirectory(t *testing.T) {
+	opts := Options{
+		Directory:        t.TempDir(),
+		ArchiveDirectory: t.TempDir(),
+		SegmentSize:      64,
+		SyncInterval:     10 * time.Millisecond,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NotEqual(t, 0, wal.segment.Id())
+	assert.Error(t, wal.Purge(wal.segment.Id()))
+
+	assert.NoError(t, wal.Purge(0))
+	_, err = os.Stat(wal.opts.segmentPath(opts.Directory, 0))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(wal.opts.segmentPath(opts.ArchiveDirectory, 0))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, positions[0].SegmentId)
+	data, err := wal.Read(positions[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record 0"), data)
+
+	// Readers cross from the archive into the primary directory.
+	assert.NoError(t, wal.Sync())
+	reader, err := wal.NewReader(&Position{SegmentId: 0})
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 10; i++ {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d", i)), data)
+	}
+}
+
+func TestWAL_WriteAmplification(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, 0.0, wal.WriteAmplification())
+
+	for i := 0; i < 10; i++ {
+		_, err := wal.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+	// The segment header is physical overhead as well.
+	assert.InDelta(t, float64(segmentHeaderSize+10*(100+ChecksumCRC32.chunkHeaderSize()))/float64(10*100), wal.WriteAmplification(), 1e-9)
+
+	// Leave 4 bytes in the block, too few for a chunk header, so the next
+	// record pads the rest of the block.
+	fill := blockSize - segmentHeaderSize - 10*(100+ChecksumCRC32.chunkHeaderSize()) - ChecksumCRC32.chunkHeaderSize() - 4
+	_, err = wal.Write(make([]byte, fill))
+	assert.NoError(t, err)
+	_, err = wal.Write(make([]byte, 100))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	payload := 10*100 + fill + 100
+	physical := blockSize + ChecksumCRC32.chunkHeaderSize() + 100
+	assert.InDelta(t, float64(physical)/float64(payload), wal.WriteAmplification(), 1e-9)
+}
+
+func TestWAL_FlushOnRead(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+		FlushOnRead:  true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("record %d", i))
+		pos, err := wal.Write(data)
+		assert.NoError(t, err)
+		readData, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, data, readData)
+	}
+
+	large := bytes.Repeat([]byte("x"), blockSize+100)
+	pos, err := wal.Write(large)
+	assert.NoError(t, err)
+	readData, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, large, readData)
+}
+
+func TestWAL_RetentionFunc(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64,
+		SyncInterval: 10 * time.Millisecond,
+		RetentionFunc: func(segments []SegmentInfo) []int {
+			var purge []int
+			for _, info := range segments {
+				if info.Id%2 == 1 && !info.Active {
+					purge = append(purge, info.Id)
+				}
+			}
+			return purge
+		},
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	active := wal.segment.Id()
+	assert.Greater(t, active, 3)
+
+	for _, info := range wal.Segments() {
+		if info.Id != active {
+			assert.Equal(t, 0, info.Id%2, "segment %d should have been purged", info.Id)
+		}
+	}
+	for id := 0; id < active; id++ {
+		_, err := os.Stat(wal.opts.segmentPath(opts.Directory, id))
+		assert.Equal(t, id%2 == 1, os.IsNotExist(err), "segment %d", id)
+	}
+}
+
+func TestWAL_RecordsInBlock(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * MB,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records [][]byte
+	for _, data := range [][]byte{
+		[]byte("first"),
+		[]byte("second"),
+		bytes.Repeat([]byte("s"), blockSize), // Spans into block 1
+		[]byte("third"),
+	} {
+		pos, err := wal.Write(data)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, data)
+	}
+	assert.Equal(t, 1, positions[3].BlockId)
+
+	gotPositions, gotRecords, err := wal.RecordsInBlock(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, positions[:3], gotPositions)
+	assert.Equal(t, records[:3], gotRecords)
+
+	gotPositions, gotRecords, err = wal.RecordsInBlock(0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, positions[3:], gotPositions)
+	assert.Equal(t, records[3:], gotRecords)
+
+	_, _, err = wal.RecordsInBlock(0, 2)
+	assert.Error(t, err)
+}
+
+func TestWAL_RecordsInBlockFlags(t *testing.T) {
+	opts := Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * MB,
+		SyncInterval:   1 * time.Hour,
+		AllowOverwrite: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for _, data := range []string{"r0", "r1", "r2", "r3"} {
+		pos, err := wal.Write([]byte(data))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	checkpoint, err := wal.WriteCheckpoint([]byte("state"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Tombstone(positions[3]))
+
+	// Checkpoints are listed, tombstoned records are not
+	gotPositions, gotRecords, err := wal.RecordsInBlock(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Position{positions[0], positions[1], positions[2], checkpoint}, gotPositions)
+	assert.Equal(t, [][]byte{[]byte("r0"), []byte("r1"), []byte("r2"), []byte("state")}, gotRecords)
+	assert.NoError(t, wal.Close())
+
+	// A corrupt chunk ends the block with an error
+	path := wal.segment.path
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[wal.segment.fileOffset(*positions[1])+int64(ChecksumCRC32.chunkHeaderSize())] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	gotPositions, gotRecords, err = wal.RecordsInBlock(0, 0)
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+	assert.Equal(t, positions[:1], gotPositions)
+	assert.Equal(t, [][]byte{[]byte("r0")}, gotRecords)
+}
+
+func TestWAL_MaxChunksPerRecord(t *testing.T) {
+	opts := Options{
+		Directory:          t.TempDir(),
+		SegmentSize:        1 * MB,
+		SyncInterval:       1 * time.Hour,
+		MaxChunksPerRecord: 2,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	fits, err := wal.Write(make([]byte, blockSize))
+	assert.NoError(t, err)
+	tooLong, err := wal.Write(make([]byte, 3*blockSize))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	data, err := wal.Read(fits)
+	assert.NoError(t, err)
+	assert.Len(t, data, blockSize)
+
+	_, err = wal.Read(tooLong)
+	assert.ErrorIs(t, err, ErrRecordTooLong)
+}
+
+func TestOptions_Validate(t *testing.T) {
+	valid := Options{Directory: t.TempDir(), SegmentSize: 1 * GB}
+	assert.NoError(t, valid.Validate())
+
+	for _, tt := range []struct {
+		name   string
+		modify func(o *Options)
+		errMsg string
+	}{
+		{"no directory", func(o *Options) { o.Directory = "" }, "Directory is required"},
+		{"zero segment size", func(o *Options) { o.SegmentSize = 0 }, "SegmentSize must be positive"},
+		{"negative segment size", func(o *Options) { o.SegmentSize = -1 }, "SegmentSize must be positive"},
+		{"negative sync interval", func(o *Options) { o.SyncInterval = -time.Second }, "SyncInterval must not be negative"},
+		{"unknown sync policy", func(o *Options) { o.SyncPolicy = SyncAlways + 1 }, "unknown SyncPolicy"},
+		{"unknown sync method", func(o *Options) { o.SyncMethod = SyncDsync + 1 }, "unknown SyncMethod"},
+		{"negative sample rate", func(o *Options) { o.ChecksumSampleRate = -1 }, "ChecksumSampleRate must not be negative"},
+		{"negative chunk limit", func(o *Options) { o.MaxChunksPerRecord = -1 }, "MaxChunksPerRecord must not be negative"},
+		{"overwrite read-only", func(o *Options) { o.ReadOnly, o.AllowOverwrite = true, true }, "AllowOverwrite cannot be combined with ReadOnly"},
+		{"repair read-only", func(o *Options) { o.ReadOnly, o.RepairOnOpen = true, true }, "RepairOnOpen cannot be combined with ReadOnly"},
+		{"archive is directory", func(o *Options) { o.ArchiveDirectory = o.Directory + "/" }, "ArchiveDirectory must differ from Directory"},
+		{"archiver without archive directory", func(o *Options) { o.Archiver = newMemArchiver() }, "Archiver requires ArchiveDirectory"},
+		{"archiver with overwrite", func(o *Options) { o.Archiver, o.ArchiveDirectory, o.AllowOverwrite = newMemArchiver(), "archive", true }, "AllowOverwrite cannot be combined with Archiver"},
+		{"pool min above max", func(o *Options) { o.PoolMin, o.PoolMax = 4096, 1024 }, "PoolMin must not exceed PoolMax"},
+		{"pool factor one", func(o *Options) { o.PoolFactor = 1 }, "PoolFactor must be at least 2"},
+		{"block size not a power of two", func(o *Options) { o.BlockSize = 3000 }, "BlockSize must be a power of two"},
+		{"block size too small", func(o *Options) { o.BlockSize = ChecksumCRC32.chunkHeaderSize() + 1 }, "BlockSize must be a power of two"},
+		{"block size too large", func(o *Options) { o.BlockSize = 128 * KB }, "BlockSize must be a power of two"},
+		{"unknown checksum type", func(o *Options) { o.ChecksumType = ChecksumCRC64 + 1 }, "unknown ChecksumType"},
+		{"single record crc64", func(o *Options) { o.SingleRecordSegments, o.ChecksumType = true, ChecksumCRC64 }, "SingleRecordSegments only support ChecksumCRC32"},
+		{"unknown compression", func(o *Options) { o.Compression = CompressionZstd + 1 }, "unknown Compression"},
+		{"compression with overwrite", func(o *Options) { o.Compression, o.AllowOverwrite = CompressionSnappy, true }, "AllowOverwrite cannot be combined with Compression"},
+		{"compression single record", func(o *Options) { o.Compression, o.SingleRecordSegments = CompressionSnappy, true }, "Compression cannot be combined with SingleRecordSegments"},
+		{"no checksum with checksum type", func(o *Options) { o.NoChecksum, o.ChecksumType = true, ChecksumCRC64 }, "NoChecksum cannot be combined with a ChecksumType"},
+		{"no checksum single record", func(o *Options) { o.NoChecksum, o.SingleRecordSegments = true, true }, "NoChecksum cannot be combined with SingleRecordSegments"},
+		{"negative max open segments", func(o *Options) { o.MaxOpenSegments = -1 }, "MaxOpenSegments must not be negative"},
+		{"negative block cache size", func(o *Options) { o.BlockCacheSize = -1 }, "BlockCacheSize must not be negative"},
+		{"negative max segments", func(o *Options) { o.MaxSegments = -1 }, "MaxSegments, MaxTotalSize and MaxAge must not be negative"},
+		{"negative max age", func(o *Options) { o.MaxAge = -time.Second }, "MaxSegments, MaxTotalSize and MaxAge must not be negative"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := valid
+			tt.modify(&opts)
+			err := opts.Validate()
+			assert.ErrorContains(t, err, tt.errMsg)
+
+			_, err = Open(opts)
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestOptions_Defaults(t *testing.T) {
+	opts, err := Options{Directory: "dir", SegmentSize: 1 * MB}.validate()
+	assert.NoError(t, err)
+	assert.Equal(t, blockSize, opts.BlockSize)
+	assert.Equal(t, time.Duration(0), opts.SyncInterval)
+	assert.NotNil(t, opts.PathFor)
+	opts, err = Options{Directories: []string{"a", "b"}, SegmentSize: 1 * MB}.validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", opts.Directory)
+	_, err = Options{SyncInterval: time.Second}.validate()
+	assert.ErrorContains(t, err, "Directory is required")
+	_, err = Options{Directory: "dir"}.validate()
+	assert.ErrorContains(t, err, "SegmentSize must be positive")
+
+	wal, err := Open(Options{Directory: t.TempDir(), SegmentSize: 1 * GB})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	assert.Equal(t, osFS{}, wal.opts.FS)
+	assert.Equal(t, int64(DefaultScrubBytesPerSecond), wal.opts.ScrubBytesPerSecond)
+	assert.Nil(t, wal.ticker, "a zero SyncInterval disables the background sync")
+
+	pos, err := wal.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	data, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+}
+
+func TestWAL_Epoch(t *testing.T) {
+	opts := Options{
+		Directory:           t.TempDir(),
+		SegmentSize:         1 * MB,
+		SyncInterval:        1 * time.Hour,
+		Epoch:               1,
+		RotateOnEpochChange: true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	_, err = wal.Write([]byte("term 1"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.SetEpoch(2))
+	_, err = wal.Write([]byte("term 2"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.SetEpoch(2)) // Unchanged, no rotation
+	assert.NoError(t, wal.SetEpoch(5))
+	_, err = wal.Write([]byte("term 5"))
+	assert.NoError(t, err)
+
+	epochs := func() map[int]uint64 {
+		m := make(map[int]uint64)
+		for _, info := range wal.Segments() {
+			m[info.Id] = info.Epoch
+		}
+		return m
+	}
+	expected := map[int]uint64{0: 1, 1: 2, 2: 5}
+	assert.Equal(t, expected, epochs())
+
+	// Epochs are persisted in the segment headers.
+	assert.NoError(t, wal.Close())
+	opts.Epoch = 5
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, expected, epochs())
+
+	// Without RotateOnEpochChange only new segments get the new epoch.
+	wal.opts.RotateOnEpochChange = false
+	assert.NoError(t, wal.SetEpoch(6))
+	assert.Equal(t, uint64(5), wal.segment.Epoch())
+	assert.NoError(t, wal.rotate())
+	assert.Equal(t, uint64(6), wal.segment.Epoch())
+}
+
+func TestWAL_SegmentIdleTimeout(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:          t.TempDir(),
+		SegmentSize:        128,
+		SyncInterval:       1 * time.Hour,
+		SegmentIdleTimeout: 20 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 10; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	released := func(id int) bool {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		return wal.segments[id].fd == nil
+	}
+	assert.Eventually(t, func() bool {
+		return released(positions[0].SegmentId)
+	}, time.Second, 5*time.Millisecond, "the idle sealed segment is released")
+	assert.False(t, released(wal.Segments()[len(wal.Segments())-1].Id), "the active segment is never released")
+
+	// A read reopens the segment
+	data, err := wal.Read(positions[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "record 0", string(data))
+	assert.False(t, released(positions[0].SegmentId))
+}
+
+func TestWAL_MaxOpenSegments(t *testing.T) {
+	opts := Options{
+		Directory:       t.TempDir(),
+		SegmentSize:     128,
+		SyncInterval:    1 * time.Hour,
+		MaxOpenSegments: 2,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	var positions []*Position
+	for i := 0; i < 30; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	openSealed := func() (open []int) {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		for id, seg := range wal.segments {
+			if seg != wal.segment && seg.fd != nil {
+				open = append(open, id)
+			}
+		}
+		return open
+	}
+	assert.LessOrEqual(t, len(openSealed()), 2, "rotations release the segments beyond the limit")
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Greater(t, len(wal.Segments()), 3)
+	assert.Empty(t, openSealed(), "only the active segment is opened")
+
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+		assert.LessOrEqual(t, len(openSealed()), 2)
+	}
+	assert.Contains(t, openSealed(), wal.segment.Id()-1, "the most recently read segments stay open")
+
+	reader, err := wal.NewReaderFromStart()
+	assert.NoError(t, err)
+	defer reader.Close()
+	for i := range positions {
+		data, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+		assert.LessOrEqual(t, len(openSealed()), 2)
+	}
+}
+
+func TestWAL_ReadVerify(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		FlushOnRead:  true,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	data := []byte("generation 1")
+	pos, err := wal.Write(data)
+	assert.NoError(t, err)
+
+	got, err := wal.ReadVerify(pos, crc32.ChecksumIEEE(data))
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = wal.ReadVerify(pos, crc32.ChecksumIEEE([]byte("generation 2")))
+	assert.ErrorIs(t, err, ErrCRCMismatch)
+	assert.NotErrorIs(t, err, ErrInvalidCRC)
+}
+
+func TestWAL_GroupCommit(t *testing.T) {
+	fs := newCountingFS()
+	fs.syncDelay = time.Millisecond // Writers queue up behind a commit
+	opts := Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    1 * GB,
+		SyncInterval:   1 * time.Hour,
+		MaxCommitDelay: 10 * time.Millisecond,
+		FS:             fs,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+
+	// Under load the commits are shared and the window widens
+	syncs := fs.syncs.Load()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := wal.WriteLevel([]byte(fmt.Sprintf("record %d-%d", g, i)), Synced)
+				assert.NoError(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Less(t, fs.syncs.Load()-syncs, int64(400))
+	assert.Greater(t, wal.CommitWindow(), time.Duration(0))
+
+	// Sparse writes are synced right away
+	for i := 0; i < 30; i++ {
+		time.Sleep(11 * time.Millisecond)
+		syncs := fs.syncs.Load()
+		_, err := wal.WriteLevel([]byte("sparse"), Synced)
+		assert.NoError(t, err)
+		assert.Equal(t, syncs+1, fs.syncs.Load(), "the record is durable on return")
+	}
+	assert.Equal(t, time.Duration(0), wal.CommitWindow())
+	assert.NoError(t, wal.Close())
+
+	_, err = wal.WriteLevel([]byte("late"), Synced)
+	assert.Error(t, err)
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	n := 0
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		n++
+	}
+	assert.Equal(t, 830, n)
+}
+
+func TestWAL_Neighbors(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 50; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Greater(t, wal.segment.Id(), 2)
+
+	for _, i := range []int{1, 25, 48} {
+		prev, data, next, err := wal.Neighbors(positions[i])
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+		assert.Equal(t, positions[i-1], prev)
+		assert.Equal(t, positions[i+1], next)
+	}
+	// Across a segment boundary
+	for i := 1; i < len(positions); i++ {
+		if positions[i].SegmentId != positions[i-1].SegmentId {
+			prev, _, _, err := wal.Neighbors(positions[i])
+			assert.NoError(t, err)
+			assert.Equal(t, positions[i-1], prev)
+			_, _, next, err := wal.Neighbors(positions[i-1])
+			assert.NoError(t, err)
+			assert.Equal(t, positions[i], next)
+		}
+	}
+
+	// The ends of the log
+	prev, _, _, err := wal.Neighbors(positions[0])
+	assert.NoError(t, err)
+	assert.Nil(t, prev)
+	_, _, next, err := wal.Neighbors(positions[49])
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+
+	_, _, _, err = wal.Neighbors(&Position{SegmentId: positions[3].SegmentId, BlockId: positions[3].BlockId, Offset: positions[3].Offset + 1})
+	assert.Error(t, err)
+}
+
+func TestWAL_MetricsJSON(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+
+	raw, err := wal.MetricsJSON()
+	assert.NoError(t, err)
+	var m map[string]int64
+	assert.NoError(t, json.Unmarshal(raw, &m))
+	for _, key := range []string{
+		"payload_bytes", "physical_bytes", "padding_bytes", "records", "syncs", "rotations",
+		"cache_hits", "cache_misses", "crc_failures",
+		"segments", "active_segment_id", "active_size", "total_size",
+	} {
+		assert.Contains(t, m, key)
+	}
+	assert.Equal(t, int64(20), m["records"])
+	assert.Greater(t, m["rotations"], int64(0))
+	assert.Equal(t, m["rotations"]+1, m["segments"])
+	assert.GreaterOrEqual(t, m["syncs"], m["rotations"]+1)
+	assert.Equal(t, int64(0), m["crc_failures"])
+}
+
+func TestWAL_Stats(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	stats := wal.Stats()
+	assert.Equal(t, 1, stats.Segments)
+	assert.Equal(t, int64(0), stats.Records)
+
+	for round := 0; round < 3; round++ {
+		if round > 0 {
+			assert.NoError(t, wal.rotate())
+		}
+		for i := 0; i < 10; i++ {
+			_, err := wal.Write(make([]byte, 100))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, wal.Sync())
+
+	stats = wal.Stats()
+	assert.Equal(t, 3, stats.Segments)
+	assert.Equal(t, wal.segment.Id(), stats.ActiveSegmentId)
+	assert.Equal(t, int64(30), stats.Records)
+	assert.Equal(t, int64(3000), stats.PayloadBytes)
+	assert.Equal(t, int64(2), stats.Rotations)
+	assert.Equal(t, int64(3), stats.Syncs)
+	var total int64
+	for _, seg := range wal.segments {
+		fi, err := os.Stat(seg.path)
+		assert.NoError(t, err)
+		total += fi.Size()
+	}
+	assert.Equal(t, total, stats.TotalSize)
+}
+
+func TestWAL_NoSplit(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		NoSplit:      true,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records [][]byte
+	for i := 0; i < 40; i++ {
+		record := bytes.Repeat([]byte{byte('a' + i%26)}, 1000+i*311)
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	pos, err := wal.Write(make([]byte, blockSize-ChecksumCRC32.chunkHeaderSize()))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pos.Offset, "a record filling a block starts a new one")
+	_, err = wal.Write(make([]byte, blockSize))
+	assert.ErrorIs(t, err, ErrRecordTooLarge)
+	assert.NoError(t, wal.Sync())
+
+	var dump bytes.Buffer
+	assert.NoError(t, wal.DumpSegment(0, &dump))
+	assert.Contains(t, dump.String(), "type=full")
+	for _, chunkType := range []string{"type=first", "type=middle", "type=last"} {
+		assert.NotContains(t, dump.String(), chunkType)
+	}
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, records[i], data)
+	}
+}
+
+func TestWAL_ReadBufferConcurrent(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	var records [][]byte
+	for i := 0; i < 100; i++ {
+		record := bytes.Repeat([]byte{byte(i)}, 10+i*997)
+		pos, err := wal.Write(record)
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+		records = append(records, record)
+	}
+	assert.NoError(t, wal.Sync())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				i := (g*31 + n*7) % len(positions)
+				buf, err := wal.ReadBuffer(positions[i])
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, records[i], buf.Bytes())
+				buf.Release()
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestWAL_ReadContext(t *testing.T) {
+	fs := newStallingFS()
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		FS:           fs,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	pos, err := wal.Write([]byte("record"))
+	assert.NoError(t, err)
+	_, err = wal.Write(make([]byte, blockSize))
+	assert.NoError(t, err)
+	uncached, err := wal.Write([]byte("uncached"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+
+	data, err := wal.ReadContext(context.Background(), pos)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record"), data)
+
+	// A stalled read returns on the deadline and does not hold the WAL
+	pos = uncached
+	fs.stall.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = wal.ReadContext(ctx, pos)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 1*time.Second)
+	_, err = wal.Write([]byte("after"))
+	assert.NoError(t, err)
+
+	close(fs.release)
+	_, err = wal.ReadContext(ctx, pos)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestWAL_ReadContextLikeRead(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:      t.TempDir(),
+		SegmentSize:    4 * KB,
+		SyncInterval:   1 * time.Hour,
+		FlushOnRead:    true,
+		BlockCacheSize: 1 * MB,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 200; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+
+	// A buffered record is flushed with FlushOnRead, like with Read
+	last := positions[len(positions)-1]
+	data, err := wal.ReadContext(context.Background(), last)
+	assert.NoError(t, err)
+	assert.Equal(t, "record 199", string(data))
+
+	// Sealed segments are read through the shared block cache
+	assert.NoError(t, wal.Sync())
+	_, err = wal.ReadContext(context.Background(), positions[0])
+	assert.NoError(t, err)
+	misses := wal.Stats().CacheMisses
+	data, err = wal.ReadContext(context.Background(), positions[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "record 1", string(data))
+	assert.Equal(t, misses, wal.Stats().CacheMisses)
+}
+
+func TestOpen_ReleasesFilesOnError(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// Loading the sequence index fails after the segments were opened
+	fs := newTrackingFS(seqIndexFile)
+	opts.FS = fs
+	opts.SequenceIndex = true
+	_, err = Open(opts)
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), fs.open.Load())
+}
+
+func TestWAL_SyncContext(t *testing.T) {
+	fs := newCountingFS()
+	fs.syncDelay = 100 * time.Millisecond
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		FS:           fs,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	_, err = wal.Write([]byte("first"))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, wal.SyncContext(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 80*time.Millisecond)
+
+	// A write stuck behind the abandoned sync gives up without writing
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	pos, err := wal.WriteContext(ctx, []byte("dropped"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, pos)
+
+	_, err = wal.WriteContext(context.Background(), []byte("after"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.SyncContext(context.Background()))
+	assert.NoError(t, wal.LastSyncError())
+
+	reader, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	var records []string
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		records = append(records, string(data))
+	}
+	assert.Equal(t, []string{"first", "after"}, records)
+}
+
+func TestWAL_WriteContextWaits(t *testing.T) {
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// A write with a cancelable context queues for the WAL like Write
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wal.mu.Lock()
+	written := make(chan error)
+	go func() {
+		_, err := wal.WriteContext(ctx, []byte("queued"))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("WriteContext returned %v while the WAL was locked", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	wal.mu.Unlock()
+	assert.NoError(t, <-written)
+
+	// Giving up leaves the WAL unlocked once the waiter gets the lock
+	wal.mu.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = wal.WriteContext(ctx, []byte("dropped"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	wal.mu.Unlock()
+	_, err = wal.Write([]byte("after"))
+	assert.NoError(t, err)
+}
+
+func TestWAL_WriteContextSyncAlways(t *testing.T) {
+	fs := newCountingFS()
+	fs.syncDelay = 100 * time.Millisecond
+	wal, err := Open(Options{
+		Directory:   t.TempDir(),
+		SegmentSize: 1 * GB,
+		SyncPolicy:  SyncAlways,
+		FS:          fs,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// The record is written, only the wait for its sync is abandoned
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	pos, err := wal.WriteContext(ctx, []byte("record"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotNil(t, pos)
+
+	assert.NoError(t, wal.Sync())
+	data, err := wal.Read(pos)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("record"), data)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = wal.WriteContext(ctx, []byte("canceled"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestWAL_ConcurrentReads(t *testing.T) {
+	fs := newStallingFS()
+	wal, err := Open(Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  256,
+		SyncInterval: 1 * time.Hour,
+		FS:           fs,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var positions []*Position
+	for i := 0; i < 40; i++ {
+		pos, err := wal.Write([]byte(fmt.Sprintf("record %d", i)))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+	first, last := positions[0], positions[30]
+	assert.Greater(t, last.SegmentId, first.SegmentId)
+
+	// A read stalled on the disk does not hold up a read of another segment
+	_, err = wal.Read(last) // Cached, so the next read does not touch the disk
+	assert.NoError(t, err)
+	fs.stall.Store(true)
+	stalled := make(chan []byte)
+	go func() {
+		data, err := wal.Read(first)
+		assert.NoError(t, err)
+		stalled <- data
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan []byte, 1)
+	go func() {
+		data, err := wal.Read(last)
+		assert.NoError(t, err)
+		done <- data
+	}()
+	select {
+	case data := <-done:
+		assert.Equal(t, "record 30", string(data))
+	case <-time.After(time.Second):
+		t.Error("the read waited for the stalled one")
+	}
+	fs.stall.Store(false)
+	close(fs.release)
+	assert.Equal(t, "record 0", string(<-stalled))
+
+	// Readers and reads run alongside the writer
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				n := (g*7 + i) % len(positions)
+				data, err := wal.Read(positions[n])
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("record %d", n), string(data))
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			start := *first // Advanced by the reader
+			reader, err := wal.NewReader(&start)
+			assert.NoError(t, err)
+			defer reader.Close()
+			for i := range positions {
+				data, err := reader.Next()
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("record %d", i), string(data))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("more %d", i)))
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+}
+
+func TestWAL_MaxWriteLatency(t *testing.T) {
+	fs := newCountingFS()
+	fs.syncDelay = 200 * time.Millisecond
+	wal, err := Open(Options{
+		Directory:       t.TempDir(),
+		SegmentSize:     1 * GB,
+		SyncInterval:    1 * time.Hour,
+		MaxWriteLatency: 20 * time.Millisecond,
+		FS:              fs,
+	})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	first, err := wal.Write([]byte("before"))
+	assert.NoError(t, err)
+
+	// A slow sync holds the WAL
+	synced := make(chan error)
+	go func() { synced <- wal.Sync() }()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	_, err = wal.Write([]byte("shed"))
+	assert.ErrorIs(t, err, ErrWriteShed)
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+	_, err = wal.WriteLevel([]byte("shed"), Flushed)
+	assert.ErrorIs(t, err, ErrWriteShed)
+	assert.NoError(t, <-synced)
+
+	// Writes go through again and the shed ones left no trace
+	second, err := wal.Write([]byte("after"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Sync())
+	r, err := wal.NewReader(first)
+	assert.NoError(t, err)
+	for _, expected := range []string{"before", "after"} {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestWAL_MixedSegmentFormats(t *testing.T) {
+	// A segment written before segment headers existed, as left behind by
+	// an older version of the package
+	dir := t.TempDir()
+	var legacy []byte
+	for _, data := range []string{"legacy 0", "legacy 1"} {
+		chunk := make([]byte, ChecksumCRC32.chunkHeaderSize())
+		chunkFormat{}.putHeader(chunk, uint64(crc32.ChecksumIEEE([]byte(data))), len(data), kFullType)
+		legacy = append(append(legacy, chunk...), data...)
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, defaultPathFor(0)), legacy, 0644))
+
+	opts := Options{
+		Directory:    dir,
+		SegmentSize:  1 * GB,
+		SyncInterval: 1 * time.Hour,
+		ChunkLayout:  LayoutLengthFirst,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	pos, err := wal.Write([]byte("current 0"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pos.SegmentId, "new records are not appended to the legacy segment")
+	_, err = wal.Write([]byte("current 1"))
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.True(t, wal.segments[0].legacy())
+	assert.Equal(t, byte(segmentHeaderVersion), wal.segments[1].header.version)
+	assert.Equal(t, LayoutLengthFirst, wal.segments[1].header.layout)
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	for _, want := range []string{"legacy 0", "legacy 1", "current 0", "current 1"} {
+		data, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func TestWAL_ChecksumType(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  1024,
+		SyncInterval: 1 * time.Hour,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("crc32 record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Close())
+
+	// Old segments keep verifying with CRC-32, new ones use CRC-64
+	opts.ChecksumType = ChecksumCRC64
+	opts.ChunkLayout = LayoutLengthFirst
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	first := wal.segment.Id()
+	for i := 0; i < 30; i++ {
+		_, err := wal.Write([]byte(fmt.Sprintf("crc64 record %d", i)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, wal.segment.Id(), first)
+	assert.Equal(t, ChecksumCRC32, wal.segments[0].header.checksum)
+	assert.Equal(t, ChecksumCRC64, wal.segment.header.checksum)
+	assert.Equal(t, 11, wal.segment.chunkHeaderSize())
+
+	r, err := wal.NewReader(&Position{})
+	assert.NoError(t, err)
+	defer r.Close()
+	for _, prefix := range []string{"crc32", "crc64"} {
+		for i := 0; i < 30; i++ {
+			data, err := r.Next()
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%s record %d", prefix, i), string(data))
+		}
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+
+	// A corrupt payload is detected with the wider checksum too
+	pos := wal.segment.dataStart + wal.segment.chunkHeaderSize()
+	raw, err := os.ReadFile(wal.segment.path)
+	assert.NoError(t, err)
+	raw[pos] ^= 0xff
+	assert.NoError(t, os.WriteFile(wal.segment.path, raw, 0644))
+	wal.segment.cachedBlock.id = -1
+	_, err = wal.Read(&Position{SegmentId: wal.segment.Id(), Offset: wal.segment.dataStart})
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+}
+
+func TestWAL_BlockSizeAboveChunkLength(t *testing.T) {
+	// Blocks above 64KB would hold chunks whose length overflows the 2 byte
+	// length field of the chunk header
+	dir := t.TempDir()
+	_, err := Open(Options{Directory: dir, SegmentSize: 1 * GB, BlockSize: 128 * KB})
+	assert.ErrorContains(t, err, "BlockSize must be a power of two")
+
+	header := segmentHeader{version: segmentHeaderVersion, blockSize: 128 * KB}
+	path := filepath.Join(dir, defaultPathFor(0))
+	assert.NoError(t, os.WriteFile(path, header.encode(), 0644))
+	_, err = Open(Options{Directory: dir, SegmentSize: 1 * GB, BlockSize: 64 * KB})
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	seg, err := NewSegment(1, filepath.Join(t.TempDir(), "1.wal"))
+	assert.NoError(t, err)
+	defer seg.Close()
+	size := seg.Size()
+	_, err = seg.writeChunk(make([]byte, math.MaxUint16+1), kFullType)
+	assert.ErrorContains(t, err, "exceeds")
+	assert.Equal(t, size, seg.Size())
+}
+
+func TestWAL_NoChecksum(t *testing.T) {
+	opts := Options{
+		Directory:    t.TempDir(),
+		SegmentSize:  64 * KB,
+		SyncInterval: 1 * time.Hour,
+		NoChecksum:   true,
+	}
+	wal, err := Open(opts)
+	assert.NoError(t, err)
+	var positions []*Position
+	for i := 0; i < 50; i++ {
+		pos, err := wal.Write(bytes.Repeat([]byte{byte(i)}, 100+i*97))
+		assert.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	assert.NoError(t, wal.Sync())
+	assert.Greater(t, len(wal.segments), 1)
+	assert.Equal(t, checksumNone, wal.segment.header.checksum)
+	assert.Equal(t, 7, wal.segment.chunkHeaderSize())
+	raw, err := os.ReadFile(wal.segment.path)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 4), raw[wal.segment.dataStart:wal.segment.dataStart+4])
+	assert.NoError(t, wal.Close())
+
+	// The segments read back unverified with or without the option
+	opts.NoChecksum = false
+	wal, err = Open(opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+	for i, pos := range positions {
+		data, err := wal.Read(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 100+i*97), data)
+	}
+	report, err := wal.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, checksumNone, wal.segments[positions[0].SegmentId].header.checksum)
+
+	// New segments are checksummed again
+	assert.NoError(t, wal.rotate())
+	assert.Equal(t, ChecksumCRC32, wal.segment.header.checksum)
+}
+
+func TestWAL_BlockSize(t *testing.T) {
+	for _, size := range []int{4 * KB, 64 * KB} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			opts := Options{
+				Directory:    t.TempDir(),
+				SegmentSize:  256 * KB,
+				SyncInterval: 1 * time.Hour,
+				BlockSize:    size,
+			}
+			wal, err := Open(opts)
+			assert.NoError(t, err)
+			var records [][]byte
+			var positions []*Position
+			for i := 0; i < 200; i++ {
+				record := bytes.Repeat([]byte{byte(i)}, i*97%(3*size))
+				pos, err := wal.Write(record)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, pos.Offset, size-ChecksumCRC32.chunkHeaderSize())
+				records = append(records, record)
+				positions = append(positions, pos)
+			}
+			assert.NoError(t, wal.Close())
+
+			wal, err = Open(opts)
+			assert.NoError(t, err)
+			assert.Equal(t, size, wal.segment.blockSize)
+			r, err := wal.NewReader(&Position{})
+			assert.NoError(t, err)
+			for i := range records {
+				data, at, err := r.next()
+				assert.NoError(t, err)
+				assert.Equal(t, *positions[i], at)
+				assert.Equal(t, records[i], data)
+			}
+			report, err := wal.Verify()
+			assert.NoError(t, err)
+			assert.Empty(t, report.Errors)
+			assert.NoError(t, wal.Close())
+
+			// The segments keep the block size they were written with
+			opts.BlockSize = 0
+			_, err = Open(opts)
+			assert.ErrorIs(t, err, ErrBlockSizeMismatch)
+		})
+	}
+}